@@ -0,0 +1,28 @@
+package prm
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AuditPRM records a security relevant event. Audit events are always logged,
+// whatever the log level, as a single line of key=value pairs so they are
+// easy to pull out of the logs
+func (prm *PRM) AuditPRM(event string, username string, r *http.Request, details ...string) {
+	fields := []string{"event=" + event, "user=" + strconv.Quote(username)}
+
+	if r != nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		fields = append(fields, "ip="+host)
+	}
+
+	fields = append(fields, details...)
+
+	log.Println("[prm:audit]", strings.Join(fields, " "))
+}
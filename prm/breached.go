@@ -0,0 +1,132 @@
+package prm
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The breached password corpus is a text file in the Pwned Passwords download
+// format - one "HASH:COUNT" per line, sorted by hash. As the file is sorted we
+// can binary search it on disk rather than loading the lot into memory.
+
+// breachedHash returns the uppercase hex hash of the password in the format
+// the corpus has been downloaded in, either sha1 (the default) or ntlm
+func (prm *PRM) breachedHash(password string) string {
+	if strings.ToLower(prm.Config.BreachedHash) == "ntlm" {
+		return strings.ToUpper(Ntlmgen(password))
+	}
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// lineAt returns the first full line in the file that starts at or after pos,
+// along with the offset it starts at
+func lineAt(f io.ReaderAt, pos int64, size int64) (start int64, line string, err error) {
+	start = pos
+	if pos > 0 {
+		// Step back one so a line starting exactly at pos is not skipped
+		reader := bufio.NewReader(io.NewSectionReader(f, pos-1, size-pos+1))
+		skipped, err := reader.ReadString('\n')
+		if err != nil {
+			return size, "", nil
+		}
+		start = pos - 1 + int64(len(skipped))
+		line, err = reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return start, "", err
+		}
+		return start, line, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	line, err = reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return start, "", err
+	}
+	return start, line, nil
+}
+
+// searchBreached binary searches a sorted corpus for hash and returns the
+// number of occurrences recorded against it, or 0 if it is not present
+func searchBreached(f io.ReaderAt, size int64, hash string) (int, error) {
+	lo, hi := int64(0), size
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := lineAt(f, mid, size)
+		if err != nil {
+			return 0, err
+		}
+
+		if start >= hi || len(line) == 0 {
+			hi = mid
+			continue
+		}
+
+		entry := strings.TrimRight(line, "\r\n")
+		entryHash := entry
+		count := 1
+		if i := strings.IndexByte(entry, ':'); i >= 0 {
+			entryHash = entry[:i]
+			count, err = strconv.Atoi(strings.TrimSpace(entry[i+1:]))
+			if err != nil {
+				count = 1
+			}
+		}
+		entryHash = strings.ToUpper(entryHash)
+
+		if entryHash == hash {
+			return count, nil
+		}
+
+		if entryHash < hash {
+			lo = start + int64(len(line))
+		} else {
+			hi = mid
+		}
+	}
+
+	return 0, nil
+}
+
+// BreachedPasswordCount returns the number of times a password appears in the
+// configured breach corpus. If no corpus is configured it always returns 0
+func (prm *PRM) BreachedPasswordCount(password string) (int, error) {
+	if prm.Config.BreachedFile == "" {
+		return 0, nil
+	}
+
+	f, err := os.Open(prm.Config.BreachedFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return searchBreached(f, fileInfo.Size(), prm.breachedHash(password))
+}
+
+// PasswordBreached returns true if the password appears in the breach corpus
+// at least as many times as the configured threshold
+func (prm *PRM) PasswordBreached(password string) (bool, error) {
+	count, err := prm.BreachedPasswordCount(password)
+	if err != nil {
+		return false, err
+	}
+
+	threshold := prm.Config.BreachedThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return count >= threshold, nil
+}
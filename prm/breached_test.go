@@ -0,0 +1,78 @@
+package prm
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Write out a small sorted corpus in the Pwned Passwords format
+func writeBreachedCorpus(t *testing.T, lines []string) string {
+	f, err := ioutil.TempFile("", "breached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.WriteString(strings.Join(lines, "\r\n") + "\r\n")
+	return f.Name()
+}
+
+// Test lookups against the start, middle and end of a corpus
+func TestBreachedPasswordCount(t *testing.T) {
+
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+
+	// sha1 of "password", "123456" and "letmein" plus some filler
+	lines := []string{
+		"000000005AD76BD555C1D6D771DE417A4B87E4B4:10",
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493",
+		"7C4A8D09CA3762AF61E59520943DC26494F8941B:37359195",
+		"B7A875FC1EA228B9061041B7CEC4BD3C52AB3CE3:250000",
+		"FFFFFFF8A0382AA9C8D9536EFBA77F261815334D:2",
+	}
+	prm.Config.BreachedFile = writeBreachedCorpus(t, lines)
+	defer os.Remove(prm.Config.BreachedFile)
+
+	var test_map = map[string]int{
+		"password":               3861493,
+		"123456":                 37359195,
+		"letmein":                250000,
+		"adoiah1223423sfdiunIOH": 0,
+	}
+
+	for password, expected := range test_map {
+		count, err := prm.BreachedPasswordCount(password)
+		if err != nil {
+			t.Error("For:", password, "got error:", err)
+		}
+		if count != expected {
+			t.Error("For:", password, "got:", count, "expected:", expected)
+		}
+	}
+
+	prm.Config.BreachedThreshold = 300000
+	breached, _ := prm.PasswordBreached("letmein")
+	if breached {
+		t.Error("letmein should be under the threshold")
+	}
+
+	breached, _ = prm.PasswordBreached("password")
+	if !breached {
+		t.Error("password should be over the threshold")
+	}
+}
+
+// Test that no configured corpus means no breaches
+func TestBreachedDisabled(t *testing.T) {
+
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+
+	breached, err := prm.PasswordBreached("password")
+	if breached || err != nil {
+		t.Error("Expected no breach and no error with no corpus, got:", breached, err)
+	}
+}
@@ -1,43 +1,504 @@
 package prm
 
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
 // There is probably a better way to do this but we
 // are doing type conversion so unless we mess with
 // yaml parser, loading yaml then converting seems best
 
 type PRMConfig struct {
-	TemplatePath           string
-	ListenAddress          string
-	LDAPHost               string
-	LDAPPort               int
-	BindPassword           string
-	CertFilePath           string
-	BaseDN                 string
-	BindDN                 string
-	LogLevel               int
-	EmailMsg               string
-	EmailSub               string
-	LDAPInsecureSkipVerify bool
-	Uffer                  string
-	PasswordModifyLDAP     string
-	ORGFieldLDAP           string
-	UserFieldLDAP          string
+	TemplatePath             string
+	ListenAddress            string
+	LDAPHost                 string
+	LDAPPort                 int
+	BindPassword             string
+	CertFilePath             string
+	BaseDN                   string
+	BindDN                   string
+	LogLevel                 int
+	EmailMsg                 string
+	EmailSub                 string
+	LDAPInsecureSkipVerify   bool
+	Uffer                    string
+	PasswordModifyLDAP       string
+	ORGFieldLDAP             string
+	UserFieldLDAP            string
+	BreachedFile             string
+	BreachedHash             string
+	BreachedThreshold        int
+	HistoryAttribute         string
+	HistoryLength            int
+	MinPasswordScore         int
+	ContextAttributes        []string
+	PassphraseLength         int
+	PassphraseMinWords       int
+	PassphraseMinEntropy     float64
+	PassphraseWords          int
+	WordListPath             string
+	PendingPath              string
+	ReplayPath               string
+	UfferKeys                map[string]string
+	UfferPrimary             string
+	TermsTimeout             int
+	TermsMode                string
+	TermsVersion             string
+	TermsAttribute           string
+	SecurityHeaders          map[string]string
+	MaxRequestBytes          int64
+	TOTPAttribute            string
+	TOTPIssuer               string
+	TOTPRequiredGroups       []string
+	TOTPGroupAttribute       string
+	TOTPMaxTries             int
+	AlternateEmailAttribute  string
+	OTPEmailSub              string
+	OTPEmailMsg              string
+	DisableLegacyOTP         bool
+	OTPAttribute             string
+	OTPLength                int
+	OTPAlphabet              string
+	OTPEncoding              string
+	ResetURL                 string
+	ResetTimeout             int
+	ResetEmailAttribute      string
+	ResetEmailSub            string
+	ResetEmailMsg            string
+	RecoveryAttribute        string
+	SMTPHost                 string
+	SMTPPort                 int
+	SMTPTLS                  string
+	SMTPUsername             string
+	SMTPPasswordFile         string
+	SMTPTimeout              int
+	EmailFrom                string
+	EmailReplyTo             string
+	EmailEnvelopeFrom        string
+	HelpdeskURL              string
+	HelpdeskContact          string
+	LocalePath               string
+	DefaultLanguage          string
+	MailSpoolPath            string
+	MailMaxAttempts          int
+	NotifyEvents             []string
+	NotifySecondaryAttribute string
+	NotifyPath               string
+	NotifyInterval           int
+	NotifyFailures           int
+	OTPMaxFailures           int
+	MissingEmailPolicy       string
+	MissingEmailDomain       string
+	AlertEmail               []string
+	catalogues               map[string]*Catalogue
 }
 
 type YamlConfig struct {
-	TemplatePath           string
-	ListenAddress          string
-	LDAPHost               string
-	LDAPPort               int
-	BindPassword           string
-	CertFilePath           string
-	BaseDN                 string
-	BindDN                 string
-	LogLevel               string
-	EmailMsg               string
-	EmailSub               string
-	LDAPInsecureSkipVerify bool
-	Uffer                  string
-	PasswordModifyLDAP     string
-	ORGFieldLDAP           string
-	UserFieldLDAP          string
+	TemplatePath             string
+	ListenAddress            string
+	LDAPHost                 string
+	LDAPPort                 int
+	BindPassword             string
+	CertFilePath             string
+	BaseDN                   string
+	BindDN                   string
+	LogLevel                 string
+	EmailMsg                 string
+	EmailSub                 string
+	LDAPInsecureSkipVerify   bool
+	Uffer                    string
+	PasswordModifyLDAP       string
+	ORGFieldLDAP             string
+	UserFieldLDAP            string
+	BreachedFile             string
+	BreachedHash             string
+	BreachedThreshold        int
+	HistoryAttribute         string
+	HistoryLength            int
+	MinPasswordScore         int
+	ContextAttributes        []string
+	PassphraseLength         int
+	PassphraseMinWords       int
+	PassphraseMinEntropy     float64
+	PassphraseWords          int
+	WordListPath             string
+	PendingPath              string
+	ReplayPath               string
+	UfferKeys                map[string]string
+	UfferPrimary             string
+	TermsTimeout             int
+	TermsMode                string
+	TermsVersion             string
+	TermsAttribute           string
+	SecurityHeaders          map[string]string
+	MaxRequestBytes          int64
+	TOTPAttribute            string
+	TOTPIssuer               string
+	TOTPRequiredGroups       []string
+	TOTPGroupAttribute       string
+	TOTPMaxTries             int
+	AlternateEmailAttribute  string
+	OTPEmailSub              string
+	OTPEmailMsg              string
+	DisableLegacyOTP         bool
+	OTPAttribute             string
+	OTPLength                int
+	OTPAlphabet              string
+	OTPEncoding              string
+	ResetURL                 string
+	ResetTimeout             int
+	ResetEmailAttribute      string
+	ResetEmailSub            string
+	ResetEmailMsg            string
+	RecoveryAttribute        string
+	SMTPHost                 string
+	SMTPPort                 int
+	SMTPTLS                  string
+	SMTPUsername             string
+	SMTPPasswordFile         string
+	SMTPTimeout              int
+	EmailFrom                string
+	EmailReplyTo             string
+	EmailEnvelopeFrom        string
+	HelpdeskURL              string
+	HelpdeskContact          string
+	LocalePath               string
+	DefaultLanguage          string
+	MailSpoolPath            string
+	MailMaxAttempts          int
+	NotifyEvents             []string
+	NotifySecondaryAttribute string
+	NotifyPath               string
+	NotifyInterval           int
+	NotifyFailures           int
+	OTPMaxFailures           int
+	MissingEmailPolicy       string
+	MissingEmailDomain       string
+	AlertEmail               []string
+}
+
+// ReadConfig reads in the YAML config file named by UPRM_CONFIG_FILE,
+// setting the PRMConfig used throughout the system. It panics if the file
+// can't be read, as nothing can work without it
+func ReadConfig(p *PRM) {
+	filename, _ := filepath.Abs(os.Getenv("UPRM_CONFIG_FILE"))
+	if err := ReadConfigFile(p, filename); err != nil {
+		panic(err)
+	}
+}
+
+// ReadConfigFile reads in the YAML config file given, filling in defaults
+// for anything left out
+func ReadConfigFile(p *PRM, filename string) error {
+
+	yamlConfig := YamlConfig{}
+	yamlFile, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return err
+	}
+
+	err = yaml.Unmarshal(yamlFile, &yamlConfig)
+	if err != nil {
+		return err
+	}
+
+	// Now convert
+	config := new(PRMConfig)
+
+	// Potentially we should set all to defaults and check for missing
+	config.TemplatePath = yamlConfig.TemplatePath
+	config.ListenAddress = yamlConfig.ListenAddress
+	config.LDAPHost = yamlConfig.LDAPHost
+	config.LDAPPort = yamlConfig.LDAPPort
+	config.BindPassword = yamlConfig.BindPassword
+	config.CertFilePath = yamlConfig.CertFilePath
+	config.BaseDN = yamlConfig.BaseDN
+	config.BindDN = yamlConfig.BindDN
+	config.EmailMsg = yamlConfig.EmailMsg
+	config.EmailSub = yamlConfig.EmailSub
+	config.LogLevel = LOG_ERROR
+	config.Uffer = yamlConfig.Uffer
+	config.LDAPInsecureSkipVerify = yamlConfig.LDAPInsecureSkipVerify
+	config.PasswordModifyLDAP = yamlConfig.PasswordModifyLDAP
+	config.ORGFieldLDAP = yamlConfig.ORGFieldLDAP
+	config.UserFieldLDAP = yamlConfig.UserFieldLDAP
+	config.BreachedFile = yamlConfig.BreachedFile
+	config.BreachedHash = yamlConfig.BreachedHash
+	config.BreachedThreshold = yamlConfig.BreachedThreshold
+	config.HistoryAttribute = yamlConfig.HistoryAttribute
+	config.HistoryLength = yamlConfig.HistoryLength
+	config.MinPasswordScore = yamlConfig.MinPasswordScore
+	config.ContextAttributes = yamlConfig.ContextAttributes
+	config.PassphraseLength = yamlConfig.PassphraseLength
+	config.PassphraseMinWords = yamlConfig.PassphraseMinWords
+	config.PassphraseMinEntropy = yamlConfig.PassphraseMinEntropy
+	config.PassphraseWords = yamlConfig.PassphraseWords
+	config.WordListPath = yamlConfig.WordListPath
+	config.PendingPath = yamlConfig.PendingPath
+	config.ReplayPath = yamlConfig.ReplayPath
+	config.UfferKeys = yamlConfig.UfferKeys
+	config.UfferPrimary = yamlConfig.UfferPrimary
+	config.TermsTimeout = yamlConfig.TermsTimeout
+	config.TermsMode = yamlConfig.TermsMode
+	config.TermsVersion = yamlConfig.TermsVersion
+	config.TermsAttribute = yamlConfig.TermsAttribute
+	config.SecurityHeaders = yamlConfig.SecurityHeaders
+	config.MaxRequestBytes = yamlConfig.MaxRequestBytes
+	config.TOTPAttribute = yamlConfig.TOTPAttribute
+	config.TOTPIssuer = yamlConfig.TOTPIssuer
+	config.TOTPRequiredGroups = yamlConfig.TOTPRequiredGroups
+	config.TOTPGroupAttribute = yamlConfig.TOTPGroupAttribute
+	config.TOTPMaxTries = yamlConfig.TOTPMaxTries
+	config.AlternateEmailAttribute = yamlConfig.AlternateEmailAttribute
+	config.OTPEmailSub = yamlConfig.OTPEmailSub
+	config.OTPEmailMsg = yamlConfig.OTPEmailMsg
+	config.DisableLegacyOTP = yamlConfig.DisableLegacyOTP
+	config.OTPAttribute = yamlConfig.OTPAttribute
+	config.OTPLength = yamlConfig.OTPLength
+	config.OTPAlphabet = yamlConfig.OTPAlphabet
+	config.OTPEncoding = yamlConfig.OTPEncoding
+	config.ResetURL = yamlConfig.ResetURL
+	config.ResetTimeout = yamlConfig.ResetTimeout
+	config.ResetEmailAttribute = yamlConfig.ResetEmailAttribute
+	config.ResetEmailSub = yamlConfig.ResetEmailSub
+	config.ResetEmailMsg = yamlConfig.ResetEmailMsg
+	config.RecoveryAttribute = yamlConfig.RecoveryAttribute
+	config.SMTPHost = yamlConfig.SMTPHost
+	config.SMTPPort = yamlConfig.SMTPPort
+	config.SMTPTLS = yamlConfig.SMTPTLS
+	config.SMTPUsername = yamlConfig.SMTPUsername
+	config.SMTPPasswordFile = yamlConfig.SMTPPasswordFile
+	config.SMTPTimeout = yamlConfig.SMTPTimeout
+	config.EmailFrom = yamlConfig.EmailFrom
+	config.EmailReplyTo = yamlConfig.EmailReplyTo
+	config.EmailEnvelopeFrom = yamlConfig.EmailEnvelopeFrom
+	config.HelpdeskURL = yamlConfig.HelpdeskURL
+	config.HelpdeskContact = yamlConfig.HelpdeskContact
+	config.LocalePath = yamlConfig.LocalePath
+	config.DefaultLanguage = yamlConfig.DefaultLanguage
+	config.MailSpoolPath = yamlConfig.MailSpoolPath
+	config.MailMaxAttempts = yamlConfig.MailMaxAttempts
+	config.NotifyEvents = yamlConfig.NotifyEvents
+	config.NotifySecondaryAttribute = yamlConfig.NotifySecondaryAttribute
+	config.NotifyPath = yamlConfig.NotifyPath
+	config.NotifyInterval = yamlConfig.NotifyInterval
+	config.NotifyFailures = yamlConfig.NotifyFailures
+	config.OTPMaxFailures = yamlConfig.OTPMaxFailures
+	config.MissingEmailPolicy = yamlConfig.MissingEmailPolicy
+	config.MissingEmailDomain = yamlConfig.MissingEmailDomain
+	config.AlertEmail = yamlConfig.AlertEmail
+
+	if config.PassphraseWords < 1 {
+		config.PassphraseWords = 6
+	}
+
+	if config.TermsTimeout < 1 {
+		config.TermsTimeout = 1800
+	}
+
+	if config.MaxRequestBytes < 1 {
+		config.MaxRequestBytes = 64 * 1024
+	}
+
+	if config.TOTPIssuer == "" {
+		config.TOTPIssuer = "PRM"
+	}
+
+	if config.TOTPGroupAttribute == "" {
+		config.TOTPGroupAttribute = "memberOf"
+	}
+
+	if config.TermsMode == "" {
+		config.TermsMode = TermsModeOTP
+	}
+
+	if config.OTPAttribute == "" {
+		config.OTPAttribute = defaultOTPAttribute
+	}
+
+	if config.OTPLength < 1 {
+		config.OTPLength = defaultOTPLength
+	}
+
+	if config.OTPAlphabet == "" {
+		config.OTPAlphabet = defaultOTPAlphabet
+	}
+
+	if config.OTPEncoding == "" {
+		config.OTPEncoding = OTPEncodingHashed
+	}
+
+	if config.ResetTimeout < 1 {
+		config.ResetTimeout = defaultResetTimeout
+	}
+
+	if config.ResetEmailAttribute == "" {
+		config.ResetEmailAttribute = "mail"
+	}
+
+	if config.SMTPHost == "" {
+		config.SMTPHost = defaultSMTPHost
+	}
+
+	if config.SMTPPort < 1 {
+		config.SMTPPort = defaultSMTPPort
+	}
+
+	if config.SMTPTLS == "" {
+		config.SMTPTLS = SMTPTLSAuto
+	}
+
+	if config.SMTPTimeout < 1 {
+		config.SMTPTimeout = defaultSMTPTimeout
+	}
+
+	if config.EmailFrom == "" {
+		config.EmailFrom = defaultEmailFrom
+	}
+
+	if config.HelpdeskContact == "" {
+		config.HelpdeskContact = defaultHelpdeskContact
+	}
+
+	if config.DefaultLanguage == "" {
+		config.DefaultLanguage = defaultLanguage
+	}
+
+	if config.MissingEmailPolicy == "" {
+		config.MissingEmailPolicy = MissingEmailSkip
+	}
+
+	if config.BreachedHash == "" {
+		config.BreachedHash = "sha1"
+	}
+
+	if config.BreachedThreshold < 1 {
+		config.BreachedThreshold = 1
+	}
+
+	if yamlConfig.LogLevel == "DEBUG" {
+		config.LogLevel = LOG_DEBUG
+	}
+
+	if yamlConfig.LogLevel == "INFO" {
+		config.LogLevel = LOG_INFO
+	}
+
+	if yamlConfig.LogLevel == "WARN" {
+		config.LogLevel = LOG_DEBUG
+	}
+
+	if yamlConfig.LogLevel == "ERROR" {
+		config.LogLevel = LOG_ERROR
+	}
+
+	//fmt.Printf("Listening on: %#v\n", config.ListenAddress)
+
+	p.Config = config
+
+	p.LogPRM("Path to Templates: "+config.TemplatePath, LOG_INFO)
+	p.LogPRM("Path to CertFile: "+config.CertFilePath, LOG_INFO)
+	p.LogPRM("Log level: "+LogLevelToString(config.LogLevel), LOG_INFO)
+	p.LogPRM("Listen address: "+config.ListenAddress, LOG_DEBUG)
+	p.LogPRM("LDAP Host address: "+config.LDAPHost, LOG_DEBUG)
+	p.LogPRM("LDAP Port: "+fmt.Sprintf("%d", config.LDAPPort), LOG_DEBUG)
+	p.LogPRM("BaseDN: "+config.BaseDN, LOG_DEBUG)
+	p.LogPRM("BindDN: "+config.BindDN, LOG_DEBUG)
+	p.LogPRM("PasswordModifyLDAP: "+config.PasswordModifyLDAP, LOG_DEBUG)
+	p.LogPRM("ORGFieldLDAP: "+config.ORGFieldLDAP, LOG_DEBUG)
+	p.LogPRM("UserFieldLDAP: "+config.UserFieldLDAP, LOG_DEBUG)
+	p.LogPRM("BreachedFile: "+config.BreachedFile, LOG_DEBUG)
+	p.LogPRM("BreachedHash: "+config.BreachedHash, LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("BreachedThreshold: %d", config.BreachedThreshold), LOG_DEBUG)
+	p.LogPRM("HistoryAttribute: "+config.HistoryAttribute, LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("HistoryLength: %d", config.HistoryLength), LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("MinPasswordScore: %d", config.MinPasswordScore), LOG_DEBUG)
+	p.LogPRM("ContextAttributes: "+strings.Join(config.ContextAttributes, ", "), LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("PassphraseLength: %d", config.PassphraseLength), LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("PassphraseMinWords: %d", config.PassphraseMinWords), LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("PassphraseMinEntropy: %v", config.PassphraseMinEntropy), LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("PassphraseWords: %d", config.PassphraseWords), LOG_DEBUG)
+	p.LogPRM("WordListPath: "+config.WordListPath, LOG_DEBUG)
+	p.LogPRM("PendingPath: "+config.PendingPath, LOG_DEBUG)
+	p.LogPRM("ReplayPath: "+config.ReplayPath, LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("TermsTimeout: %d", config.TermsTimeout), LOG_DEBUG)
+	p.LogPRM("TermsMode: "+config.TermsMode, LOG_DEBUG)
+	p.LogPRM("TermsVersion: "+config.TermsVersion, LOG_DEBUG)
+	p.LogPRM("TermsAttribute: "+config.TermsAttribute, LOG_DEBUG)
+	p.LogPRM("SecurityHeaders: "+strings.Join(p.SecurityHeaderNames(), ", "), LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("MaxRequestBytes: %d", config.MaxRequestBytes), LOG_DEBUG)
+	p.LogPRM("TOTPAttribute: "+config.TOTPAttribute, LOG_DEBUG)
+	p.LogPRM("TOTPIssuer: "+config.TOTPIssuer, LOG_DEBUG)
+	p.LogPRM("TOTPRequiredGroups: "+strings.Join(config.TOTPRequiredGroups, ", "), LOG_DEBUG)
+	p.LogPRM("TOTPGroupAttribute: "+config.TOTPGroupAttribute, LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("TOTPMaxTries: %d", config.TOTPMaxTries), LOG_DEBUG)
+	p.LogPRM("AlternateEmailAttribute: "+config.AlternateEmailAttribute, LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("DisableLegacyOTP: %v", config.DisableLegacyOTP), LOG_DEBUG)
+	p.LogPRM("OTPAttribute: "+config.OTPAttribute, LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("OTPLength: %d", config.OTPLength), LOG_DEBUG)
+	p.LogPRM("OTPAlphabet: "+config.OTPAlphabet, LOG_DEBUG)
+	p.LogPRM("OTPEncoding: "+config.OTPEncoding, LOG_DEBUG)
+	p.LogPRM("ResetURL: "+config.ResetURL, LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("ResetTimeout: %d", config.ResetTimeout), LOG_DEBUG)
+	p.LogPRM("ResetEmailAttribute: "+config.ResetEmailAttribute, LOG_DEBUG)
+	p.LogPRM("RecoveryAttribute: "+config.RecoveryAttribute, LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("SMTP server: %v:%d tls %v timeout %d", config.SMTPHost, config.SMTPPort, config.SMTPTLS, config.SMTPTimeout), LOG_DEBUG)
+	p.LogPRM("SMTPUsername: "+config.SMTPUsername, LOG_DEBUG)
+	p.LogPRM("SMTPPasswordFile: "+config.SMTPPasswordFile, LOG_DEBUG)
+	p.LogPRM("EmailFrom: "+config.EmailFrom, LOG_DEBUG)
+	p.LogPRM("EmailReplyTo: "+config.EmailReplyTo, LOG_DEBUG)
+	p.LogPRM("EmailEnvelopeFrom: "+config.EmailEnvelopeFrom, LOG_DEBUG)
+	p.LogPRM("HelpdeskURL: "+config.HelpdeskURL, LOG_DEBUG)
+	p.LogPRM("HelpdeskContact: "+config.HelpdeskContact, LOG_DEBUG)
+	p.LogPRM("LocalePath: "+config.LocalePath+" default language "+config.DefaultLanguage, LOG_DEBUG)
+	p.LogPRM("MailSpoolPath: "+config.MailSpoolPath, LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("MailMaxAttempts: %d", config.MailMaxAttempts), LOG_DEBUG)
+	p.LogPRM("NotifyEvents: "+strings.Join(config.NotifyEvents, ", "), LOG_DEBUG)
+	p.LogPRM("NotifySecondaryAttribute: "+config.NotifySecondaryAttribute, LOG_DEBUG)
+	p.LogPRM("NotifyPath: "+config.NotifyPath, LOG_DEBUG)
+	p.LogPRM(fmt.Sprintf("NotifyInterval: %d NotifyFailures: %d OTPMaxFailures: %d", config.NotifyInterval, config.NotifyFailures, config.OTPMaxFailures), LOG_DEBUG)
+	p.LogPRM("MissingEmailPolicy: "+config.MissingEmailPolicy+" domain "+config.MissingEmailDomain, LOG_DEBUG)
+	p.LogPRM("AlertEmail: "+strings.Join(config.AlertEmail, ", "), LOG_DEBUG)
+
+	if config.LDAPInsecureSkipVerify {
+		p.LogPRM("LDAP insecure skip verify: true", LOG_DEBUG)
+	} else {
+		p.LogPRM("LDAP insecure skip verify: false", LOG_DEBUG)
+	}
+	p.LogPRM("uffer: "+config.Uffer, LOG_DEBUG)
+	p.LogPRM("Uffer primary key: "+config.UfferPrimary, LOG_DEBUG)
+
+	// Without a usable key nothing could be sealed or opened, so refuse to start
+	if err := p.CheckUfferKeys(); err != nil {
+		return err
+	}
+
+	// A code that can't be generated or read back is no use, so refuse to start
+	if err := p.CheckOTPConfig(); err != nil {
+		return err
+	}
+
+	if err := CheckEmailConfig(config); err != nil {
+		return err
+	}
+
+	if err := p.CheckNotifyConfig(); err != nil {
+		return err
+	}
+
+	// A catalogue with a mistake in it would leave pages half translated
+	if err := CheckLanguageConfig(config); err != nil {
+		return err
+	}
+
+	p.LogPRM("Email message: "+config.EmailMsg, LOG_DEBUG)
+	p.LogPRM("Email subject: "+config.EmailSub, LOG_DEBUG)
+
+	return nil
 }
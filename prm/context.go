@@ -0,0 +1,241 @@
+package prm
+
+import (
+	"gopkg.in/ldap.v2"
+	"strings"
+)
+
+// Context checks stop users basing their password on things an attacker
+// could look up about them - their login, names and email address as well
+// as any other attributes listed in the config.
+
+// minTermLength is the shortest personal term worth checking for. Anything
+// shorter would reject far too many good passwords
+const minTermLength = 3
+
+// Limits on the work done per password, as every term is compared with every
+// part of every variant of the password
+const (
+	maxTermLength    = 32
+	maxTerms         = 32
+	maxL33tVariants  = 3
+	maxContextLength = maxEstimateLength
+)
+
+// personalTerm is a word taken from the users entry, the message saying
+// where it came from and, for attributes from the config, which attribute
+type personalTerm struct {
+	term      string
+	reason    string
+	attribute string
+}
+
+// splitTerm breaks an attribute value into the words within it
+func splitTerm(value string) []string {
+	return strings.FieldsFunc(asciiLower(value), func(c rune) bool {
+		return c == ' ' || c == '.' || c == '_' || c == '-' || c == '@' || c == ',' || c == '\''
+	})
+}
+
+// addTerms adds the value, and each word within it, to the list of terms.
+// Words too short to matter or too long to compare are left out, as is
+// anything beyond maxTerms
+func addTerms(terms []personalTerm, value string, reason string, attribute string) []personalTerm {
+	words := splitTerm(value)
+	candidates := []string{strings.Join(words, "")}
+	if len(words) > 1 {
+		candidates = append(candidates, words...)
+	}
+
+	for _, word := range candidates {
+		if len(terms) >= maxTerms {
+			break
+		}
+		if len(word) >= minTermLength && len(word) <= maxTermLength {
+			terms = append(terms, personalTerm{word, reason, attribute})
+		}
+	}
+	return terms
+}
+
+// personalTerms returns the words from a users entry that should not appear
+// in their password. With no entry only the username is used. The entry must
+// only be used once the user has proved who they are, as the reasons given
+// say where a term came from
+func (prm *PRM) personalTerms(username string, entry *ldap.Entry) []personalTerm {
+	terms := addTerms(nil, username, "it is based on your username", "")
+
+	if entry == nil {
+		return terms
+	}
+
+	terms = addTerms(terms, entry.GetAttributeValue("givenName"), "it is based on your first name", "")
+	terms = addTerms(terms, entry.GetAttributeValue("sn"), "it is based on your surname", "")
+
+	for _, cn := range entry.GetAttributeValues("cn") {
+		terms = addTerms(terms, cn, "it is based on your name", "")
+	}
+
+	for _, mail := range entry.GetAttributeValues("mail") {
+		local := mail
+		if i := strings.Index(mail, "@"); i >= 0 {
+			local = mail[:i]
+		}
+		terms = addTerms(terms, local, "it is based on your email address", "")
+	}
+
+	for _, attribute := range prm.Config.ContextAttributes {
+		for _, value := range entry.GetAttributeValues(attribute) {
+			terms = addTerms(terms, value, "it is based on your %ATTRIBUTE%", attribute)
+		}
+	}
+
+	return terms
+}
+
+// termWords returns just the words from a list of personal terms, for
+// feeding to the strength estimator
+func termWords(terms []personalTerm) []string {
+	var words []string
+	for _, t := range terms {
+		words = append(words, t.term)
+	}
+	return words
+}
+
+// allowedEdits is how far a term may be altered and still count as a match
+func allowedEdits(term string) int {
+	switch {
+	case len(term) >= 8:
+		return 2
+	case len(term) >= 5:
+		return 1
+	}
+	return 0
+}
+
+// withinEdits checks if two strings are at most max edits apart. Only the
+// band of the table within max of the diagonal is filled in, and it gives up
+// as soon as a whole row is over max, so it is cheap for the small max used
+func withinEdits(a, b string, max int) bool {
+	if len(a)-len(b) > max || len(b)-len(a) > max {
+		return false
+	}
+
+	const far = 1 << 30
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		lo, hi := i-max, i+max
+		if lo < 1 {
+			lo = 1
+		}
+		if hi > len(b) {
+			hi = len(b)
+		}
+
+		current[0] = i
+		if lo > 1 {
+			current[lo-1] = far
+		}
+		best := current[0]
+		for j := lo; j <= hi; j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+			if current[j] < best {
+				best = current[j]
+			}
+		}
+		if hi < len(b) {
+			current[hi+1] = far
+		}
+		if best > max {
+			return false
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)] <= max
+}
+
+// nearlyContains checks if any part of s is the term or within a few edits of it
+func nearlyContains(s string, term string) bool {
+	if strings.Contains(s, term) {
+		return true
+	}
+
+	edits := allowedEdits(term)
+	if edits == 0 {
+		return false
+	}
+
+	for length := len(term) - edits; length <= len(term)+edits; length++ {
+		if length < minTermLength {
+			continue
+		}
+		for i := 0; i+length <= len(s); i++ {
+			if withinEdits(s[i:i+length], term, edits) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// passwordVariants returns the password lowercased, reversed and with l33t
+// substitutions undone, so close variants of a term are caught. Only the
+// first maxContextLength bytes are used and only a few l33t variants kept
+func passwordVariants(password string) []string {
+	lower := asciiLower(limitLength(password, maxContextLength))
+
+	reversed := []byte(lower)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+
+	variants := []string{lower, string(reversed)}
+	seen := map[string]bool{lower: true, string(reversed): true}
+
+	for _, v := range variants[:2] {
+		unleeted, _ := unl33t(v)
+		added := 0
+		for _, u := range unleeted {
+			if added < maxL33tVariants && !seen[u] {
+				seen[u] = true
+				variants = append(variants, u)
+				added++
+			}
+		}
+	}
+	return variants
+}
+
+// containsPersonalTerm checks a password against the terms given, returning
+// the reason, a cracklib style message saying which was found, and the
+// attribute to fill in for %ATTRIBUTE% in it, or nil if none were
+func containsPersonalTerm(password string, terms []personalTerm) map[string]string {
+	variants := passwordVariants(password)
+
+	for _, t := range terms {
+		for _, v := range variants {
+			if nearlyContains(v, t.term) {
+				return map[string]string{"reason": t.reason, "attribute": t.attribute}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package prm
+
+import (
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"strings"
+	"testing"
+)
+
+// A user entry to test against
+var contextEntry = &ldap.Entry{
+	DN: "uid=abc123,ou=People",
+	Attributes: []*ldap.EntryAttribute{
+		{Name: "givenName", Values: []string{"Jonathan"}},
+		{Name: "sn", Values: []string{"Wellington-Smythe"}},
+		{Name: "cn", Values: []string{"Jonathan Wellington-Smythe"}},
+		{Name: "mail", Values: []string{"j.wellington@example.ac.uk"}},
+		{Name: "telephoneNumber", Values: []string{"02078825555"}},
+	},
+}
+
+// Setup test cases - password against the expected reason
+var context_map = map[string]string{
+	"xxJonathan99!":     "it is based on your first name",
+	"n4htanoj#1":        "it is based on your first name",
+	"W3ll1ngt0n2016":    "it is based on your surname",
+	"Wellingtn!!42":     "it is based on your surname",
+	"abc123abc":         "it is based on your username",
+	"zz02078825555":     "it is based on your telephoneNumber",
+	"adoiah1223423sfdi": "",
+}
+
+// Test passwords based on personal details are caught, with the right reason
+func TestContainsPersonalTerm(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.ContextAttributes = []string{"telephoneNumber"}
+
+	terms := prm.personalTerms("abc123", contextEntry)
+
+	for password, expected := range context_map {
+		reason := TranslateReason(prm.Config, "en", containsPersonalTerm(password, terms))
+		if reason != expected {
+			t.Error("For:", password, "got:", reason, "expected:", expected)
+		}
+	}
+}
+
+// Test the bounded edit distance
+func TestWithinEdits(t *testing.T) {
+	test_map := []struct {
+		a, b string
+		max  int
+		want bool
+	}{
+		{"kitten", "sitting", 3, true},
+		{"kitten", "sitting", 2, false},
+		{"", "abc", 3, true},
+		{"abc", "abc", 0, true},
+		{"wellingtn", "wellington", 1, true},
+		{"notwelling", "wellington", 2, false},
+		{"abcdef", "ab", 2, false},
+	}
+
+	for _, test := range test_map {
+		if got := withinEdits(test.a, test.b, test.max); got != test.want {
+			t.Error("For:", test.a, test.b, test.max, "got:", got)
+		}
+	}
+}
+
+// Test the work done is capped however long the password and the details
+func TestPersonalTermLimits(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.ContextAttributes = []string{"description"}
+
+	var words []string
+	for i := 0; i < 100; i++ {
+		words = append(words, fmt.Sprintf("word%03d", i))
+	}
+	entry := &ldap.Entry{DN: "uid=abc123,ou=People", Attributes: []*ldap.EntryAttribute{
+		{Name: "description", Values: []string{strings.Join(words, " "), strings.Repeat("x", 1000)}},
+	}}
+
+	if terms := prm.personalTerms(strings.Repeat("u", 1000), entry); len(terms) > maxTerms {
+		t.Error("For: many details got terms:", len(terms))
+	}
+
+	password := strings.Repeat("4@$1!3", 10000)
+	variants := passwordVariants(password)
+	if len(variants) > 2+2*maxL33tVariants {
+		t.Error("For: long password got variants:", len(variants))
+	}
+	for _, v := range variants {
+		if len(v) > maxContextLength {
+			t.Error("For: long password got a variant of length:", len(v))
+		}
+	}
+}
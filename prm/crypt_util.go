@@ -1,98 +1,86 @@
 package prm
 
 import (
-	//"crypto/tls"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
-	"encoding/hex"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 )
 
-// createUffer creates a hex string of an AES Block encoded string
-// Relies on the global uffer_key. The uffer is basically our protection
-// mechanism between forms so a user can't just send form data
-func createUffer(plainstring string, ufferKey string) string {
-	key := []byte(ufferKey)
-
-	// Make sure we pad out to the block size
-	texttemp := []byte(plainstring)
-	var plaintext []byte
-	pad := 0
-	var smallpad uint8
-
-	// We always pad so we can check padding when we decrypt
-	if len(texttemp)%aes.BlockSize != 0 {
-		pad = aes.BlockSize - (len(texttemp) % aes.BlockSize)
-	} else {
-		pad = aes.BlockSize
-	}
+// The uffer is our protection mechanism between forms so a user can't just
+// send form data. Anything put in one is sealed with AES-GCM, so it can
+// neither be read nor altered without the uffer key.
+
+// What an uffer is for is bound into it when it is sealed, so one kind can't
+// be opened as another even where their fields look alike
+const (
+	ufferSession   = "session"
+	ufferPending   = "pending"
+	ufferReset     = "reset"
+	ufferEnrolment = "totp-enrolment"
+	ufferTOTP      = "totp-record"
+	ufferMail      = "mail"
+)
 
-	for i := 0; i < len(texttemp); i++ {
-		plaintext = append(plaintext, texttemp[i])
-	}
+// ufferAAD is bound into every seal so uffers can't be confused with any
+// other AES-GCM data sealed with the same key, or with uffers for another
+// purpose
+func ufferAAD(purpose string) []byte {
+	return []byte("prm-uffer-v1/" + purpose)
+}
 
-	smallpad = uint8(pad)
+// ErrUfferInvalid is returned when an uffer fails to decode or authenticate
+var ErrUfferInvalid = errors.New("uffer failed verification")
 
-	for i := 0; i < pad; i++ {
-		plaintext = append(plaintext, smallpad)
+// newUfferAEAD creates the AES-GCM cipher from the uffer key
+func newUfferAEAD(ufferKey string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher([]byte(ufferKey))
+	if err != nil {
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	block, err := aes.NewCipher(key)
+// sealUffer encrypts and authenticates plaintext for a purpose, returning a
+// url safe base64 string of the nonce followed by the ciphertext
+func sealUffer(purpose string, plaintext []byte, ufferKey string) (string, error) {
+	aead, err := newUfferAEAD(ufferKey)
 	if err != nil {
-		log.Print(err)
-		return ("")
+		return "", err
 	}
 
-	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		log.Print(err)
-		return ("")
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
 	}
 
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(ciphertext[aes.BlockSize:], plaintext)
-
-	return hex.EncodeToString(ciphertext)
-
+	sealed := aead.Seal(nonce, nonce, plaintext, ufferAAD(purpose))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
 }
 
-// decrypt_uffer decrypts a hex string generated from the encrypt_uffer function
-func decryptUffer(hextext string, ufferKey string) string {
-	key := []byte(ufferKey)
-
-	ciphertext, _ := hex.DecodeString(hextext)
-	block, err := aes.NewCipher(key)
+// openUffer reverses sealUffer. Any tampering with the uffer, or use of the
+// wrong key or purpose, gives ErrUfferInvalid rather than garbage
+func openUffer(purpose string, uffer string, ufferKey string) ([]byte, error) {
+	aead, err := newUfferAEAD(ufferKey)
 	if err != nil {
-		log.Print(err)
-		return ("")
+		return nil, err
 	}
 
-	if len(ciphertext) < aes.BlockSize {
-		log.Print(err)
-		return ("")
+	sealed, err := base64.RawURLEncoding.DecodeString(uffer)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, ErrUfferInvalid
 	}
 
-	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
-
-	if len(ciphertext)%aes.BlockSize != 0 {
-		log.Print(err)
-		return ("")
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ufferAAD(purpose))
+	if err != nil {
+		return nil, ErrUfferInvalid
 	}
 
-	mode := cipher.NewCBCDecrypter(block, iv)
-	mode.CryptBlocks(ciphertext, ciphertext)
-
-	padding := int(ciphertext[len(ciphertext)-1])
-	plaintext := fmt.Sprintf("%s", ciphertext[0:len(ciphertext)-padding])
-
-	return plaintext
+	return plaintext, nil
 }
 
 // CreatePasswordHash creates a Linux salty hash for the changing of passwords
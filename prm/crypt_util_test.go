@@ -1,24 +1,74 @@
 package prm
 
 import (
+	"encoding/base64"
+	"strings"
 	"testing"
 )
 
-// Test the encoding and decoding of the puffer / uffer
+// ufferNonceSize is the size of the AES-GCM nonce at the start of an uffer
+const ufferNonceSize = 12
+
+// Test the sealing and opening of the uffer
 
 func TestUffer(t *testing.T) {
-	uffer := createUffer("test", "0123456789ABCDEF")
+	uffer, err := sealUffer(ufferSession, []byte("test"), "0123456789ABCDEF")
+
+	if err != nil {
+		t.Fatal("sealUffer failed:", err)
+	}
 
 	if uffer == "test" {
-		t.Error("puffer is equal to 'test', should be encrypted")
+		t.Error("uffer is equal to 'test', should be encrypted")
+	}
+
+	plaintext, err := openUffer(ufferSession, uffer, "0123456789ABCDEF")
+
+	if err != nil || string(plaintext) != "test" {
+		t.Error("uffer not equal to 'test', got:", string(plaintext), err)
+	}
+
+}
+
+// tamperUffer flips a bit in the first byte of ciphertext after the nonce of
+// an uffer, keeping any key id tag, so the result is still well formed but
+// must fail to open. Changing a character of the base64 instead isn't safe,
+// as the last character may only carry padding bits
+func tamperUffer(t *testing.T, uffer string) string {
+	tag := ""
+	if i := strings.Index(uffer, "."); i >= 0 {
+		tag, uffer = uffer[:i+1], uffer[i+1:]
 	}
 
-	puffer := decryptUffer(uffer, "0123456789ABCDEF")
+	sealed, err := base64.RawURLEncoding.DecodeString(uffer)
+	if err != nil || len(sealed) <= ufferNonceSize {
+		t.Fatal("tamperUffer: not an uffer:", uffer, err)
+	}
+
+	sealed[ufferNonceSize] ^= 0x01
+	return tag + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// Test a tampered uffer or the wrong key is an error, not garbage
+
+func TestUfferTampered(t *testing.T) {
+	uffer, _ := sealUffer(ufferSession, []byte("test"), "0123456789ABCDEF")
 
-	if puffer != "test" {
-		t.Error("puffer not equal to 'test', got:", puffer)
+	if _, err := openUffer(ufferSession, tamperUffer(t, uffer), "0123456789ABCDEF"); err != ErrUfferInvalid {
+		t.Error("Expected ErrUfferInvalid for a tampered uffer, got:", err)
 	}
 
+	if _, err := openUffer(ufferSession, uffer, "FEDCBA9876543210"); err != ErrUfferInvalid {
+		t.Error("Expected ErrUfferInvalid for the wrong key, got:", err)
+	}
+
+	if _, err := openUffer(ufferEnrolment, uffer, "0123456789ABCDEF"); err != ErrUfferInvalid {
+		t.Error("Expected ErrUfferInvalid for the wrong purpose, got:", err)
+	}
+
+	if _, err := openUffer(ufferSession, "", "0123456789ABCDEF"); err != ErrUfferInvalid {
+		t.Error("Expected ErrUfferInvalid for an empty uffer, got:", err)
+	}
 }
 
 // Test the hash is correctly made for a linux box
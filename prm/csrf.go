@@ -0,0 +1,150 @@
+package prm
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CSRF protection uses signed double-submit tokens. renderIndex hands out a
+// token both as a cookie and in a hidden form field, and a POST is only
+// accepted if the two match and the signature is good. Another site can make
+// the browser send the cookie but can't read it to fill in the form, and
+// can't make up its own without the uffer key. The Origin or Referer of a
+// POST must also be this server.
+
+// csrfCookie is the name of the cookie holding the CSRF token
+const csrfCookie = "prm_csrf"
+
+// csrfField is the name of the hidden form field holding the CSRF token
+const csrfField = "csrf"
+
+// CSRF errors
+var (
+	ErrCSRFMissing = errors.New("csrf token missing")
+	ErrCSRFInvalid = errors.New("csrf token invalid")
+	ErrCSRFOrigin  = errors.New("request came from another site")
+)
+
+// csrfMAC signs a CSRF nonce with the given uffer key. The key is hashed with
+// a label first so the MAC can never be mistaken for anything else
+func csrfMAC(nonce string, key string) string {
+	derived := sha256.Sum256([]byte("prm-csrf\n" + key))
+	mac := hmac.New(sha256.New, derived[:])
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newCSRFToken creates a token of the form keyid.nonce.mac signed with the
+// primary uffer key
+func (prm *PRM) newCSRFToken() (string, error) {
+	primary, keys := prm.ufferKeyring()
+
+	key, ok := keys[primary]
+	if !ok {
+		return "", errors.New("uffer primary key " + primary + " is not in the keyring")
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	encoded := hex.EncodeToString(nonce)
+	return primary + "." + encoded + "." + csrfMAC(encoded, key), nil
+}
+
+// validCSRFToken checks the signature on a token with whichever key it names
+func (prm *PRM) validCSRFToken(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	_, keys := prm.ufferKeyring()
+	key, ok := keys[parts[0]]
+	if !ok || key == "" {
+		return false
+	}
+
+	return hmac.Equal([]byte(parts[2]), []byte(csrfMAC(parts[1], key)))
+}
+
+// CSRFToken returns the CSRF token to embed in a form, reusing the one in
+// the users cookie if it is still good and setting a new cookie if not
+func (prm *PRM) CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && prm.validCSRFToken(cookie.Value) {
+		return cookie.Value, nil
+	}
+
+	token, err := prm.newCSRFToken()
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// sameOrigin checks the Origin, or failing that the Referer, of a request is
+// this server. An opaque "null" origin is refused, while requests with
+// neither header are left to the token check
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "null" {
+		return false
+	}
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// CheckCSRF verifies a POST came from our own form. The form field must match
+// the cookie and carry a valid signature
+func (prm *PRM) CheckCSRF(r *http.Request) error {
+	if !sameOrigin(r) {
+		return ErrCSRFOrigin
+	}
+
+	cookie, err := r.Cookie(csrfCookie)
+	field := r.PostFormValue(csrfField)
+	if err != nil || cookie.Value == "" || field == "" {
+		return ErrCSRFMissing
+	}
+
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(field)) != 1 || !prm.validCSRFToken(field) {
+		return ErrCSRFInvalid
+	}
+	return nil
+}
+
+// checkCSRF runs CheckCSRF and audits any request it refuses
+func (prm *PRM) checkCSRF(r *http.Request) bool {
+	if err := prm.CheckCSRF(r); err != nil {
+		prm.AuditPRM("csrf-rejected", r.PostFormValue("user"), r, "reason="+strings.Replace(err.Error(), " ", "-", -1))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package prm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newCSRFPRM() *PRM {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.Uffer = "0123456789ABCDEF"
+	return prm
+}
+
+// csrfPost builds a POST to /change with the given cookie, form field and
+// extra headers
+func csrfPost(cookie string, field string, headers map[string]string) *http.Request {
+	form := url.Values{"user": {"abc123"}}
+	if field != "" {
+		form.Set(csrfField, field)
+	}
+
+	r := httptest.NewRequest("POST", "https://pass.example.com/change", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != "" {
+		r.AddCookie(&http.Cookie{Name: csrfCookie, Value: cookie})
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+// Test a token handed out with the form is accepted back, and reused
+func TestCSRFToken(t *testing.T) {
+	prm := newCSRFPRM()
+
+	w := httptest.NewRecorder()
+	token, err := prm.CSRFToken(w, httptest.NewRequest("GET", "https://pass.example.com/", nil))
+	if err != nil {
+		t.Fatal("CSRFToken failed:", err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != token || !cookies[0].HttpOnly || !cookies[0].Secure || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatal("Cookie not set as expected, got:", cookies)
+	}
+
+	r := csrfPost(token, token, map[string]string{"Origin": "https://pass.example.com"})
+	if err := prm.CheckCSRF(r); err != nil {
+		t.Error("Genuine form refused:", err)
+	}
+
+	// A later page reuses the cookie rather than replacing it
+	w = httptest.NewRecorder()
+	again, _ := prm.CSRFToken(w, r)
+	if again != token || len(w.Result().Cookies()) != 0 {
+		t.Error("Expected the cookie token to be reused, got:", again)
+	}
+}
+
+// Test forged requests are refused
+func TestCSRFForged(t *testing.T) {
+	prm := newCSRFPRM()
+	token, _ := prm.newCSRFToken()
+	other, _ := prm.newCSRFToken()
+
+	forged := newCSRFPRM()
+	forged.Config.Uffer = "FEDCBA9876543210"
+	unsigned, _ := forged.newCSRFToken()
+
+	test_map := map[string]struct {
+		request *http.Request
+		want    error
+	}{
+		"no token":         {csrfPost("", "", nil), ErrCSRFMissing},
+		"cookie only":      {csrfPost(token, "", nil), ErrCSRFMissing},
+		"field only":       {csrfPost("", token, nil), ErrCSRFMissing},
+		"mismatched":       {csrfPost(token, other, nil), ErrCSRFInvalid},
+		"wrong key":        {csrfPost(unsigned, unsigned, nil), ErrCSRFInvalid},
+		"malformed":        {csrfPost("abc", "abc", nil), ErrCSRFInvalid},
+		"cross site":       {csrfPost(token, token, map[string]string{"Origin": "https://evil.example.org"}), ErrCSRFOrigin},
+		"null origin":      {csrfPost(token, token, map[string]string{"Origin": "null"}), ErrCSRFOrigin},
+		"cross referer":    {csrfPost(token, token, map[string]string{"Referer": "https://evil.example.org/form"}), ErrCSRFOrigin},
+		"same referer":     {csrfPost(token, token, map[string]string{"Referer": "https://pass.example.com/"}), nil},
+		"no origin at all": {csrfPost(token, token, nil), nil},
+	}
+
+	for name, test := range test_map {
+		if err := prm.CheckCSRF(test.request); err != test.want {
+			t.Error("For:", name, "got:", err)
+		}
+	}
+}
+
+// Test ProcessForm and ProcessTerms refuse a forged request before doing
+// anything else
+func TestProcessCSRF(t *testing.T) {
+	prm := newCSRFPRM()
+
+	if result, _ := prm.ProcessForm(csrfPost("", "", nil)); result.Message != ErrorCSRF {
+		t.Error("For: ProcessForm got:", result.ToString())
+	}
+
+	if result, _ := prm.ProcessTerms(csrfPost("", "", nil)); result.Message != ErrorCSRF {
+		t.Error("For: ProcessTerms got:", result.ToString())
+	}
+}
@@ -1,31 +1,563 @@
 package prm
 
 import (
-	"log"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
 	"strings"
+	texttemplate "text/template"
+	"time"
 )
 
-// SendEmail uses smtp to post an email to a successful user at the end
-// of the password change
-func SendEmail(given_name string, email_address string, config *PRMConfig) {
-	// Set up authentication information.
-	auth := smtp.PlainAuth("", "user@example.com", "password", "localhost")
+// How the connection to the mail server is secured, set by SMTPTLS:
+//
+//	auto     - STARTTLS if the server offers it, as smtp.SendMail does
+//	starttls - STARTTLS, refusing to send if the server doesn't offer it
+//	tls      - TLS from the start, usually on port 465
+//	none     - never use TLS, only sensible for a relay on localhost
+const (
+	SMTPTLSAuto     = "auto"
+	SMTPTLSStartTLS = "starttls"
+	SMTPTLSImplicit = "tls"
+	SMTPTLSNone     = "none"
+)
+
+// What to do when a user has no address to tell them their password has
+// changed, set by missingemailpolicy:
+//
+//	skip      - send nothing
+//	construct - send to the username at missingemaildomain
+//	alert     - tell the addresses in alertemail instead
+const (
+	MissingEmailSkip      = "skip"
+	MissingEmailConstruct = "construct"
+	MissingEmailAlert     = "alert"
+)
+
+// ErrNoEmail is returned when a user has no email address
+var ErrNoEmail = errors.New("user has no email address")
+
+// The defaults match what older versions hardcoded
+const (
+	defaultSMTPHost    = "localhost"
+	defaultSMTPPort    = 25
+	defaultSMTPTimeout = 30
+	defaultEmailFrom   = "its-research-support@qmul.ac.uk"
+)
+
+// emailTimeFormat is how times are written in emails. A catalogue can give
+// its own layout by translating it
+const emailTimeFormat = "15:04 on Mon 2 Jan 2006"
 
-	// Connect to the server, authenticate, set the sender and recipient,
-	// and send the email all in one step.
+// Email bodies are rendered from templates in the email directory under
+// TemplatePath. Each email has a text template, name.txt, and may have an
+// HTML one, name.html, in which case both are sent as multipart/alternative.
+// Translations go in a directory named after the language, e.g. email/fr/,
+// and are used if they have the text template. If the text template is
+// missing the older message from the config is used instead, with %NAME%
+// style placeholders.
 
-	body := config.EmailMsg
-	body = strings.Replace(body, "%NAME%", given_name, -1)
+// EmailData holds the values email templates can use. Fields that don't
+// apply to an email are left empty
+type EmailData struct {
+	Name     string
+	Username string
+	Time     string
+	IP       string
+	Browser  string
+	Helpdesk string
+	Contact  string
+	Code     string
+	Link     string
+	Expires  string
+	Lang     string
+}
+
+// Email is a rendered message to a single address
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
 
-	to := []string{email_address}
-	msg := []byte("To: " + email_address + "\r\n" +
-		"Subject: " + config.EmailSub + "\r\n" +
-		"\r\n" +
-		body)
-	err := smtp.SendMail("localhost:25", auth, "its-research-support@qmul.ac.uk", to, msg)
+// NewEmailData fills in the values common to every email. The request may be
+// nil when there is no user at a browser, e.g. for prm-admin
+func NewEmailData(config *PRMConfig, username string, name string, r *http.Request) EmailData {
+	data := EmailData{
+		Name:     name,
+		Username: username,
+		Helpdesk: config.HelpdeskURL,
+		Contact:  config.helpdeskContact(),
+		Lang:     RequestLanguage(config, r),
+	}
+	data.Time = emailTime(config, data.Lang, time.Now())
+
+	if r != nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		data.IP = host
+		data.Browser = r.Header.Get("User-Agent")
+	}
+
+	return data
+}
+
+// emailTime writes a time for an email in a language
+func emailTime(config *PRMConfig, lang string, t time.Time) string {
+	return t.Format(Translate(config, lang, emailTimeFormat))
+}
+
+// legacyBody fills in the placeholders of a message from the config
+func legacyBody(body string, data EmailData) string {
+	return strings.NewReplacer(
+		"%NAME%", data.Name,
+		"%USERNAME%", data.Username,
+		"%CODE%", data.Code,
+		"%LINK%", data.Link,
+		"%EXPIRES%", data.Expires,
+		"%HELPDESK%", data.Contact,
+	).Replace(body)
+}
+
+// emailTemplatePath is where the templates for the named email are, in the
+// directory for the language if there is a translation
+func emailTemplatePath(config *PRMConfig, name string, lang string) string {
+	if lang != "" && languageCode.MatchString(lang) {
+		path := config.TemplatePath + "email/" + lang + "/" + name
+		if _, err := os.Stat(path + ".txt"); err == nil {
+			return path
+		}
+	}
+	return config.TemplatePath + "email/" + name
+}
+
+// RenderEmail renders the templates for the named email. legacy is the
+// message to fall back on if there is no text template. The subject and
+// legacy message are translated into the language in data
+func RenderEmail(config *PRMConfig, name string, address string, subject string, legacy string, data EmailData) (*Email, error) {
+	email := &Email{To: address, Subject: Translate(config, data.Lang, subject)}
+	path := emailTemplatePath(config, name, data.Lang)
+
+	if _, err := os.Stat(path + ".txt"); err == nil {
+		t, err := texttemplate.ParseFiles(path + ".txt")
+		if err != nil {
+			return nil, err
+		}
+		var text bytes.Buffer
+		if err := t.Execute(&text, data); err != nil {
+			return nil, err
+		}
+		email.Text = text.String()
+	} else {
+		email.Text = legacyBody(Translate(config, data.Lang, legacy), data)
+	}
+
+	if _, err := os.Stat(path + ".html"); err == nil {
+		t, err := htmltemplate.ParseFiles(path + ".html")
+		if err != nil {
+			return nil, err
+		}
+		var html bytes.Buffer
+		if err := t.Execute(&html, data); err != nil {
+			return nil, err
+		}
+		email.HTML = html.String()
+	}
+
+	return email, nil
+}
+
+// SendEmail queues an email to a successful user at the end of the
+// password change
+func (prm *PRM) SendEmail(email_address string, data EmailData) {
+	subject := prm.Config.EmailSub
+	if subject == "" {
+		subject = "Your password has been changed"
+	}
+
+	email, err := RenderEmail(prm.Config, "changed", email_address, subject, prm.Config.EmailMsg, data)
+	if err == nil {
+		err = prm.QueueEmail(email)
+	}
+
+	if err != nil {
+		prm.LogPRM("SendEmail Error: "+err.Error(), LOG_ERROR)
+	}
+}
+
+// sendChangedNotice tells a user their password has changed. If their
+// address can't be found nothing is sent to a made up one; missingemailpolicy
+// says what happens instead. Either way the outcome is audited
+func (prm *PRM) sendChangedNotice(username string, conn Conn, r *http.Request) {
+	name, address, err := prm.GetEmailDeets(username, conn)
+	if err == nil {
+		prm.SendEmail(address, NewEmailData(prm.Config, username, name, r))
+		prm.AuditPRM("change-notice", username, r, "outcome=sent")
+		return
+	}
+
+	reason := "reason=" + strconv.Quote(err.Error())
+
+	switch prm.Config.MissingEmailPolicy {
+	case MissingEmailConstruct:
+		constructed := prm.constructedAddress(username)
+		if constructed == "" {
+			prm.AuditPRM("change-notice", username, r, "outcome=skipped", reason, "constructed=invalid")
+			return
+		}
+		prm.SendEmail(constructed, NewEmailData(prm.Config, username, name, r))
+		prm.AuditPRM("change-notice", username, r, "outcome=constructed", reason)
+
+	case MissingEmailAlert:
+		// The alert is for staff, not whoever is at the browser
+		data := NewEmailData(prm.Config, username, name, r)
+		data.Lang = prm.Config.defaultLanguage()
+		for _, alert := range prm.Config.AlertEmail {
+			email, rerr := RenderEmail(prm.Config, "alert-no-email", alert, "Password changed for "+username+" without a notice", "The password for %USERNAME% was changed, but they could not be told as no email address was found for them.\n", data)
+			if rerr == nil {
+				rerr = prm.QueueEmail(email)
+			}
+			if rerr != nil {
+				prm.LogPRM("sendChangedNotice Error: "+rerr.Error(), LOG_ERROR)
+			}
+		}
+		prm.AuditPRM("change-notice", username, r, "outcome=alerted", reason)
+
+	default:
+		prm.AuditPRM("change-notice", username, r, "outcome=skipped", reason)
+	}
+}
+
+// constructedAddress is the address the construct missingemailpolicy makes
+// up for a user without one. It returns "" for any other policy, or if the
+// username doesn't make a valid address
+func (prm *PRM) constructedAddress(username string) string {
+	if prm.Config.MissingEmailPolicy != MissingEmailConstruct {
+		return ""
+	}
+	constructed, err := mail.ParseAddress(username + "@" + prm.Config.MissingEmailDomain)
+	if err != nil {
+		return ""
+	}
+	return constructed.Address
+}
+
+// SendTestEmail sends a short message to check the mail settings work
+func SendTestEmail(config *PRMConfig, email_address string) error {
+	email := &Email{
+		To:      email_address,
+		Subject: "Password manager test message",
+		Text: "This is a test message from the password manager, sent with\n" +
+			"prm_server -test-email. If you can read it, email is working.\n",
+	}
+	return sendMessage(config, email)
+}
+
+// smtpAddress is the host and port of the mail server
+func smtpAddress(config *PRMConfig) (string, string) {
+	host := config.SMTPHost
+	if host == "" {
+		host = defaultSMTPHost
+	}
+
+	port := config.SMTPPort
+	if port < 1 {
+		port = defaultSMTPPort
+	}
+
+	return host, net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// smtpTimeout is how long a whole conversation with the mail server may take
+func smtpTimeout(config *PRMConfig) time.Duration {
+	if config.SMTPTimeout > 0 {
+		return time.Duration(config.SMTPTimeout) * time.Second
+	}
+	return defaultSMTPTimeout * time.Second
+}
+
+// emailFrom is the address emails come from
+func emailFrom(config *PRMConfig) string {
+	if config.EmailFrom != "" {
+		return config.EmailFrom
+	}
+	return defaultEmailFrom
+}
+
+// envelopeFrom is the bare address bounces go to. The From address may
+// include a display name, which isn't allowed in the envelope
+func envelopeFrom(config *PRMConfig) (string, error) {
+	if config.EmailEnvelopeFrom != "" {
+		return config.EmailEnvelopeFrom, nil
+	}
+
+	address, err := mail.ParseAddress(emailFrom(config))
+	if err != nil {
+		return "", err
+	}
+	return address.Address, nil
+}
+
+// smtpPassword reads the password for the mail server from its file. It is
+// read each time so the file can be replaced without a restart
+func smtpPassword(config *PRMConfig) (string, error) {
+	if config.SMTPPasswordFile == "" {
+		return "", nil
+	}
 
+	secret, err := ioutil.ReadFile(config.SMTPPasswordFile)
 	if err != nil {
-		log.Print(err)
+		return "", err
+	}
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
+// headerSafe checks a value can go in a header without starting a new one
+func headerSafe(values ...string) error {
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("email header contains a line break")
+		}
+	}
+	return nil
+}
+
+// messageID makes a unique Message-ID in the domain of the From address
+func messageID(from *mail.Address) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	domain := "localhost"
+	if at := strings.LastIndex(from.Address, "@"); at != -1 {
+		domain = from.Address[at+1:]
+	}
+	return "<" + hex.EncodeToString(random) + "@" + domain + ">", nil
+}
+
+// writePart writes a body quoted-printable encoded, so long lines and
+// characters outside ASCII arrive intact
+func writePart(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// buildMessage puts together the headers and body of an email. Names and
+// subjects outside ASCII are encoded as RFC 2047 words, and an email with an
+// HTML body is sent as multipart/alternative with the text first
+func buildMessage(config *PRMConfig, email *Email) ([]byte, error) {
+	if err := headerSafe(email.To, email.Subject); err != nil {
+		return nil, err
+	}
+
+	from, err := mail.ParseAddress(emailFrom(config))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := messageID(from)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString("From: " + from.String() + "\r\n")
+	msg.WriteString("To: " + (&mail.Address{Address: email.To}).String() + "\r\n")
+	if config.EmailReplyTo != "" {
+		replyTo, err := mail.ParseAddress(config.EmailReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		msg.WriteString("Reply-To: " + replyTo.String() + "\r\n")
+	}
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", email.Subject) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Message-ID: " + id + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+
+	if email.HTML == "" {
+		msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writePart(&msg, email.Text); err != nil {
+			return nil, err
+		}
+		return msg.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&msg)
+	msg.WriteString("Content-Type: multipart/alternative; boundary=" + parts.Boundary() + "\r\n\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", email.Text},
+		{"text/html; charset=utf-8", email.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writePart(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// sendMessage sends an email to its address using the mail server settings
+// in config
+func sendMessage(config *PRMConfig, email *Email) error {
+	msg, err := buildMessage(config, email)
+	if err != nil {
+		return err
+	}
+
+	host, address := smtpAddress(config)
+	timeout := smtpTimeout(config)
+	tlsConfig := &tls.Config{ServerName: host}
+
+	var conn net.Conn
+	if config.SMTPTLS == SMTPTLSImplicit {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The deadline covers the whole conversation so a stuck server can't
+	// hold up the request
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	switch config.SMTPTLS {
+	case SMTPTLSImplicit, SMTPTLSNone:
+	default:
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if config.SMTPTLS == SMTPTLSStartTLS {
+			return errors.New(address + " does not offer STARTTLS")
+		}
+	}
+
+	if config.SMTPUsername != "" {
+		password, err := smtpPassword(config)
+		if err != nil {
+			return err
+		}
+		// PlainAuth refuses to send the password unencrypted unless the
+		// server is on localhost
+		if err := client.Auth(smtp.PlainAuth("", config.SMTPUsername, password, host)); err != nil {
+			return err
+		}
+	}
+
+	envelope, err := envelopeFrom(config)
+	if err != nil {
+		return err
+	}
+	if err := client.Mail(envelope); err != nil {
+		return err
+	}
+	if err := client.Rcpt(email.To); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// CheckEmailConfig makes sure the mail settings can be used
+func CheckEmailConfig(config *PRMConfig) error {
+	switch config.SMTPTLS {
+	case "", SMTPTLSAuto, SMTPTLSStartTLS, SMTPTLSImplicit, SMTPTLSNone:
+	default:
+		return fmt.Errorf("smtptls %v must be auto, starttls, tls or none", config.SMTPTLS)
+	}
+
+	switch config.MissingEmailPolicy {
+	case "", MissingEmailSkip:
+	case MissingEmailConstruct:
+		if config.MissingEmailDomain == "" {
+			return errors.New("missingemailpolicy construct needs missingemaildomain")
+		}
+	case MissingEmailAlert:
+		if len(config.AlertEmail) == 0 {
+			return errors.New("missingemailpolicy alert needs alertemail")
+		}
+	default:
+		return fmt.Errorf("missingemailpolicy %v must be skip, construct or alert", config.MissingEmailPolicy)
+	}
+
+	for _, alert := range config.AlertEmail {
+		if _, err := mail.ParseAddress(alert); err != nil {
+			return fmt.Errorf("alertemail %v is not an address: %v", alert, err)
+		}
+	}
+
+	if config.SMTPUsername != "" && config.SMTPPasswordFile == "" {
+		return errors.New("smtpusername is set without smtppasswordfile")
+	}
+
+	if err := headerSafe(config.EmailFrom, config.EmailReplyTo, config.EmailEnvelopeFrom); err != nil {
+		return err
+	}
+
+	if _, err := envelopeFrom(config); err != nil {
+		return fmt.Errorf("emailfrom %v is not an address: %v", emailFrom(config), err)
+	}
+
+	if config.EmailReplyTo != "" {
+		if _, err := mail.ParseAddress(config.EmailReplyTo); err != nil {
+			return fmt.Errorf("emailreplyto %v is not an address: %v", config.EmailReplyTo, err)
+		}
 	}
+	return nil
 }
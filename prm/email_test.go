@@ -0,0 +1,386 @@
+package prm
+
+import (
+	"bufio"
+	"bytes"
+	"gopkg.in/ldap.v2"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is just enough of a mail server to accept messages, one
+// connection at a time. It can also be silent, never answering, or refuse
+// every recipient
+type fakeSMTP struct {
+	listener net.Listener
+	mode     string
+	from     string
+	to       string
+	data     string
+	sent     int
+	done     chan bool
+}
+
+func newFakeSMTP(t *testing.T, mode string) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeSMTP{listener: listener, mode: mode, done: make(chan bool, 16)}
+	go server.serve()
+	return server
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.handle(conn)
+		s.done <- true
+	}
+}
+
+func (s *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+
+	if s.mode == "silent" {
+		time.Sleep(3 * time.Second)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("220 test\r\n"))
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			conn.Write([]byte("250 test\r\n"))
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			s.from = strings.TrimSpace(line[len("MAIL FROM:"):])
+			conn.Write([]byte("250 ok\r\n"))
+		case strings.HasPrefix(command, "RCPT TO:") && s.mode == "reject":
+			conn.Write([]byte("550 no such user\r\n"))
+		case strings.HasPrefix(command, "RCPT TO:"):
+			s.to = strings.TrimSpace(line[len("RCPT TO:"):])
+			conn.Write([]byte("250 ok\r\n"))
+		case strings.HasPrefix(command, "DATA"):
+			conn.Write([]byte("354 go ahead\r\n"))
+			s.data = ""
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				s.data += line
+			}
+			s.sent++
+			conn.Write([]byte("250 ok\r\n"))
+		case strings.HasPrefix(command, "QUIT"):
+			conn.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("502 unknown\r\n"))
+		}
+	}
+}
+
+func (s *fakeSMTP) config() *PRMConfig {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	config := new(PRMConfig)
+	config.SMTPHost = "127.0.0.1"
+	config.SMTPPort, _ = strconv.Atoi(port)
+	config.SMTPTimeout = 1
+	return config
+}
+
+// Test a message goes out with the configured sender, envelope and headers
+func TestSendMessage(t *testing.T) {
+	server := newFakeSMTP(t, "")
+	defer server.listener.Close()
+
+	config := server.config()
+	config.EmailFrom = "Password Manager <prm@example.com>"
+	config.EmailReplyTo = "help@example.com"
+	config.EmailEnvelopeFrom = "bounces@example.com"
+
+	if err := sendMessage(config, &Email{To: "abc123@example.com", Subject: "Hello", Text: "Body text\n"}); err != nil {
+		t.Fatal("sendMessage failed:", err)
+	}
+	<-server.done
+
+	if server.from != "<bounces@example.com>" || server.to != "<abc123@example.com>" {
+		t.Error("For: envelope got:", server.from, server.to)
+	}
+
+	// Without an envelope address the From address is used, less its name
+	config.EmailEnvelopeFrom = ""
+	if envelope, err := envelopeFrom(config); err != nil || envelope != "prm@example.com" {
+		t.Error("For: envelopeFrom got:", envelope, err)
+	}
+
+	for _, header := range []string{"From: \"Password Manager\" <prm@example.com>\r\n", "To: <abc123@example.com>\r\n", "Reply-To: <help@example.com>\r\n", "Subject: Hello\r\n", "\r\nDate: ", "\r\nMessage-ID: <", "Content-Type: text/plain; charset=utf-8\r\n"} {
+		if !strings.Contains(server.data, header) {
+			t.Error("For:", header, "got:", server.data)
+		}
+	}
+}
+
+// Test STARTTLS can be insisted on
+func TestSendMessageRequiresTLS(t *testing.T) {
+	server := newFakeSMTP(t, "")
+	defer server.listener.Close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSStartTLS
+
+	if err := sendMessage(config, &Email{To: "abc123@example.com", Subject: "Hello", Text: "Body text\n"}); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Error("For: starttls got:", err)
+	}
+}
+
+// Test a server that never answers doesn't hold things up
+func TestSendMessageTimeout(t *testing.T) {
+	server := newFakeSMTP(t, "silent")
+	defer server.listener.Close()
+
+	start := time.Now()
+	if err := sendMessage(server.config(), &Email{To: "abc123@example.com", Subject: "Hello", Text: "Body text\n"}); err == nil {
+		t.Error("For: silent server got: nil")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("For: silent server took:", time.Since(start))
+	}
+}
+
+// Test headers can't be smuggled in through the subject or addresses
+func TestBuildMessageHeaders(t *testing.T) {
+	config := new(PRMConfig)
+
+	test_map := map[string][2]string{
+		"subject": {"abc123@example.com", "Hello\r\nBcc: evil@example.com"},
+		"address": {"abc123@example.com\nBcc: evil@example.com", "Hello"},
+	}
+
+	for name, fields := range test_map {
+		if _, err := buildMessage(config, &Email{To: fields[0], Subject: fields[1], Text: "Body"}); err == nil {
+			t.Error("For:", name, "got: nil")
+		}
+	}
+}
+
+// Test the password file is read without its trailing newline and bad
+// settings are refused
+func TestEmailConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("s3cret\n")
+	file.Close()
+
+	config := &PRMConfig{SMTPUsername: "prm", SMTPPasswordFile: file.Name()}
+	if password, err := smtpPassword(config); err != nil || password != "s3cret" {
+		t.Error("For: smtpPassword got:", password, err)
+	}
+
+	test_map := map[string]PRMConfig{
+		"default":  {},
+		"tls":      {SMTPTLS: "sometimes"},
+		"password": {SMTPUsername: "prm"},
+		"from":     {EmailFrom: "a@example.com\r\nBcc: b@example.com"},
+		"address":  {EmailFrom: "not an address"},
+	}
+
+	for name, config := range test_map {
+		config := config
+		if err := CheckEmailConfig(&config); (err == nil) != (name == "default") {
+			t.Error("For:", name, "got:", err)
+		}
+	}
+}
+
+// Test an email with an HTML body is sent as multipart/alternative with
+// names and subjects outside ASCII encoded
+func TestBuildMessageMultipart(t *testing.T) {
+	config := &PRMConfig{EmailFrom: "Gwasanaeth Cyfrinair <prm@example.com>"}
+	email := &Email{To: "abc123@example.com", Subject: "Café password", Text: "Dear Zoë\n", HTML: "<p>Dear Zoë</p>\n"}
+
+	msg, err := buildMessage(config, email)
+	if err != nil {
+		t.Fatal("buildMessage failed:", err)
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal("ReadMessage failed:", err)
+	}
+
+	decoder := new(mime.WordDecoder)
+	if subject, err := decoder.DecodeHeader(parsed.Header.Get("Subject")); err != nil || subject != email.Subject {
+		t.Error("For: Subject got:", parsed.Header.Get("Subject"), err)
+	}
+	if !strings.HasSuffix(parsed.Header.Get("Message-ID"), "@example.com>") {
+		t.Error("For: Message-ID got:", parsed.Header.Get("Message-ID"))
+	}
+	if _, err := parsed.Header.Date(); err != nil {
+		t.Error("For: Date got:", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatal("For: Content-Type got:", mediaType, err)
+	}
+
+	// The multipart reader undoes the quoted-printable encoding
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, want := range []string{email.Text, email.HTML} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal("NextPart failed:", err)
+		}
+		body, _ := ioutil.ReadAll(part)
+		if strings.Replace(string(body), "\r\n", "\n", -1) != want {
+			t.Error("For:", want, "got:", string(body))
+		}
+	}
+}
+
+// Test emails come from the templates when there are some, and from the
+// message in the config when there aren't
+func TestRenderEmail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &PRMConfig{TemplatePath: dir + "/", HelpdeskURL: "https://help.example.com"}
+	data := NewEmailData(config, "abc123", "<Zoë>", nil)
+	data.Code = "123456789"
+
+	email, err := RenderEmail(config, "otp", "abc123@example.com", "Code", "Dear %NAME%, your code is %CODE%", data)
+	if err != nil || email.Text != "Dear <Zoë>, your code is 123456789" || email.HTML != "" {
+		t.Error("For: legacy got:", email, err)
+	}
+
+	os.Mkdir(dir+"/email", 0755)
+	ioutil.WriteFile(dir+"/email/otp.txt", []byte("{{.Name}} {{.Code}} {{.Helpdesk}}"), 0644)
+	ioutil.WriteFile(dir+"/email/otp.html", []byte("<p>{{.Name}} {{.Code}}</p>"), 0644)
+
+	email, err = RenderEmail(config, "otp", "abc123@example.com", "Code", "Dear %NAME%", data)
+	if err != nil {
+		t.Fatal("RenderEmail failed:", err)
+	}
+	if email.Text != "<Zoë> 123456789 https://help.example.com" {
+		t.Error("For: text got:", email.Text)
+	}
+	if email.HTML != "<p>&lt;Zoë&gt; 123456789</p>" {
+		t.Error("For: html got:", email.HTML)
+	}
+}
+
+// Test the templates that ship with the server render
+func TestShippedEmailTemplates(t *testing.T) {
+	config := &PRMConfig{TemplatePath: "../templates/"}
+	data := NewEmailData(config, "abc123", "Zoë", httptest.NewRequest("POST", "/", nil))
+
+	names := []string{"changed", "otp", "reset", "alert-no-email"}
+	for event := range notifySubjects {
+		names = append(names, "notify-"+event)
+	}
+
+	for _, name := range names {
+		email, err := RenderEmail(config, name, "abc123@example.com", "Subject", "", data)
+		if err != nil || email.Text == "" || email.HTML == "" {
+			t.Error("For:", name, "got:", email, err)
+		}
+	}
+}
+
+// Test a user without an address is never sent a made up one, and the
+// policy for them is followed
+func TestChangedNotice(t *testing.T) {
+	prm, cleanup := newNotifyPRM(t)
+	defer cleanup()
+	r := httptest.NewRequest("POST", "/terms", nil)
+
+	withMail := &otpConn{entry: notifyEntry()}
+	withoutMail := &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example",
+		Attributes: []*ldap.EntryAttribute{{Name: "givenName", Values: []string{"Alice"}}}}}
+
+	if _, _, err := prm.GetEmailDeets("abc123", withoutMail); err != ErrNoEmail {
+		t.Error("For: GetEmailDeets without mail got:", err)
+	}
+	if _, _, err := prm.GetEmailDeets("abc123", &otpConn{}); err != ErrNoUser {
+		t.Error("For: GetEmailDeets without user got:", err)
+	}
+
+	test_map := []struct {
+		name   string
+		policy string
+		conn   *otpConn
+		want   string
+	}{
+		{"mail", MissingEmailSkip, withMail, "alice@example.com"},
+		{"skip", MissingEmailSkip, withoutMail, ""},
+		{"construct", MissingEmailConstruct, withoutMail, "abc123@users.example.com"},
+		{"alert", MissingEmailAlert, withoutMail, "admins@example.com"},
+		{"no user", MissingEmailAlert, &otpConn{}, "admins@example.com"},
+	}
+
+	prm.Config.MissingEmailDomain = "users.example.com"
+	prm.Config.AlertEmail = []string{"admins@example.com"}
+
+	for _, test := range test_map {
+		os.RemoveAll(prm.Config.MailSpoolPath)
+		prm.Config.MissingEmailPolicy = test.policy
+		prm.sendChangedNotice("abc123", test.conn, r)
+
+		emails, _ := prm.MailQueue()
+		switch {
+		case test.want == "" && len(emails) != 0:
+			t.Error("For:", test.name, "got:", emails[0].To)
+		case test.want != "" && (len(emails) != 1 || emails[0].To != test.want):
+			t.Error("For:", test.name, "got:", emails)
+		}
+	}
+}
+
+// Test the policy for users without an address is checked at startup
+func TestMissingEmailConfig(t *testing.T) {
+	test_map := map[string]PRMConfig{
+		"skip":           {MissingEmailPolicy: MissingEmailSkip},
+		"construct":      {MissingEmailPolicy: MissingEmailConstruct, MissingEmailDomain: "example.com"},
+		"alert":          {MissingEmailPolicy: MissingEmailAlert, AlertEmail: []string{"admins@example.com"}},
+		"bad construct":  {MissingEmailPolicy: MissingEmailConstruct},
+		"bad alert":      {MissingEmailPolicy: MissingEmailAlert},
+		"bad alertemail": {MissingEmailPolicy: MissingEmailAlert, AlertEmail: []string{"admins"}},
+		"bad policy":     {MissingEmailPolicy: "guess"},
+	}
+
+	for name, config := range test_map {
+		config := config
+		if err := CheckEmailConfig(&config); (err == nil) != !strings.HasPrefix(name, "bad") {
+			t.Error("For:", name, "got:", err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package prm
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// Test the defaults are sent and can be replaced or dropped from the config
+func TestSecurityHeaders(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.SecurityHeaders = map[string]string{
+		"strict-transport-security": "max-age=60",
+		"X-Frame-Options":           "",
+	}
+
+	w := httptest.NewRecorder()
+	prm.SetSecurityHeaders(w)
+
+	test_map := map[string]string{
+		"Strict-Transport-Security": "max-age=60",
+		"X-Frame-Options":           "",
+		"Cache-Control":             "no-store",
+		"Referrer-Policy":           "same-origin",
+		"Content-Security-Policy":   defaultSecurityHeaders["Content-Security-Policy"],
+	}
+
+	for header, want := range test_map {
+		if got := w.Header().Get(header); got != want {
+			t.Error("For:", header, "got:", got)
+		}
+	}
+}
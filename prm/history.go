@@ -0,0 +1,150 @@
+package prm
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Password history is kept in a multi-valued LDAP attribute. As LDAP does not
+// keep values in order, each value is prefixed with the time it was set:
+//
+//	<unix time>#{PH1}keyid$salt$mac
+//
+// where mac is an HMAC-SHA256, keyed from the uffer keyring, of the salt and
+// password, so anyone able to read the directory can't crack old passwords
+// without the key as well.
+
+// historyScheme marks a hashed history value and its format version
+const historyScheme = "{PH1}"
+
+// historyMAC computes the MAC of a password for the history. The key is
+// hashed with a label first so the MAC can never be mistaken for anything else
+func historyMAC(key string, salt string, password string) string {
+	derived := sha256.Sum256([]byte("prm-history\n" + key))
+	mac := hmac.New(sha256.New, derived[:])
+	mac.Write([]byte(salt + "\n" + password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashHistory creates the hash of a password to store in the history
+// attribute, using the primary uffer key
+func (prm *PRM) hashHistory(password string) (string, error) {
+	primary, keys := prm.ufferKeyring()
+
+	key, ok := keys[primary]
+	if !ok || key == "" {
+		return "", errors.New("uffer primary key " + primary + " is not in the keyring")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	encoded := hex.EncodeToString(salt)
+
+	return historyScheme + primary + "$" + encoded + "$" + historyMAC(key, encoded, password), nil
+}
+
+// historyMatches checks to see if a password matches one history value
+func (prm *PRM) historyMatches(value string, password string) bool {
+	i := strings.Index(value, "#")
+	if i < 0 || !strings.HasPrefix(value[i+1:], historyScheme) {
+		return false
+	}
+
+	parts := strings.Split(value[i+1+len(historyScheme):], "$")
+	if len(parts) != 3 {
+		return false
+	}
+
+	_, keys := prm.ufferKeyring()
+	key, ok := keys[parts[0]]
+	if !ok {
+		return false
+	}
+
+	return hmac.Equal([]byte(historyMAC(key, parts[1], password)), []byte(parts[2]))
+}
+
+// historyTime returns the time prefix of a history value, 0 if there isnt one
+func historyTime(value string) int64 {
+	i := strings.Index(value, "#")
+	if i < 0 {
+		return 0
+	}
+	epoch, _ := strconv.ParseInt(value[:i], 10, 64)
+	return epoch
+}
+
+// trimHistory sorts the history newest first and drops anything beyond the
+// configured length
+func trimHistory(values []string, length int) []string {
+	sorted := make([]string, len(values))
+	copy(sorted, values)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return historyTime(sorted[i]) > historyTime(sorted[j])
+	})
+
+	if len(sorted) > length {
+		sorted = sorted[:length]
+	}
+	return sorted
+}
+
+// PasswordInHistory returns true if the password matches any of the
+// passwords recorded in the users history
+func (prm *PRM) PasswordInHistory(entry *ldap.Entry, password string) bool {
+	if prm.Config.HistoryAttribute == "" || entry == nil {
+		return false
+	}
+
+	for _, value := range entry.GetAttributeValues(prm.Config.HistoryAttribute) {
+		if prm.historyMatches(value, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdatePasswordHistory adds the new password to the users history, dropping
+// the oldest entries. The whole attribute is replaced in a single modify so
+// the history is never left half written. Returns true if successful
+func (prm *PRM) UpdatePasswordHistory(username string, newpassword string, entry *ldap.Entry, conn Conn) (result bool) {
+	if prm.Config.HistoryAttribute == "" || prm.Config.HistoryLength < 1 {
+		return true
+	}
+
+	hash, err := prm.hashHistory(newpassword)
+	if err != nil {
+		prm.LogPRM("UpdatePasswordHistory Error: "+err.Error(), LOG_ERROR)
+		return false
+	}
+
+	var values []string
+	if entry != nil {
+		values = entry.GetAttributeValues(prm.Config.HistoryAttribute)
+	}
+	values = append(values, fmt.Sprintf("%d#%v", time.Now().Unix(), hash))
+	values = trimHistory(values, prm.Config.HistoryLength)
+
+	modify := ldap.NewModifyRequest(fmt.Sprintf(prm.Config.PasswordModifyLDAP+",%v", username, prm.Config.BaseDN))
+	modify.Replace(prm.Config.HistoryAttribute, values)
+	err = conn.Modify(modify)
+
+	if err != nil {
+		prm.LogPRM("UpdatePasswordHistory Error: "+err.Error(), LOG_ERROR)
+		return false
+	}
+
+	return true
+}
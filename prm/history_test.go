@@ -0,0 +1,81 @@
+package prm
+
+import (
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"strings"
+	"testing"
+)
+
+// Test a history hash matches only its own password, and only with the key
+// it was made with
+func TestHistoryHash(t *testing.T) {
+	prm := newOTPPRM()
+	hash, err := prm.hashHistory("n4klxui")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := "1474300000#" + hash
+
+	if !strings.HasPrefix(hash, historyScheme+legacyKeyID+"$") {
+		t.Error("history hash not tagged with its key:", hash)
+	}
+
+	if !prm.historyMatches(value, "n4klxui") {
+		t.Error("history hash does not match its own password:", value)
+	}
+
+	if prm.historyMatches(value, "n4klxuj") {
+		t.Error("history hash matches the wrong password:", value)
+	}
+
+	if prm.historyMatches(hash, "n4klxui") {
+		t.Error("history hash without a time should not match")
+	}
+
+	prm.Config.Uffer = "fedcba9876543210fedcba9876543210"
+	if prm.historyMatches(value, "n4klxui") {
+		t.Error("history hash matches with another key:", value)
+	}
+}
+
+// Test the history is kept newest first and trimmed
+func TestTrimHistory(t *testing.T) {
+	var values []string
+	for i := 1; i <= 7; i++ {
+		values = append(values, fmt.Sprintf("%d#{PH1}x", i))
+	}
+
+	trimmed := trimHistory(values, 5)
+
+	if len(trimmed) != 5 {
+		t.Fatal("expected 5 entries, got:", len(trimmed))
+	}
+
+	if historyTime(trimmed[0]) != 7 || historyTime(trimmed[4]) != 3 {
+		t.Error("history not trimmed to the newest entries:", trimmed)
+	}
+}
+
+// Test a password in the users entry is picked up
+func TestPasswordInHistory(t *testing.T) {
+	prm := newOTPPRM()
+	prm.Config.HistoryAttribute = "prmPasswordHistory"
+
+	hash, _ := prm.hashHistory("oldpassword")
+	entry := &ldap.Entry{
+		DN: "uid=user,ou=People",
+		Attributes: []*ldap.EntryAttribute{
+			{Name: "prmPasswordHistory", Values: []string{"1474300000#" + hash}},
+		},
+	}
+
+	if !prm.PasswordInHistory(entry, "oldpassword") {
+		t.Error("oldpassword should be in the history")
+	}
+
+	if prm.PasswordInHistory(entry, "newpassword") {
+		t.Error("newpassword should not be in the history")
+	}
+}
@@ -0,0 +1,348 @@
+package prm
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pages, results and emails are written in English and translated with
+// catalogues in localepath, one YAML file per language named after its code,
+// e.g. fr.yml:
+//
+//	name: Français
+//	messages:
+//	  "Forgotten your password?": "Mot de passe oublié ?"
+//
+// Messages are looked up by their English text, so anything missing from a
+// catalogue is shown in English. A user gets the language they last picked
+// with the switcher on each page, which is remembered in a cookie, or else
+// the best match for their browsers Accept-Language, or else
+// defaultlanguage.
+
+// englishName is shown in the switcher for the built in English
+const englishName = "English"
+
+// The defaults for the language settings
+const (
+	defaultLanguage        = "en"
+	defaultHelpdeskContact = "its-research-support@qmul.ac.uk"
+)
+
+// languageCookie remembers the language picked with the switcher
+const languageCookie = "prm_lang"
+
+// languageParam is the query parameter the switcher links set
+const languageParam = "lang"
+
+// languageCookieAge is how long the picked language is remembered
+const languageCookieAge = 365 * 24 * time.Hour
+
+// languageCode is what a catalogue may be named, a language tag in lower case
+var languageCode = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// Catalogue is the translations for one language
+type Catalogue struct {
+	Name     string            `yaml:"name"`
+	Messages map[string]string `yaml:"messages"`
+}
+
+// Language is a language users can pick, for the switcher
+type Language struct {
+	Code string
+	Name string
+}
+
+// LoadCatalogues reads every catalogue in a directory. A catalogue that
+// can't be read is an error, as it would leave the pages half translated
+func LoadCatalogues(path string) (map[string]*Catalogue, error) {
+	catalogues := make(map[string]*Catalogue)
+	if path == "" {
+		return catalogues, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.yml"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		code := strings.TrimSuffix(filepath.Base(file), ".yml")
+		if !languageCode.MatchString(code) {
+			return nil, fmt.Errorf("catalogue %v is not named after a language code", file)
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		catalogue := new(Catalogue)
+		if err := yaml.UnmarshalStrict(data, catalogue); err != nil {
+			return nil, fmt.Errorf("catalogue %v: %v", file, err)
+		}
+		if catalogue.Name == "" {
+			return nil, fmt.Errorf("catalogue %v has no name", file)
+		}
+		catalogues[code] = catalogue
+	}
+
+	return catalogues, nil
+}
+
+// defaultLanguage is the language used when nothing better is known
+func (config *PRMConfig) defaultLanguage() string {
+	if config.DefaultLanguage != "" {
+		return config.DefaultLanguage
+	}
+	return defaultLanguage
+}
+
+// helpdeskContact is who users are told to get in touch with
+func (config *PRMConfig) helpdeskContact() string {
+	if config.HelpdeskContact != "" {
+		return config.HelpdeskContact
+	}
+	return defaultHelpdeskContact
+}
+
+// CheckLanguageConfig loads the catalogues and makes sure the default
+// language is one of them
+func CheckLanguageConfig(config *PRMConfig) error {
+	catalogues, err := LoadCatalogues(config.LocalePath)
+	if err != nil {
+		return err
+	}
+	config.catalogues = catalogues
+
+	if config.defaultLanguage() != defaultLanguage && catalogues[config.defaultLanguage()] == nil {
+		return errors.New("defaultlanguage " + config.defaultLanguage() + " has no catalogue in localepath")
+	}
+	return nil
+}
+
+// Languages lists the languages users can pick, English first
+func Languages(config *PRMConfig) []Language {
+	languages := []Language{{defaultLanguage, englishName}}
+
+	var codes []string
+	for code := range config.catalogues {
+		if code != defaultLanguage {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		languages = append(languages, Language{code, config.catalogues[code].Name})
+	}
+	return languages
+}
+
+// Translate looks a message up in the catalogue for a language, giving the
+// message back as it is if there is no translation
+func Translate(config *PRMConfig, lang string, message string) string {
+	if catalogue := config.catalogues[lang]; catalogue != nil {
+		if translated := catalogue.Messages[message]; translated != "" {
+			return translated
+		}
+	}
+	return message
+}
+
+// TranslateReason translates why a password was refused, from the data given
+// back with the result, filling in the attribute it was based on if any
+func TranslateReason(config *PRMConfig, lang string, data map[string]string) string {
+	return strings.Replace(Translate(config, lang, data["reason"]), "%ATTRIBUTE%", data["attribute"], -1)
+}
+
+// matchLanguage finds the language we have for a tag from a browser, trying
+// the whole tag then just the language, so en-GB gets en. It returns "" if
+// there is no match
+func matchLanguage(config *PRMConfig, tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	for tag != "" {
+		if tag == defaultLanguage || config.catalogues[tag] != nil {
+			return tag
+		}
+		dash := strings.LastIndex(tag, "-")
+		if dash == -1 {
+			break
+		}
+		tag = tag[:dash]
+	}
+	return ""
+}
+
+// parseAcceptLanguage returns the tags in an Accept-Language header, most
+// wanted first. Tags with a q of 0, or one that can't be read, are left out
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				value, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					value = 0
+				}
+				q = value
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	result := make([]string, len(tags))
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+	return result
+}
+
+// RequestLanguage picks the language for a request: the one just chosen with
+// the switcher, the one remembered in the cookie, the best match for the
+// browser or else the default
+func RequestLanguage(config *PRMConfig, r *http.Request) string {
+	if r == nil {
+		return config.defaultLanguage()
+	}
+
+	if lang := matchLanguage(config, r.URL.Query().Get(languageParam)); lang != "" {
+		return lang
+	}
+
+	if cookie, err := r.Cookie(languageCookie); err == nil {
+		if lang := matchLanguage(config, cookie.Value); lang != "" {
+			return lang
+		}
+	}
+
+	for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		if tag == "*" {
+			break
+		}
+		if lang := matchLanguage(config, tag); lang != "" {
+			return lang
+		}
+	}
+
+	return config.defaultLanguage()
+}
+
+// Language picks the language for a page and, if the user has just chosen
+// one with the switcher, remembers it in a cookie. It must be called before
+// anything is written
+func (prm *PRM) Language(w http.ResponseWriter, r *http.Request) string {
+	lang := RequestLanguage(prm.Config, r)
+
+	if r.URL.Query().Get(languageParam) != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     languageCookie,
+			Value:    lang,
+			Path:     "/",
+			Expires:  time.Now().Add(languageCookieAge),
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	w.Header().Set("Content-Language", lang)
+	return lang
+}
+
+// ResultMessage is the message for a result in a language, with the
+// helpdesk contact filled in
+func (prm *PRM) ResultMessage(result Result, lang string) string {
+	message := Translate(prm.Config, lang, ResultMap[result.Message])
+	return strings.Replace(message, "%HELPDESK%", prm.Config.helpdeskContact(), -1)
+}
+
+// TranslateReport translates the advice in a /check answer. Message is left
+// alone, as older clients look for "GOOD" in it, and Reason carries the
+// translation instead
+func (prm *PRM) TranslateReport(report PasswordReport, lang string) PasswordReport {
+	if report.Message != "GOOD" {
+		report.Reason = Translate(prm.Config, lang, report.Message)
+	}
+	report.Warning = Translate(prm.Config, lang, report.Warning)
+
+	suggestions := make([]string, len(report.Suggestions))
+	for i, suggestion := range report.Suggestions {
+		suggestions[i] = Translate(prm.Config, lang, suggestion)
+	}
+	report.Suggestions = suggestions
+	return report
+}
+
+// switcherURL is where a link in the switcher goes: the same page in another
+// language, or the front page if the page was the answer to a form
+func switcherURL(r *http.Request, lang string) string {
+	target := url.URL{Path: "/"}
+	query := url.Values{}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		target.Path = r.URL.Path
+		query = r.URL.Query()
+	}
+	query.Set(languageParam, lang)
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// Template parses a page from TemplatePath for a language, along with
+// language.html, which defines the switcher, if there is one. Pages can use
+//
+//	{{T "message" args...}}  the message translated, formatted with args
+//	{{Lang}}                 the code of the language
+//	{{Languages}}            the languages for the switcher
+//	{{LanguageURL "fr"}}     this page in another language
+//	{{Helpdesk}}             helpdeskcontact
+func (prm *PRM) Template(r *http.Request, lang string, name string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"T": func(message string, args ...interface{}) string {
+			translated := Translate(prm.Config, lang, message)
+			if len(args) > 0 {
+				return fmt.Sprintf(translated, args...)
+			}
+			return translated
+		},
+		"Lang":        func() string { return lang },
+		"Languages":   func() []Language { return Languages(prm.Config) },
+		"LanguageURL": func(code string) string { return switcherURL(r, code) },
+		"Helpdesk":    prm.Config.helpdeskContact,
+	}
+
+	files := []string{prm.Config.TemplatePath + name}
+	if _, err := os.Stat(prm.Config.TemplatePath + "language.html"); err == nil {
+		files = append(files, prm.Config.TemplatePath+"language.html")
+	}
+
+	return template.New(name).Funcs(funcs).ParseFiles(files...)
+}
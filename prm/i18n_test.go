@@ -0,0 +1,267 @@
+package prm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// newI18nPRM has a French catalogue and one for Swiss German, to test tags
+// with a region
+func newI18nPRM() *PRM {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.HelpdeskContact = "help@example.com"
+	prm.Config.catalogues = map[string]*Catalogue{
+		"fr": {Name: "Français", Messages: map[string]string{
+			"Success": "Succès",
+			"Error; your one-time unlocking code has expired. Please contact %HELPDESK% for a new code.": "Erreur ; contactez %HELPDESK%.",
+			"it is too short":                 "est trop court",
+			"it is based on your %ATTRIBUTE%": "reprend votre %ATTRIBUTE%",
+		}},
+		"de-ch": {Name: "Deutsch (Schweiz)", Messages: map[string]string{}},
+	}
+	return prm
+}
+
+// Test browsers' preferences are read most wanted first
+func TestParseAcceptLanguage(t *testing.T) {
+	test_map := map[string]string{
+		"":                          "",
+		"fr":                        "fr",
+		"fr-CH, fr;q=0.9, en;q=0.8": "fr-CH fr en",
+		"en;q=0.5, fr":              "fr en",
+		"de;q=0, fr;q=0.1":          "fr",
+		"de;q=x, it , *;q=0.1":      "it *",
+	}
+
+	for header, want := range test_map {
+		if got := strings.Join(parseAcceptLanguage(header), " "); got != want {
+			t.Error("For:", header, "got:", got)
+		}
+	}
+}
+
+// Test the language is the one picked, then the remembered one, then the
+// best for the browser, then the default
+func TestRequestLanguage(t *testing.T) {
+	prm := newI18nPRM()
+
+	test_map := []struct {
+		target string
+		cookie string
+		accept string
+		want   string
+	}{
+		{"/", "", "", "en"},
+		{"/", "", "fr-FR,en;q=0.5", "fr"},
+		{"/", "", "es, en-GB;q=0.9, fr;q=0.8", "en"},
+		{"/", "", "de-CH-1996", "de-ch"},
+		{"/", "", "de", "en"},
+		{"/", "", "*", "en"},
+		{"/", "fr", "en", "fr"},
+		{"/", "xx", "fr", "fr"},
+		{"/?lang=en", "fr", "fr", "en"},
+		{"/?lang=../../etc", "", "fr", "fr"},
+	}
+
+	for _, test := range test_map {
+		r := httptest.NewRequest("GET", test.target, nil)
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: languageCookie, Value: test.cookie})
+		}
+		r.Header.Set("Accept-Language", test.accept)
+		if got := RequestLanguage(prm.Config, r); got != test.want {
+			t.Error("For:", test.target, test.cookie, test.accept, "got:", got)
+		}
+	}
+
+	if got := RequestLanguage(prm.Config, nil); got != "en" {
+		t.Error("For: no request got:", got)
+	}
+}
+
+// Test picking a language with the switcher remembers it
+func TestLanguageCookie(t *testing.T) {
+	prm := newI18nPRM()
+
+	w := httptest.NewRecorder()
+	if lang := prm.Language(w, httptest.NewRequest("GET", "/forgot?lang=fr", nil)); lang != "fr" {
+		t.Error("For: switch got:", lang)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != languageCookie || cookies[0].Value != "fr" {
+		t.Error("For: cookie got:", cookies)
+	}
+	if w.Header().Get("Content-Language") != "fr" {
+		t.Error("For: Content-Language got:", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	prm.Language(w, httptest.NewRequest("GET", "/forgot", nil))
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Error("For: no switch got:", cookies)
+	}
+}
+
+// Test results are translated with the helpdesk filled in
+func TestResultMessage(t *testing.T) {
+	prm := newI18nPRM()
+
+	test_map := []struct {
+		code int
+		lang string
+		want string
+	}{
+		{Success, "en", "Success"},
+		{Success, "fr", "Succès"},
+		{Success, "de-ch", "Success"},
+		{ErrorOTPExpired, "fr", "Erreur ; contactez help@example.com."},
+		{ErrorOTPExpired, "en", "Error; your one-time unlocking code has expired. Please contact help@example.com for a new code."},
+	}
+
+	for _, test := range test_map {
+		if got := prm.ResultMessage(Result{test.code}, test.lang); got != test.want {
+			t.Error("For:", test.code, test.lang, "got:", got)
+		}
+	}
+
+	result := Result{ErrorOTPExpired}
+	if strings.Contains(result.ToString(), "%HELPDESK%") {
+		t.Error("For: ToString got:", result.ToString())
+	}
+
+	reason := map[string]string{"reason": "it is based on your %ATTRIBUTE%", "attribute": "telephoneNumber"}
+	if got := TranslateReason(prm.Config, "fr", reason); got != "reprend votre telephoneNumber" {
+		t.Error("For: TranslateReason got:", got)
+	}
+
+	report := prm.TranslateReport(PasswordReport{Message: "it is too short"}, "fr")
+	if report.Message != "it is too short" || report.Reason != "est trop court" {
+		t.Error("For: TranslateReport got:", report)
+	}
+}
+
+// Test catalogues are loaded, and mistakes in them refused
+func TestLoadCatalogues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(dir+"/fr.yml", []byte("name: Français\nmessages:\n  Success: Succès\n"), 0600)
+	ioutil.WriteFile(dir+"/README", []byte("not a catalogue"), 0600)
+
+	config := &PRMConfig{LocalePath: dir, DefaultLanguage: "fr"}
+	if err := CheckLanguageConfig(config); err != nil {
+		t.Fatal("CheckLanguageConfig failed:", err)
+	}
+	if languages := Languages(config); len(languages) != 2 || languages[0].Code != "en" || languages[1].Name != "Français" {
+		t.Error("For: Languages got:", languages)
+	}
+
+	config.DefaultLanguage = "de"
+	if err := CheckLanguageConfig(config); err == nil {
+		t.Error("For: default without catalogue got: nil")
+	}
+	config.DefaultLanguage = ""
+
+	test_map := map[string]string{
+		"fr.yml":     "name: Français\nmesages:\n  Success: Succès\n",
+		"de.yml":     "messages:\n  Success: Erfolg\n",
+		"French.yml": "name: Français\n",
+	}
+	for file, content := range test_map {
+		bad, _ := ioutil.TempDir(dir, "bad")
+		ioutil.WriteFile(bad+"/"+file, []byte(content), 0600)
+		config.LocalePath = bad
+		if err := CheckLanguageConfig(config); err == nil {
+			t.Error("For:", file, "got: nil")
+		}
+	}
+}
+
+// Test the pages that ship with the server render in every shipped language,
+// and that every message on them has a translation
+func TestShippedPages(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = &PRMConfig{TemplatePath: "../templates/", LocalePath: "../locales/"}
+	if err := CheckLanguageConfig(prm.Config); err != nil {
+		t.Fatal("CheckLanguageConfig failed:", err)
+	}
+
+	pages, _ := ioutil.ReadDir("../templates")
+	message := regexp.MustCompile(`{{T "((?:[^"\\]|\\.)*)"`)
+
+	for _, language := range Languages(prm.Config) {
+		for _, page := range pages {
+			if page.IsDir() || page.Name() == "language.html" {
+				continue
+			}
+
+			r := httptest.NewRequest("GET", "/reset?reset=abc", nil)
+			tmpl, err := prm.Template(r, language.Code, page.Name())
+			if err != nil {
+				t.Error("For:", page.Name(), "got:", err)
+				continue
+			}
+
+			var out bytes.Buffer
+			data := map[string]interface{}{"Message": "", "Codes": []string{"a"}, "Path": "/nowhere"}
+			if err := tmpl.Execute(&out, data); err != nil {
+				t.Error("For:", page.Name(), language.Code, "got:", err)
+			}
+			// The switcher links to the same page in the other languages
+			other := "fr"
+			if language.Code != "en" {
+				other = "en"
+			}
+			if !strings.Contains(out.String(), "/reset?lang="+other+"&amp;reset=abc") {
+				t.Error("For:", page.Name(), language.Code, "got no switcher")
+			}
+
+			if language.Code == "en" {
+				continue
+			}
+			source, _ := ioutil.ReadFile("../templates/" + page.Name())
+			for _, m := range message.FindAllStringSubmatch(string(source), -1) {
+				msgid := strings.Replace(m[1], `\"`, `"`, -1)
+				if Translate(prm.Config, language.Code, msgid) == msgid {
+					t.Error("For:", page.Name(), language.Code, "no translation of:", msgid)
+				}
+			}
+		}
+	}
+}
+
+// Test emails use the translated templates and subject when there are some
+func TestTranslatedEmail(t *testing.T) {
+	config := &PRMConfig{TemplatePath: "../templates/", LocalePath: "../locales/"}
+	if err := CheckLanguageConfig(config); err != nil {
+		t.Fatal("CheckLanguageConfig failed:", err)
+	}
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Accept-Language", "fr-FR")
+	data := NewEmailData(config, "abc123", "Zoë", r)
+
+	email, err := RenderEmail(config, "changed", "abc123@example.com", "Your password has been changed", "", data)
+	if err != nil {
+		t.Fatal("RenderEmail failed:", err)
+	}
+	if email.Subject != "Votre mot de passe a été modifié" || !strings.HasPrefix(email.Text, "Bonjour Zoë") || !strings.Contains(email.HTML, "Bonjour") {
+		t.Error("For: changed got:", email)
+	}
+
+	// There is no translation of the alert so the English is used
+	email, err = RenderEmail(config, "alert-no-email", "staff@example.com", "Alert", "", data)
+	if err != nil || !strings.HasPrefix(email.Text, "The password for abc123") {
+		t.Error("For: alert got:", email, err)
+	}
+}
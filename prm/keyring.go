@@ -0,0 +1,111 @@
+package prm
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// The uffer keyring lets the uffer key be rotated without throwing away every
+// session in flight. Everything is sealed or hashed with the primary key and
+// tagged with its id, and any key still in the ring can open it. To rotate,
+// add a new key and make it primary. Sessions move off the old key within the
+// session timeout, but TOTP records, recovery codes, spooled mail and the
+// password history keep needing it for much longer; see the README.
+
+// legacyKeyID is the id given to the single uffer key when no keyring is set
+const legacyKeyID = "0"
+
+// ufferKeyChars are the characters a generated key is made from
+const ufferKeyChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// ufferKeyLength gives AES-256 keys
+const ufferKeyLength = 32
+
+// ufferKeyring returns the id of the primary key and every usable key
+func (prm *PRM) ufferKeyring() (string, map[string]string) {
+	if len(prm.Config.UfferKeys) == 0 {
+		return legacyKeyID, map[string]string{legacyKeyID: prm.Config.Uffer}
+	}
+	return prm.Config.UfferPrimary, prm.Config.UfferKeys
+}
+
+// CheckUfferKeys checks the primary key exists and every key is a valid AES
+// key length
+func (prm *PRM) CheckUfferKeys() error {
+	primary, keys := prm.ufferKeyring()
+
+	if _, ok := keys[primary]; !ok {
+		return errors.New("uffer primary key " + primary + " is not in the keyring")
+	}
+
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if id == "" || strings.ContainsAny(id, ".$") {
+			return errors.New("uffer key id " + id + " must be non empty and not contain a . or $")
+		}
+		switch len(keys[id]) {
+		case 16, 24, 32:
+		default:
+			return errors.New("uffer key " + id + " must be 16, 24 or 32 characters long")
+		}
+	}
+	return nil
+}
+
+// sealKeyed seals plaintext for a purpose with the primary key and tags it
+// with the key id
+func (prm *PRM) sealKeyed(purpose string, plaintext []byte) (string, error) {
+	primary, keys := prm.ufferKeyring()
+
+	key, ok := keys[primary]
+	if !ok {
+		return "", errors.New("uffer primary key " + primary + " is not in the keyring")
+	}
+
+	sealed, err := sealUffer(purpose, plaintext, key)
+	if err != nil {
+		return "", err
+	}
+	return primary + "." + sealed, nil
+}
+
+// openKeyed opens an uffer with whichever key in the ring its tag names.
+// Untagged uffers, ones sealed with a key since removed and ones sealed for
+// another purpose are invalid
+func (prm *PRM) openKeyed(purpose string, uffer string) ([]byte, error) {
+	i := strings.Index(uffer, ".")
+	if i < 0 {
+		return nil, ErrUfferInvalid
+	}
+
+	_, keys := prm.ufferKeyring()
+	key, ok := keys[uffer[:i]]
+	if !ok {
+		return nil, ErrUfferInvalid
+	}
+
+	return openUffer(purpose, uffer[i+1:], key)
+}
+
+// GenerateUfferKey returns a new random key suitable for the keyring
+func GenerateUfferKey() (string, error) {
+	key := make([]byte, ufferKeyLength)
+	max := big.NewInt(int64(len(ufferKeyChars)))
+
+	for i := range key {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		key[i] = ufferKeyChars[n.Int64()]
+	}
+	return string(key), nil
+}
@@ -0,0 +1,87 @@
+package prm
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test tokens sealed with an old key still open after rotation, and not once
+// the key is removed
+func TestKeyringRotation(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.UfferKeys = map[string]string{"old": "0123456789ABCDEF"}
+	prm.Config.UfferPrimary = "old"
+
+	sealed, err := prm.sealKeyed(ufferSession, []byte("test"))
+	if err != nil || !strings.HasPrefix(sealed, "old.") {
+		t.Fatal("sealKeyed failed, got:", sealed, err)
+	}
+
+	prm.Config.UfferKeys["new"] = "FEDCBA9876543210FEDCBA9876543210"
+	prm.Config.UfferPrimary = "new"
+
+	if plaintext, err := prm.openKeyed(ufferSession, sealed); err != nil || string(plaintext) != "test" {
+		t.Error("Old key should still open, got:", string(plaintext), err)
+	}
+
+	resealed, _ := prm.sealKeyed(ufferSession, []byte("test"))
+	if !strings.HasPrefix(resealed, "new.") {
+		t.Error("Expected the new primary key, got:", resealed)
+	}
+
+	delete(prm.Config.UfferKeys, "old")
+	if _, err := prm.openKeyed(ufferSession, sealed); err != ErrUfferInvalid {
+		t.Error("Expected ErrUfferInvalid once the key is removed, got:", err)
+	}
+}
+
+// Test the single uffer key is used when no keyring is configured
+func TestKeyringLegacy(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.Uffer = "0123456789ABCDEF"
+
+	sealed, err := prm.sealKeyed(ufferSession, []byte("test"))
+	if err != nil {
+		t.Fatal("sealKeyed failed:", err)
+	}
+
+	if plaintext, err := prm.openKeyed(ufferSession, sealed); err != nil || string(plaintext) != "test" {
+		t.Error("For: legacy uffer got:", string(plaintext), err)
+	}
+}
+
+// Test keyring configuration problems are found
+func TestCheckUfferKeys(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+
+	test_map := map[string]map[string]string{
+		"good":    {"a": "0123456789ABCDEF", "b": "0123456789ABCDEF01234567"},
+		"missing": {"b": "0123456789ABCDEF"},
+		"short":   {"a": "0123456789"},
+		"dotted":  {"a": "0123456789ABCDEF", "b.c": "0123456789ABCDEF"},
+	}
+
+	for name, keys := range test_map {
+		prm.Config.UfferKeys = keys
+		prm.Config.UfferPrimary = "a"
+		err := prm.CheckUfferKeys()
+		if (name == "good") != (err == nil) {
+			t.Error("For:", name, "got:", err)
+		}
+	}
+}
+
+// Test generated keys are the right length and usable
+func TestGenerateUfferKey(t *testing.T) {
+	key, err := GenerateUfferKey()
+	if err != nil || len(key) != ufferKeyLength {
+		t.Fatal("GenerateUfferKey failed, got:", key, err)
+	}
+
+	if _, err := sealUffer(ufferSession, []byte("test"), key); err != nil {
+		t.Error("Generated key was not usable:", err)
+	}
+}
@@ -0,0 +1,371 @@
+package prm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Emails sent while handling a request go through a queue, so a slow mail
+// server doesn't hold up the page and one that is down doesn't lose them.
+// When mailspoolpath is set each email is written to its own file in the
+// queue directory under it, and a sender in the server tries to deliver it,
+// waiting longer after each failure. An email that still hasn't gone after
+// mailmaxattempts tries, or that the mail server refuses outright, is moved
+// to the dead directory for someone to look at with prm-admin mail queue.
+//
+// Without a spool each email is tried in the background of the process that
+// made it, with the same retries, but is lost if the process stops.
+
+// ErrMailNotFound is returned for an id that is not in the spool
+var ErrMailNotFound = errors.New("email not found in the spool")
+
+// defaultMailMaxAttempts is how many times an email is tried if no limit is
+// configured. With the backoff below that is about five hours
+const defaultMailMaxAttempts = 10
+
+// mailRetryBase and mailRetryMax set the backoff between tries, which
+// doubles each time up to the maximum
+const (
+	mailRetryBase = time.Minute
+	mailRetryMax  = time.Hour
+)
+
+// mailQueueInterval is how often the sender looks for emails that are due
+const mailQueueInterval = 30 * time.Second
+
+// The directories under mailspoolpath
+const (
+	mailQueueDir = "queue"
+	mailDeadDir  = "dead"
+)
+
+// SpooledEmail is an email in the spool. The body is sealed, as it may hold a
+// one-time code or reset link, but who it is to and the subject are left
+// readable for prm-admin
+type SpooledEmail struct {
+	ID       string `json:"-"`
+	To       string `json:"to"`
+	Subject  string `json:"subject"`
+	Sealed   string `json:"sealed"`
+	Queued   int64  `json:"queued"`
+	Attempts int    `json:"attempts"`
+	Next     int64  `json:"next"`
+	Error    string `json:"error,omitempty"`
+	Dead     bool   `json:"-"`
+}
+
+// mailMaxAttempts is how many times an email is tried before it is dead
+func (prm *PRM) mailMaxAttempts() int {
+	if prm.Config.MailMaxAttempts > 0 {
+		return prm.Config.MailMaxAttempts
+	}
+	return defaultMailMaxAttempts
+}
+
+// mailBackoff is how long to wait after a number of failed tries
+func mailBackoff(attempts int) time.Duration {
+	wait := mailRetryBase
+	for i := 1; i < attempts && wait < mailRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > mailRetryMax {
+		wait = mailRetryMax
+	}
+	return wait
+}
+
+// permanentMailError checks if the mail server refused an email outright,
+// in which case trying again won't help
+func permanentMailError(err error) bool {
+	smtpErr, ok := err.(*textproto.Error)
+	return ok && smtpErr.Code >= 500
+}
+
+// mailSpoolDir returns a directory in the spool
+func (prm *PRM) mailSpoolDir(name string) string {
+	return filepath.Join(prm.Config.MailSpoolPath, name)
+}
+
+// QueueEmail hands an email to the queue to be sent in the background
+func (prm *PRM) QueueEmail(email *Email) error {
+	if prm.Config.MailSpoolPath == "" {
+		go prm.sendWithRetries(email)
+		return nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(email)
+	if err != nil {
+		return err
+	}
+	sealed, err := prm.sealKeyed(ufferMail, body)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	spooled := &SpooledEmail{
+		ID:      hex.EncodeToString(id),
+		To:      email.To,
+		Subject: email.Subject,
+		Sealed:  sealed,
+		Queued:  now,
+		Next:    now,
+	}
+	return prm.writeSpooled(mailQueueDir, spooled)
+}
+
+// sendWithRetries tries an email until it goes or runs out of tries, for
+// when there is no spool
+func (prm *PRM) sendWithRetries(email *Email) {
+	for attempts := 1; ; attempts++ {
+		err := sendMessage(prm.Config, email)
+		if err == nil {
+			return
+		}
+
+		if permanentMailError(err) || attempts >= prm.mailMaxAttempts() {
+			prm.LogPRM("Email to "+email.To+" given up: "+err.Error(), LOG_ERROR)
+			return
+		}
+
+		prm.LogPRM("Email to "+email.To+" failed, will retry: "+err.Error(), LOG_WARN)
+		time.Sleep(mailBackoff(attempts))
+	}
+}
+
+// writeSpooled writes an email to a temporary file and renames it into place
+// so the sender never sees half an email
+func (prm *PRM) writeSpooled(dir string, spooled *SpooledEmail) error {
+	path := prm.mailSpoolDir(dir)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(spooled)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(path, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(path, spooled.ID))
+}
+
+// readSpooled reads an email from the spool
+func readSpooled(path string) (*SpooledEmail, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	spooled := new(SpooledEmail)
+	if err := json.Unmarshal(data, spooled); err != nil {
+		return nil, err
+	}
+	spooled.ID = filepath.Base(path)
+	return spooled, nil
+}
+
+// validMailID checks an id is one QueueEmail could have made, so it is safe
+// to use as a file name
+func validMailID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
+// MailQueue lists the emails waiting to be sent followed by the dead ones
+func (prm *PRM) MailQueue() ([]*SpooledEmail, error) {
+	if prm.Config.MailSpoolPath == "" {
+		return nil, errors.New("mailspoolpath is not set")
+	}
+
+	var emails []*SpooledEmail
+	for _, dir := range []string{mailQueueDir, mailDeadDir} {
+		files, err := ioutil.ReadDir(prm.mailSpoolDir(dir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		var found []*SpooledEmail
+		for _, f := range files {
+			if !validMailID(f.Name()) {
+				continue
+			}
+			spooled, err := readSpooled(filepath.Join(prm.mailSpoolDir(dir), f.Name()))
+			if err != nil {
+				continue
+			}
+			spooled.Dead = dir == mailDeadDir
+			found = append(found, spooled)
+		}
+
+		sort.Slice(found, func(i, j int) bool { return found[i].Queued < found[j].Queued })
+		emails = append(emails, found...)
+	}
+
+	return emails, nil
+}
+
+// ProcessMailQueue tries every email that is due, or every email waiting if
+// all is set. It returns how many were sent and how many failed
+func (prm *PRM) ProcessMailQueue(all bool) (sent int, failed int) {
+	if prm.Config.MailSpoolPath == "" {
+		return 0, 0
+	}
+
+	dir := prm.mailSpoolDir(mailQueueDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0
+	}
+
+	now := time.Now()
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if strings.HasPrefix(f.Name(), ".") {
+			// An email claimed by a process that stopped part way through
+			// goes back in the queue, anything else left over is removed
+			if time.Since(f.ModTime()) > time.Hour {
+				if id := strings.TrimPrefix(f.Name(), ".sending-"); id != f.Name() && validMailID(id) {
+					os.Rename(path, filepath.Join(dir, id))
+				} else {
+					os.Remove(path)
+				}
+			}
+			continue
+		}
+		if !validMailID(f.Name()) {
+			continue
+		}
+
+		spooled, err := readSpooled(path)
+		if err != nil || (!all && now.Unix() < spooled.Next) {
+			continue
+		}
+
+		switch err := prm.sendSpooled(f.Name()); err {
+		case nil:
+			sent++
+		case ErrMailNotFound:
+			// Another process got to it first
+		default:
+			failed++
+		}
+	}
+
+	return sent, failed
+}
+
+// sendSpooled claims an email by renaming it, so only one process sends it,
+// then tries it and either removes it, puts it back for later or moves it to
+// the dead letters
+func (prm *PRM) sendSpooled(id string) error {
+	dir := prm.mailSpoolDir(mailQueueDir)
+	claimed := filepath.Join(dir, ".sending-"+id)
+	if err := os.Rename(filepath.Join(dir, id), claimed); err != nil {
+		return ErrMailNotFound
+	}
+	// Touch the claim so it isn't mistaken for one left by a stopped process
+	now := time.Now()
+	os.Chtimes(claimed, now, now)
+
+	spooled, err := readSpooled(claimed)
+	if err != nil {
+		os.Remove(claimed)
+		return err
+	}
+	spooled.ID = id
+
+	email := new(Email)
+	body, err := prm.openKeyed(ufferMail, spooled.Sealed)
+	if err == nil {
+		err = json.Unmarshal(body, email)
+	}
+	if err == nil {
+		err = sendMessage(prm.Config, email)
+	}
+
+	if err == nil {
+		os.Remove(claimed)
+		prm.LogPRM("Email sent to "+spooled.To, LOG_INFO)
+		return nil
+	}
+
+	spooled.Attempts++
+	spooled.Error = err.Error()
+	spooled.Next = time.Now().Add(mailBackoff(spooled.Attempts)).Unix()
+
+	target := mailQueueDir
+	if permanentMailError(err) || spooled.Attempts >= prm.mailMaxAttempts() {
+		target = mailDeadDir
+		prm.LogPRM(fmt.Sprintf("Email %v to %v is dead after %d tries: %v", id, spooled.To, spooled.Attempts, err), LOG_ERROR)
+	} else {
+		prm.LogPRM(fmt.Sprintf("Email %v to %v failed, will retry: %v", id, spooled.To, err), LOG_WARN)
+	}
+
+	if werr := prm.writeSpooled(target, spooled); werr != nil {
+		// Leave the claim to be put back in the queue later
+		prm.LogPRM("writeSpooled Error: "+werr.Error(), LOG_ERROR)
+		return err
+	}
+	os.Remove(claimed)
+	return err
+}
+
+// RequeueMail moves a dead email back into the queue to be tried again
+// straight away, with a fresh set of tries
+func (prm *PRM) RequeueMail(id string) error {
+	if !validMailID(id) {
+		return ErrMailNotFound
+	}
+
+	path := filepath.Join(prm.mailSpoolDir(mailDeadDir), id)
+	spooled, err := readSpooled(path)
+	if err != nil {
+		return ErrMailNotFound
+	}
+
+	spooled.Attempts = 0
+	spooled.Next = time.Now().Unix()
+	spooled.Error = ""
+	if err := prm.writeSpooled(mailQueueDir, spooled); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// RunMailQueue sends emails from the spool as they fall due. It never
+// returns, so run it in its own goroutine
+func (prm *PRM) RunMailQueue() {
+	for {
+		prm.ProcessMailQueue(false)
+		time.Sleep(mailQueueInterval)
+	}
+}
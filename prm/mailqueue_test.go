@@ -0,0 +1,155 @@
+package prm
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMailQueuePRM sends through a fake mail server with a spool in a
+// temporary directory
+func newMailQueuePRM(t *testing.T, server *fakeSMTP) (*PRM, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prm = new(PRM)
+	prm.Config = server.config()
+	prm.Config.Uffer = "0123456789ABCDEF"
+	prm.Config.MailSpoolPath = dir
+	return prm, func() { os.RemoveAll(dir); server.listener.Close() }
+}
+
+// Test a queued email waits in the spool until the sender gets to it
+func TestMailQueue(t *testing.T) {
+	server := newFakeSMTP(t, "")
+	prm, cleanup := newMailQueuePRM(t, server)
+	defer cleanup()
+
+	email := &Email{To: "abc123@example.com", Subject: "Hello", Text: "Your code is 123456789\n"}
+	if err := prm.QueueEmail(email); err != nil {
+		t.Fatal("QueueEmail failed:", err)
+	}
+
+	emails, err := prm.MailQueue()
+	if err != nil || len(emails) != 1 || emails[0].To != email.To || emails[0].Dead {
+		t.Fatal("For: queued got:", emails, err)
+	}
+
+	// The body is sealed in the spool
+	data, _ := ioutil.ReadFile(prm.mailSpoolDir(mailQueueDir) + "/" + emails[0].ID)
+	if len(data) == 0 || strings.Contains(string(data), "123456789") {
+		t.Error("For: spool file got:", string(data))
+	}
+
+	if sent, failed := prm.ProcessMailQueue(false); sent != 1 || failed != 0 {
+		t.Error("For: ProcessMailQueue got:", sent, failed)
+	}
+	<-server.done
+
+	if server.sent != 1 || !strings.Contains(server.data, "123456789") {
+		t.Error("For: delivered got:", server.sent, server.data)
+	}
+
+	if emails, _ := prm.MailQueue(); len(emails) != 0 {
+		t.Error("For: after sending got:", emails)
+	}
+}
+
+// Test a failed email is tried again later, then given up on, and can be
+// put back in the queue
+func TestMailQueueRetries(t *testing.T) {
+	server := newFakeSMTP(t, "")
+	prm, cleanup := newMailQueuePRM(t, server)
+	defer cleanup()
+
+	// Nothing is listening here
+	prm.Config.SMTPPort = 1
+	prm.Config.MailMaxAttempts = 2
+
+	if err := prm.QueueEmail(&Email{To: "abc123@example.com", Subject: "Hello", Text: "Hi\n"}); err != nil {
+		t.Fatal("QueueEmail failed:", err)
+	}
+
+	if sent, failed := prm.ProcessMailQueue(false); sent != 0 || failed != 1 {
+		t.Error("For: first try got:", sent, failed)
+	}
+
+	emails, _ := prm.MailQueue()
+	if len(emails) != 1 || emails[0].Attempts != 1 || emails[0].Error == "" || emails[0].Next <= time.Now().Unix() {
+		t.Fatal("For: after one failure got:", emails)
+	}
+
+	// It isn't due yet, so only a flush tries it
+	if sent, failed := prm.ProcessMailQueue(false); sent != 0 || failed != 0 {
+		t.Error("For: not due got:", sent, failed)
+	}
+	if sent, failed := prm.ProcessMailQueue(true); sent != 0 || failed != 1 {
+		t.Error("For: flush got:", sent, failed)
+	}
+
+	emails, _ = prm.MailQueue()
+	if len(emails) != 1 || !emails[0].Dead || emails[0].Attempts != 2 {
+		t.Fatal("For: dead got:", emails)
+	}
+
+	// Dead emails are left alone until requeued
+	if sent, failed := prm.ProcessMailQueue(true); sent != 0 || failed != 0 {
+		t.Error("For: dead flush got:", sent, failed)
+	}
+
+	prm.Config.SMTPPort = server.config().SMTPPort
+	if err := prm.RequeueMail(emails[0].ID); err != nil {
+		t.Fatal("RequeueMail failed:", err)
+	}
+	if sent, failed := prm.ProcessMailQueue(false); sent != 1 || failed != 0 {
+		t.Error("For: requeued got:", sent, failed)
+	}
+
+	if err := prm.RequeueMail(emails[0].ID); err != ErrMailNotFound {
+		t.Error("For: requeue twice got:", err)
+	}
+	if err := prm.RequeueMail("../queue"); err != ErrMailNotFound {
+		t.Error("For: bad id got:", err)
+	}
+}
+
+// Test an email the mail server refuses outright isn't tried again
+func TestMailQueueRefused(t *testing.T) {
+	server := newFakeSMTP(t, "reject")
+	prm, cleanup := newMailQueuePRM(t, server)
+	defer cleanup()
+
+	if err := prm.QueueEmail(&Email{To: "nobody@example.com", Subject: "Hello", Text: "Hi\n"}); err != nil {
+		t.Fatal("QueueEmail failed:", err)
+	}
+
+	if sent, failed := prm.ProcessMailQueue(false); sent != 0 || failed != 1 {
+		t.Error("For: refused got:", sent, failed)
+	}
+
+	emails, _ := prm.MailQueue()
+	if len(emails) != 1 || !emails[0].Dead || emails[0].Attempts != 1 {
+		t.Error("For: refused got:", emails)
+	}
+}
+
+// Test the wait between tries doubles up to the maximum
+func TestMailBackoff(t *testing.T) {
+	test_map := map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		7:  time.Hour,
+		50: time.Hour,
+	}
+
+	for attempts, want := range test_map {
+		if got := mailBackoff(attempts); got != want {
+			t.Error("For:", attempts, "got:", got)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package prm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users can be emailed when something happens to their account that they
+// might not have done themselves. Each kind of notice is turned on by naming
+// it in notifyevents. Notices go to the address reset links are sent to and,
+// if notifysecondaryattribute is set, the address held there too. A user is
+// sent at most one notice of each kind every notifyinterval, so someone
+// guessing at the form can't use it to flood their inbox.
+//
+// Failures are counted, and networks remembered, in their own store, a
+// directory given by notifypath so every server process sees the same
+// numbers. It is kept apart from the replay cache as networks are remembered
+// for a year, and the replay cache is used on every form.
+
+// Notification events, as named in notifyevents
+const (
+	NotifyPasswordFailed = "password-failed"
+	NotifyOTPUsed        = "otp-used"
+	NotifyOTPLocked      = "otp-locked"
+	NotifyTOTPLocked     = "totp-locked"
+	NotifyNewNetwork     = "new-network"
+)
+
+// notifySubjects are the subjects of the notices
+var notifySubjects = map[string]string{
+	NotifyPasswordFailed: "Failed attempts to change your password",
+	NotifyOTPUsed:        "Your account was unlocked with a code",
+	NotifyOTPLocked:      "Your one-time unlocking code has been cancelled",
+	NotifyTOTPLocked:     "Too many wrong authenticator codes for your account",
+	NotifyNewNetwork:     "Your password was changed from a new network",
+}
+
+// notifyMessages are used if there is no template for a notice
+var notifyMessages = map[string]string{
+	NotifyPasswordFailed: "Dear %NAME%\n\nSomeone has tried several times to change the password for %USERNAME% with the wrong current password. If this was not you, contact %HELPDESK%.\n",
+	NotifyOTPUsed:        "Dear %NAME%\n\nA one-time unlocking code or recovery code was used to set a new password for %USERNAME%. If this was not you, contact %HELPDESK%.\n",
+	NotifyOTPLocked:      "Dear %NAME%\n\nThe one-time unlocking code for %USERNAME% was typed wrongly too many times and has been cancelled. Contact %HELPDESK% for a new one.\n",
+	NotifyTOTPLocked:     "Dear %NAME%\n\nToo many authenticator codes have been tried for %USERNAME%, so none will be accepted for an hour. If this was not you, change your password and contact %HELPDESK%.\n",
+	NotifyNewNetwork:     "Dear %NAME%\n\nThe password for %USERNAME% was changed from a network it has not been changed from before. If this was not you, contact %HELPDESK%.\n",
+}
+
+// Defaults for the notification settings
+const (
+	defaultNotifyInterval = 3600
+	defaultNotifyFailures = 3
+	defaultOTPMaxFailures = 5
+	defaultTOTPMaxTries   = 10
+)
+
+// failureWindow is how long a failed attempt counts towards a notice or
+// lockout
+const failureWindow = time.Hour
+
+// knownNetworkTime is how long a network a user changed their password from
+// is remembered
+const knownNetworkTime = 365 * 24 * time.Hour
+
+// memoryNotify is shared by every PRM in the process that has no notify
+// directory
+var memoryNotify = &memoryReplayCache{used: make(map[string]time.Time)}
+
+// notifyStore returns where failure counts, networks and recent notices are
+// kept
+func (prm *PRM) notifyStore() ReplayCache {
+	if prm.Config.NotifyPath != "" {
+		return fileReplayCache{prm.Config.NotifyPath}
+	}
+	return memoryNotify
+}
+
+// notifyInterval is the shortest time between notices of the same kind
+func (prm *PRM) notifyInterval() time.Duration {
+	if prm.Config.NotifyInterval > 0 {
+		return time.Duration(prm.Config.NotifyInterval) * time.Second
+	}
+	return defaultNotifyInterval * time.Second
+}
+
+// notifyFailures is how many wrong passwords there must be before a notice
+func (prm *PRM) notifyFailures() int {
+	if prm.Config.NotifyFailures > 0 {
+		return prm.Config.NotifyFailures
+	}
+	return defaultNotifyFailures
+}
+
+// otpMaxFailures is how many wrong one-time codes cancel the code, or 0 if a
+// negative otpmaxfailures has turned cancelling off
+func (prm *PRM) otpMaxFailures() int {
+	switch {
+	case prm.Config.OTPMaxFailures > 0:
+		return prm.Config.OTPMaxFailures
+	case prm.Config.OTPMaxFailures < 0:
+		return 0
+	}
+	return defaultOTPMaxFailures
+}
+
+// totpMaxTries is how many authenticator or recovery codes may be typed for a
+// user in failureWindow
+func (prm *PRM) totpMaxTries() int {
+	if prm.Config.TOTPMaxTries > 0 {
+		return prm.Config.TOTPMaxTries
+	}
+	return defaultTOTPMaxTries
+}
+
+// NotifyEnabled checks if a kind of notice is turned on
+func (prm *PRM) NotifyEnabled(event string) bool {
+	for _, e := range prm.Config.NotifyEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckNotifyConfig makes sure every event in notifyevents is one we know
+func (prm *PRM) CheckNotifyConfig() error {
+	for _, event := range prm.Config.NotifyEvents {
+		if _, ok := notifySubjects[event]; !ok {
+			return fmt.Errorf("notifyevents %v is not one of %v, %v, %v, %v or %v", event,
+				NotifyPasswordFailed, NotifyOTPUsed, NotifyOTPLocked, NotifyTOTPLocked, NotifyNewNetwork)
+		}
+	}
+	return nil
+}
+
+// notifyID is the notify store id for something about a user. It is hashed
+// so it is safe as a file name and doesn't give away the username
+func notifyID(parts ...string) string {
+	sum := sha256.Sum256([]byte("notify\n" + strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// countFailure records a failure and returns how many there have been in
+// the last failureWindow, up to limit. Each failure takes the first free slot
+// of limit in the notify store, which is atomic even with a directory shared
+// between processes. If the count couldn't be kept it returns limit, so a
+// broken cache locks things out rather than letting guesses through
+func (prm *PRM) countFailure(kind string, username string, limit int) int {
+	expires := time.Now().Add(failureWindow)
+	for i := 0; i < limit; i++ {
+		err := prm.notifyStore().Use(notifyID(kind, username, strconv.Itoa(i)), expires)
+		if err == nil {
+			return i + 1
+		}
+		if err != ErrTokenReplayed {
+			prm.LogPRM("countFailure Error: "+err.Error(), LOG_ERROR)
+			return limit
+		}
+	}
+	return limit
+}
+
+// clientNetwork is the network a request came from, the /24 for IPv4 or the
+// /64 for IPv6, so moving between addresses on one network isn't news
+func clientNetwork(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return host
+	case ip.To4() != nil:
+		return ip.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	default:
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+}
+
+// fromNewNetwork records the network a password change came from and checks
+// if it is one the user hasn't changed their password from before. The first
+// change we see doesn't count, as every network is new then
+func (prm *PRM) fromNewNetwork(username string, r *http.Request) bool {
+	expires := time.Now().Add(knownNetworkTime)
+
+	seen := prm.notifyStore().Use(notifyID("network", username), expires) == ErrTokenReplayed
+	known := prm.notifyStore().Use(notifyID("network", username, clientNetwork(r)), expires) == ErrTokenReplayed
+
+	return seen && !known
+}
+
+// notify emails a user about an event on their account, if that kind of
+// notice is turned on and they haven't had one recently
+func (prm *PRM) notify(event string, username string, entry *ldap.Entry, r *http.Request) {
+	if !prm.NotifyEnabled(event) || entry == nil {
+		return
+	}
+
+	if err := prm.notifyStore().Use(notifyID(event, username), time.Now().Add(prm.notifyInterval())); err != nil {
+		prm.LogPRM("notify: "+event+" for "+username+" sent recently", LOG_DEBUG)
+		return
+	}
+
+	// Users without an address are treated as they are for the change
+	// notice, except that staff aren't alerted about every notice
+	addresses := entry.GetAttributeValues(prm.resetEmailAttribute())
+	if constructed := prm.constructedAddress(username); len(addresses) == 0 && constructed != "" {
+		addresses = []string{constructed}
+	}
+	if prm.Config.NotifySecondaryAttribute != "" {
+		addresses = append(addresses, entry.GetAttributeValues(prm.Config.NotifySecondaryAttribute)...)
+	}
+
+	data := NewEmailData(prm.Config, username, entry.GetAttributeValue("givenName"), r)
+
+	sent := make(map[string]bool)
+	for _, address := range addresses {
+		if address == "" || sent[strings.ToLower(address)] {
+			continue
+		}
+		sent[strings.ToLower(address)] = true
+
+		email, err := RenderEmail(prm.Config, "notify-"+event, address, notifySubjects[event], notifyMessages[event], data)
+		if err == nil {
+			err = prm.QueueEmail(email)
+		}
+		if err != nil {
+			prm.LogPRM("notify Error: "+err.Error(), LOG_ERROR)
+		}
+	}
+
+	if len(sent) > 0 {
+		prm.AuditPRM("notify-sent", username, r, "notify="+event, fmt.Sprintf("addresses=%d", len(sent)))
+	} else {
+		prm.AuditPRM("notify-skipped", username, r, "notify="+event, `reason="user has no email address"`)
+	}
+}
+
+// passwordFailed notes a wrong current password, telling the user once
+// there have been enough of them
+func (prm *PRM) passwordFailed(username string, entry *ldap.Entry, r *http.Request) {
+	if !prm.NotifyEnabled(NotifyPasswordFailed) {
+		return
+	}
+
+	if prm.countFailure(NotifyPasswordFailed, username, prm.notifyFailures()) >= prm.notifyFailures() {
+		prm.notify(NotifyPasswordFailed, username, entry, r)
+	}
+}
+
+// otpFailed notes a wrong one-time code and, once there have been
+// otpmaxfailures of them, cancels the code so it can't be guessed. It
+// returns true if the code was cancelled. The connection must be bound as
+// admin
+func (prm *PRM) otpFailed(username string, entry *ldap.Entry, conn Conn, r *http.Request) bool {
+	limit := prm.otpMaxFailures()
+	if limit == 0 || entry == nil || entry.GetAttributeValue(prm.otpAttribute()) == "" {
+		return false
+	}
+
+	// Failures are counted against the code itself, so a new code starts
+	// with a clean slate
+	kind := "otp-failed\n" + entry.GetAttributeValue(prm.otpAttribute())
+	if prm.countFailure(kind, username, limit) < limit {
+		return false
+	}
+
+	if err := prm.RevokeOTP(username, conn); err != nil {
+		prm.LogPRM("otpFailed Error: "+err.Error(), LOG_ERROR)
+		return false
+	}
+
+	prm.AuditPRM("otp-locked", username, r, fmt.Sprintf("failures=%d", limit))
+	prm.notify(NotifyOTPLocked, username, entry, r)
+	return true
+}
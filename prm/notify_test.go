@@ -0,0 +1,243 @@
+package prm
+
+import (
+	"gopkg.in/ldap.v2"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newNotifyPRM keeps its replay cache, notify store and mail spool in a
+// temporary directory, so counts don't carry over between tests
+func newNotifyPRM(t *testing.T, events ...string) (*PRM, func()) {
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prm := newOTPPRM()
+	prm.Config.ReplayPath = dir + "/replay"
+	prm.Config.NotifyPath = dir + "/notify"
+	prm.Config.MailSpoolPath = dir + "/mail"
+	prm.Config.NotifyEvents = events
+	return prm, func() { os.RemoveAll(dir) }
+}
+
+// notifyEntry is a user with a usual and a secondary address
+func notifyEntry(attributes ...*ldap.EntryAttribute) *ldap.Entry {
+	return &ldap.Entry{DN: "uid=abc123,ou=People,dc=example", Attributes: append([]*ldap.EntryAttribute{
+		{Name: "givenName", Values: []string{"Alice"}},
+		{Name: "mail", Values: []string{"alice@example.com"}},
+		{Name: "prmAlternateMail", Values: []string{"alice@example.org"}},
+	}, attributes...)}
+}
+
+// queued counts the emails waiting in the spool
+func queued(t *testing.T, prm *PRM) int {
+	emails, err := prm.MailQueue()
+	if err != nil {
+		t.Fatal("MailQueue failed:", err)
+	}
+	return len(emails)
+}
+
+// Test notices go to both addresses, only for events that are turned on and
+// no more than once an interval
+func TestNotify(t *testing.T) {
+	prm, cleanup := newNotifyPRM(t, NotifyOTPUsed)
+	defer cleanup()
+	r := httptest.NewRequest("POST", "/change", nil)
+
+	prm.notify(NotifyNewNetwork, "abc123", notifyEntry(), r)
+	if n := queued(t, prm); n != 0 {
+		t.Error("For: turned off got:", n)
+	}
+
+	prm.notify(NotifyOTPUsed, "abc123", notifyEntry(), r)
+	if n := queued(t, prm); n != 1 {
+		t.Error("For: mail only got:", n)
+	}
+
+	// The second address is only used when configured, and the same
+	// notice isn't sent again straight away
+	prm.Config.NotifySecondaryAttribute = "prmAlternateMail"
+	prm.notify(NotifyOTPUsed, "abc123", notifyEntry(), r)
+	if n := queued(t, prm); n != 1 {
+		t.Error("For: throttled got:", n)
+	}
+
+	prm.notify(NotifyOTPUsed, "def456", notifyEntry(), r)
+	if n := queued(t, prm); n != 3 {
+		t.Error("For: both addresses got:", n)
+	}
+}
+
+// Test notices go where reset links do, and that users without an address
+// are treated as missingemailpolicy says
+func TestNotifyAddresses(t *testing.T) {
+	prm, cleanup := newNotifyPRM(t, NotifyOTPUsed)
+	defer cleanup()
+	r := httptest.NewRequest("POST", "/change", nil)
+
+	prm.Config.ResetEmailAttribute = "prmAlternateMail"
+	prm.notify(NotifyOTPUsed, "abc123", notifyEntry(), r)
+
+	prm.Config.MissingEmailPolicy = MissingEmailSkip
+	nobody := &ldap.Entry{DN: "uid=def456,ou=People,dc=example"}
+	prm.notify(NotifyOTPUsed, "def456", nobody, r)
+
+	prm.Config.MissingEmailPolicy = MissingEmailConstruct
+	prm.Config.MissingEmailDomain = "example.ac.uk"
+	prm.notify(NotifyOTPUsed, "ghi789", nobody, r)
+
+	emails, err := prm.MailQueue()
+	if err != nil {
+		t.Fatal("MailQueue failed:", err)
+	}
+	var to []string
+	for _, email := range emails {
+		to = append(to, email.To)
+	}
+	sort.Strings(to)
+	if strings.Join(to, " ") != "alice@example.org ghi789@example.ac.uk" {
+		t.Error("For: addresses got:", to)
+	}
+}
+
+// Test a notice is only sent once there have been enough wrong passwords
+func TestPasswordFailedNotice(t *testing.T) {
+	prm, cleanup := newNotifyPRM(t, NotifyPasswordFailed)
+	defer cleanup()
+	r := httptest.NewRequest("POST", "/change", nil)
+
+	for i := 1; i <= 3; i++ {
+		prm.passwordFailed("abc123", notifyEntry(), r)
+		want := 0
+		if i == 3 {
+			want = 1
+		}
+		if n := queued(t, prm); n != want {
+			t.Error("For: failure", i, "got:", n)
+		}
+	}
+}
+
+// Test a one-time code is cancelled after too many wrong guesses, and a new
+// code starts again from nothing
+func TestOTPLockout(t *testing.T) {
+	prm, cleanup := newNotifyPRM(t, NotifyOTPLocked)
+	defer cleanup()
+	prm.Config.OTPMaxFailures = 2
+	r := httptest.NewRequest("POST", "/change", nil)
+
+	for round := 0; round < 2; round++ {
+		conn := &otpConn{entry: notifyEntry()}
+		if _, _, err := prm.IssueOTP("abc123", time.Hour, conn); err != nil {
+			t.Fatal("IssueOTP failed:", err)
+		}
+		stored := conn.modified.ReplaceAttributes[0].Vals[0]
+		conn.entry = notifyEntry(&ldap.EntryAttribute{Name: defaultOTPAttribute, Values: []string{stored}})
+		conn.modified = nil
+
+		if ok, code := prm.checkUnlockCode("abc123", conn.entry, "000000000", "", conn, r); ok || code != ErrorOTP {
+			t.Error("For: first wrong code got:", ok, code)
+		}
+		if conn.modified != nil {
+			t.Error("For: first wrong code got a modify")
+		}
+
+		if ok, code := prm.checkUnlockCode("abc123", conn.entry, "000000000", "", conn, r); ok || code != ErrorOTPLocked {
+			t.Error("For: second wrong code got:", ok, code)
+		}
+		if conn.modified == nil || len(conn.modified.DeleteAttributes) != 1 || conn.modified.DeleteAttributes[0].Type != defaultOTPAttribute {
+			t.Error("For: lockout got:", conn.modified)
+		}
+	}
+
+	// The second lockout is within the notify interval
+	if n := queued(t, prm); n != 1 {
+		t.Error("For: notices got:", n)
+	}
+}
+
+// Test only a change from a network not seen before is news
+func TestFromNewNetwork(t *testing.T) {
+	prm, cleanup := newNotifyPRM(t, NotifyNewNetwork)
+	defer cleanup()
+
+	test_map := []struct {
+		addr string
+		want bool
+	}{
+		{"192.0.2.1:1234", false},
+		{"192.0.2.200:1234", false},
+		{"198.51.100.7:1234", true},
+		{"198.51.100.8:1234", false},
+		{"[2001:db8::1]:1234", true},
+		{"[2001:db8::2]:1234", false},
+	}
+
+	for _, test := range test_map {
+		r := httptest.NewRequest("POST", "/terms", nil)
+		r.RemoteAddr = test.addr
+		if got := prm.fromNewNetwork("abc123", r); got != test.want {
+			t.Error("For:", test.addr, "got:", got)
+		}
+	}
+}
+
+// Test unknown events are refused at startup
+func TestNotifyConfig(t *testing.T) {
+	prm := newOTPPRM()
+
+	prm.Config.NotifyEvents = []string{NotifyPasswordFailed, NotifyOTPUsed, NotifyOTPLocked, NotifyNewNetwork}
+	if err := prm.CheckNotifyConfig(); err != nil {
+		t.Error("For: all events got:", err)
+	}
+
+	prm.Config.NotifyEvents = []string{"password-changed"}
+	if err := prm.CheckNotifyConfig(); err == nil {
+		t.Error("For: unknown event got: nil")
+	}
+
+	for configured, want := range map[int]int{0: defaultOTPMaxFailures, 2: 2, -1: 0} {
+		prm.Config.OTPMaxFailures = configured
+		if got := prm.otpMaxFailures(); got != want {
+			t.Error("For: otpmaxfailures", configured, "got:", got)
+		}
+	}
+}
+
+// Test failures count up to the limit, and that a cache which can't be
+// written counts as being over it
+func TestCountFailure(t *testing.T) {
+	prm, cleanup := newNotifyPRM(t)
+	defer cleanup()
+
+	for want := 1; want <= 3; want++ {
+		if got := prm.countFailure("test", "abc123", 3); got != want {
+			t.Error("For: failure", want, "got:", got)
+		}
+	}
+	if got := prm.countFailure("test", "abc123", 3); got != 3 {
+		t.Error("For: failure over the limit got:", got)
+	}
+
+	// A file where the directory should be can't be written to
+	broken := prm.Config.MailSpoolPath + "-file"
+	if err := ioutil.WriteFile(broken, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	prm.Config.NotifyPath = broken + "/notify"
+
+	if got := prm.countFailure("test", "def456", 3); got != 3 {
+		t.Error("For: broken store got:", got)
+	}
+	if ok, code := prm.checkUnlockCode("def456", notifyEntry(), "000000000", "", &otpConn{}, nil); ok || code != ErrorUnlockLimited {
+		t.Error("For: unlock code with a broken store got:", ok, code)
+	}
+}
@@ -0,0 +1,440 @@
+package prm
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// One-time unlocking codes let the helpdesk get a user back in when they
+// have forgotten their password. A code is OTPLength characters from
+// OTPAlphabet, 9 digits by default, kept in OTPAttribute on the users entry
+// and deleted by CheckOTP once used. With the default OTPEncoding of hashed
+// codes are stored as
+//
+//	{OTP1}keyid$expiry$salt$mac
+//
+// where mac is an HMAC-SHA256, keyed from the uffer keyring, of the username,
+// salt and code, so anyone able to read the directory can't recover the code.
+// The plain encoding, which older versions always used, stores the zero padded
+// code followed by the expiry time. Plain codes are still accepted unless
+// DisableLegacyOTP is set, and prm-admin otp migrate rehashes them.
+
+// Ways of storing one-time codes, set by OTPEncoding
+const (
+	OTPEncodingHashed = "hashed"
+	OTPEncodingPlain  = "plain"
+)
+
+// The defaults match what older versions hardcoded
+const (
+	defaultOTPAttribute = "internationaliSDNNumber"
+	defaultOTPLength    = 9
+	defaultOTPAlphabet  = "0123456789"
+)
+
+// ErrNoOTP is returned when a user has no one-time code
+var ErrNoOTP = errors.New("user has no one-time code")
+
+// ErrNoUser is returned when a user can't be found
+var ErrNoUser = errors.New("user not found")
+
+// ErrOTPFormat is returned when a stored one-time code can't be understood
+var ErrOTPFormat = errors.New("one-time code is not in a known format")
+
+// otpHashPrefix marks a hashed one-time code and its format version
+const otpHashPrefix = "{OTP1}"
+
+// OTPInfo describes a users stored one-time code. Code is only known for
+// codes stored in the plain encoding
+type OTPInfo struct {
+	Code    string
+	Expires time.Time
+	Hashed  bool
+}
+
+// otpAttribute is the attribute holding a users one-time code
+func (prm *PRM) otpAttribute() string {
+	if prm.Config.OTPAttribute != "" {
+		return prm.Config.OTPAttribute
+	}
+	return defaultOTPAttribute
+}
+
+// otpLength is the number of characters in a one-time code
+func (prm *PRM) otpLength() int {
+	if prm.Config.OTPLength > 0 {
+		return prm.Config.OTPLength
+	}
+	return defaultOTPLength
+}
+
+// otpAlphabet is the characters a one-time code is made from
+func (prm *PRM) otpAlphabet() string {
+	if prm.Config.OTPAlphabet != "" {
+		return prm.Config.OTPAlphabet
+	}
+	return defaultOTPAlphabet
+}
+
+// CheckOTPConfig makes sure the one-time code settings can be used. Codes
+// must be long enough to resist guessing and the alphabet must be printable
+// ASCII without repeats, so the codes are easy to type and plain values can
+// be split by length
+func (prm *PRM) CheckOTPConfig() error {
+	if prm.otpLength() < 6 || prm.otpLength() > 32 {
+		return fmt.Errorf("otplength %d must be between 6 and 32", prm.otpLength())
+	}
+
+	alphabet := prm.otpAlphabet()
+	if len(alphabet) < 2 {
+		return errors.New("otpalphabet must have at least 2 characters")
+	}
+	for i, c := range alphabet {
+		if c <= ' ' || c > '~' || c == '$' || c == '-' {
+			return fmt.Errorf("otpalphabet character %q is not allowed", c)
+		}
+		if strings.IndexRune(alphabet[:i], c) >= 0 {
+			return fmt.Errorf("otpalphabet character %q is repeated", c)
+		}
+	}
+
+	switch prm.Config.OTPEncoding {
+	case "", OTPEncodingHashed:
+	case OTPEncodingPlain:
+		if prm.Config.DisableLegacyOTP {
+			return errors.New("otpencoding plain can't be used with disablelegacyotp")
+		}
+	default:
+		return errors.New("otpencoding " + prm.Config.OTPEncoding + " must be hashed or plain")
+	}
+
+	return nil
+}
+
+// NewOTP creates a random one-time code. The first character is never 0,
+// as plain codes are zero padded and the padding is stripped off again
+func (prm *PRM) NewOTP() (string, error) {
+	alphabet := prm.otpAlphabet()
+	first := strings.Replace(alphabet, "0", "", -1)
+
+	code := make([]byte, prm.otpLength())
+	for i := range code {
+		chars := alphabet
+		if i == 0 && first != "" {
+			chars = first
+		}
+
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = chars[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// normaliseOtp tidies up a code typed by the user, dropping spaces and
+// dashes and matching the case of the alphabet
+func (prm *PRM) normaliseOtp(code string) string {
+	code = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, code)
+
+	alphabet := prm.otpAlphabet()
+	if strings.ToUpper(alphabet) == alphabet {
+		return strings.ToUpper(code)
+	}
+	if strings.ToLower(alphabet) == alphabet {
+		return strings.ToLower(code)
+	}
+	return code
+}
+
+// formatOtp packs a code and its expiry time into a plain attribute value
+func (prm *PRM) formatOtp(code string, expires time.Time) string {
+	return fmt.Sprintf("%0*s%d", prm.otpLength(), code, expires.Unix())
+}
+
+// parseOtp splits a plain attribute value into its expiry time and code
+func (prm *PRM) parseOtp(value string) (epoch int64, otp string, err error) {
+	length := prm.otpLength()
+	if len(value) <= length {
+		return 0, "", ErrOTPFormat
+	}
+
+	epoch, err = strconv.ParseInt(value[length:], 10, 64)
+	if err != nil {
+		return 0, "", ErrOTPFormat
+	}
+	return epoch, strings.TrimLeft(value[:length], "0"), nil
+}
+
+// encodeOtp creates the attribute value for a code in the configured encoding
+func (prm *PRM) encodeOtp(username string, code string, expires time.Time) (string, error) {
+	if prm.Config.OTPEncoding == OTPEncodingPlain {
+		return prm.formatOtp(code, expires), nil
+	}
+	return prm.hashOtp(username, code, expires)
+}
+
+// otpMAC computes the MAC of a code for a user. The key is hashed with a
+// label first so the MAC can never be mistaken for anything else
+func otpMAC(key string, username string, salt string, code string) string {
+	derived := sha256.Sum256([]byte("prm-otp\n" + key))
+	mac := hmac.New(sha256.New, derived[:])
+	mac.Write([]byte(username + "\n" + salt + "\n" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashOtp creates the hashed attribute value for a code, using the primary
+// uffer key
+func (prm *PRM) hashOtp(username string, code string, expires time.Time) (string, error) {
+	primary, keys := prm.ufferKeyring()
+
+	key, ok := keys[primary]
+	if !ok || key == "" {
+		return "", errors.New("uffer primary key " + primary + " is not in the keyring")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	encoded := hex.EncodeToString(salt)
+
+	return fmt.Sprintf("%v%v$%d$%v$%v", otpHashPrefix, primary, expires.Unix(), encoded, otpMAC(key, username, encoded, code)), nil
+}
+
+// isPlainOtp checks if an attribute value is a code stored in the clear
+func isPlainOtp(value string) bool {
+	return value != "" && !strings.HasPrefix(value, otpHashPrefix)
+}
+
+// verifyOtp checks a code typed by the user against the stored value,
+// returning the expiry time and whether it matched
+func (prm *PRM) verifyOtp(username string, value string, userotp string) (int64, bool, error) {
+	if isPlainOtp(value) {
+		if prm.Config.DisableLegacyOTP {
+			return 0, false, errors.New("plain one-time codes are disabled")
+		}
+
+		epoch, storedOtp, err := prm.parseOtp(value)
+		if err != nil {
+			return 0, false, err
+		}
+		return epoch, userotp != "" && subtle.ConstantTimeCompare([]byte(storedOtp), []byte(userotp)) == 1, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, otpHashPrefix), "$")
+	if len(parts) != 4 {
+		return 0, false, ErrOTPFormat
+	}
+
+	epoch, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, false, ErrOTPFormat
+	}
+
+	_, keys := prm.ufferKeyring()
+	key, ok := keys[parts[0]]
+	if !ok {
+		return 0, false, errors.New("one-time code key " + parts[0] + " is not in the keyring")
+	}
+
+	mac := otpMAC(key, username, parts[2], userotp)
+	return epoch, hmac.Equal([]byte(mac), []byte(parts[3])), nil
+}
+
+// otpExpires reads just the expiry time from a stored value
+func (prm *PRM) otpExpires(value string) (int64, error) {
+	if isPlainOtp(value) {
+		epoch, _, err := prm.parseOtp(value)
+		return epoch, err
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, otpHashPrefix), "$")
+	if !strings.HasPrefix(value, otpHashPrefix) || len(parts) != 4 {
+		return 0, ErrOTPFormat
+	}
+	return strconv.ParseInt(parts[1], 10, 64)
+}
+
+// userDN returns the DN of a users entry
+func (prm *PRM) userDN(username string) string {
+	return fmt.Sprintf(prm.Config.PasswordModifyLDAP+",%v", username, prm.Config.BaseDN)
+}
+
+// IssueOTP gives a user a new one-time code lasting for ttl, replacing any
+// they already had. The connection must be bound as admin
+func (prm *PRM) IssueOTP(username string, ttl time.Duration, conn Conn) (string, time.Time, error) {
+	if prm.SearchUsername(username, conn) == nil {
+		return "", time.Time{}, ErrNoUser
+	}
+
+	code, err := prm.NewOTP()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expires := time.Now().Add(ttl)
+	value, err := prm.encodeOtp(username, code, expires)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	modify := ldap.NewModifyRequest(prm.userDN(username))
+	modify.Replace(prm.otpAttribute(), []string{value})
+
+	if err := conn.Modify(modify); err != nil {
+		return "", time.Time{}, err
+	}
+	return code, expires, nil
+}
+
+// ShowOTP describes a users current one-time code. Hashed codes can't be
+// shown, only when they expire
+func (prm *PRM) ShowOTP(username string, conn Conn) (OTPInfo, error) {
+	entry := prm.SearchUsername(username, conn)
+	if entry == nil {
+		return OTPInfo{}, ErrNoUser
+	}
+
+	value := entry.GetAttributeValue(prm.otpAttribute())
+	if value == "" {
+		return OTPInfo{}, ErrNoOTP
+	}
+
+	epoch, err := prm.otpExpires(value)
+	if err != nil {
+		return OTPInfo{}, err
+	}
+
+	info := OTPInfo{Expires: time.Unix(epoch, 0), Hashed: !isPlainOtp(value)}
+	if !info.Hashed {
+		_, info.Code, _ = prm.parseOtp(value)
+	}
+	return info, nil
+}
+
+// RevokeOTP removes a users one-time code
+func (prm *PRM) RevokeOTP(username string, conn Conn) error {
+	entry := prm.SearchUsername(username, conn)
+	if entry == nil {
+		return ErrNoUser
+	}
+
+	if entry.GetAttributeValue(prm.otpAttribute()) == "" {
+		return ErrNoOTP
+	}
+
+	modify := ldap.NewModifyRequest(prm.userDN(username))
+	modify.Delete(prm.otpAttribute(), []string{})
+	return conn.Modify(modify)
+}
+
+// EmailOTP sends a one-time code to the users alternate email address, as
+// their usual address may well need the password they have forgotten
+func (prm *PRM) EmailOTP(username string, code string, expires time.Time, conn Conn) (string, error) {
+	if prm.Config.AlternateEmailAttribute == "" {
+		return "", errors.New("alternateemailattribute is not set")
+	}
+
+	entry := prm.SearchUsername(username, conn)
+	if entry == nil {
+		return "", ErrNoUser
+	}
+
+	address := entry.GetAttributeValue(prm.Config.AlternateEmailAttribute)
+	if address == "" {
+		return "", errors.New(username + " has no " + prm.Config.AlternateEmailAttribute)
+	}
+
+	legacy := prm.Config.OTPEmailMsg
+	if legacy == "" {
+		legacy = "Dear %NAME%\n\nYour one-time account unlocking code is %CODE%. It can be used once, until %EXPIRES%, to set a new password.\n"
+	}
+
+	subject := prm.Config.OTPEmailSub
+	if subject == "" {
+		subject = "Your one-time account unlocking code"
+	}
+
+	data := NewEmailData(prm.Config, username, entry.GetAttributeValue("givenName"), nil)
+	data.Code = code
+	data.Expires = emailTime(prm.Config, data.Lang, expires)
+
+	email, err := RenderEmail(prm.Config, "otp", address, subject, legacy, data)
+	if err != nil {
+		return address, err
+	}
+	return address, sendMessage(prm.Config, email)
+}
+
+// LegacyOTPUsers finds every user with a one-time code still stored in the
+// clear
+func (prm *PRM) LegacyOTPUsers(conn Conn) ([]string, error) {
+	searchRequest := ldap.NewSearchRequest(
+		fmt.Sprintf(prm.Config.ORGFieldLDAP+",%v", prm.Config.BaseDN),
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"("+prm.otpAttribute()+"=*)",
+		[]string{prm.Config.UserFieldLDAP, prm.otpAttribute()},
+		nil,
+	)
+
+	sr, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []string
+	for _, entry := range sr.Entries {
+		if isPlainOtp(entry.GetAttributeValue(prm.otpAttribute())) {
+			users = append(users, entry.GetAttributeValue(prm.Config.UserFieldLDAP))
+		}
+	}
+	return users, nil
+}
+
+// MigrateOTP rehashes a users legacy one-time code, keeping its expiry time.
+// It returns false if there was nothing to migrate
+func (prm *PRM) MigrateOTP(username string, conn Conn) (bool, error) {
+	entry := prm.SearchUsername(username, conn)
+	if entry == nil {
+		return false, ErrNoUser
+	}
+
+	value := entry.GetAttributeValue(prm.otpAttribute())
+	if !isPlainOtp(value) {
+		return false, nil
+	}
+
+	epoch, code, err := prm.parseOtp(value)
+	if err != nil {
+		return false, err
+	}
+
+	hashed, err := prm.hashOtp(username, code, time.Unix(epoch, 0))
+	if err != nil {
+		return false, err
+	}
+
+	modify := ldap.NewModifyRequest(prm.userDN(username))
+	modify.Replace(prm.otpAttribute(), []string{hashed})
+	if err := conn.Modify(modify); err != nil {
+		return false, err
+	}
+	return true, nil
+}
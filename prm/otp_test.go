@@ -0,0 +1,287 @@
+package prm
+
+import (
+	"gopkg.in/ldap.v2"
+	"strings"
+	"testing"
+	"time"
+)
+
+// otpConn returns a single entry from searches and records modifies
+type otpConn struct {
+	TestConn
+	entry    *ldap.Entry
+	modified *ldap.ModifyRequest
+}
+
+func (l *otpConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	result := &ldap.SearchResult{}
+	if l.entry != nil {
+		result.Entries = []*ldap.Entry{l.entry}
+	}
+	return result, nil
+}
+
+func (l *otpConn) Modify(modifyRequest *ldap.ModifyRequest) error {
+	l.modified = modifyRequest
+	return nil
+}
+
+func newOTPPRM() *PRM {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.PasswordModifyLDAP = "uid=%v,ou=People"
+	prm.Config.BaseDN = "dc=example"
+	prm.Config.UserFieldLDAP = "uid"
+	prm.Config.Uffer = "0123456789abcdef0123456789abcdef"
+	return prm
+}
+
+// Test codes are the right length, from the alphabet and never start with a 0
+func TestNewOTP(t *testing.T) {
+	prm := newOTPPRM()
+
+	test_map := map[string]int{
+		"":                                 9,
+		"ABCDEFGHJKLMNPQRSTUVWXYZ23456789": 8,
+		"01":                               12,
+	}
+
+	for alphabet, length := range test_map {
+		prm.Config.OTPAlphabet = alphabet
+		prm.Config.OTPLength = length
+
+		for i := 0; i < 1000; i++ {
+			code, err := prm.NewOTP()
+			if err != nil || len(code) != length || code[0] == '0' || strings.Trim(code, prm.otpAlphabet()) != "" {
+				t.Fatal("For:", alphabet, "got:", code, err)
+			}
+		}
+	}
+}
+
+// Test a code packed by formatOtp comes back out of parseOtp
+func TestFormatOtp(t *testing.T) {
+	prm := newOTPPRM()
+	expires := time.Unix(1700000000, 0)
+
+	value := prm.formatOtp("123456789", expires)
+	if value != "1234567891700000000" {
+		t.Error("For: 123456789 got:", value)
+	}
+
+	epoch, code, err := prm.parseOtp(value)
+	if err != nil || code != "123456789" || epoch != expires.Unix() {
+		t.Error("For:", value, "got:", code, epoch, err)
+	}
+}
+
+// Test parseOtp refuses values that are too short or have no expiry time
+// rather than panicking
+func TestParseOtpErrors(t *testing.T) {
+	prm := newOTPPRM()
+
+	for _, value := range []string{"", "12345", "123456789", "123456789abc", "1234567891700000000x"} {
+		if _, _, err := prm.parseOtp(value); err != ErrOTPFormat {
+			t.Error("For:", value, "got:", err)
+		}
+	}
+
+	// Codes that are too short are refused by CheckOTP too
+	conn := &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example",
+		Attributes: []*ldap.EntryAttribute{{Name: defaultOTPAttribute, Values: []string{"12345"}}}}}
+	if result, code := prm.CheckOTP("abc123", "12345", conn); result || code != ErrorOTP {
+		t.Error("For: 12345 got:", result, code)
+	}
+}
+
+// Test the configured attribute, encoding and alphabet are used
+func TestOTPConfigured(t *testing.T) {
+	prm := newOTPPRM()
+	prm.Config.OTPAttribute = "prmOneTimeCode"
+	prm.Config.OTPEncoding = OTPEncodingPlain
+	prm.Config.OTPAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	prm.Config.OTPLength = 10
+
+	conn := &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example"}}
+	code, expires, err := prm.IssueOTP("abc123", time.Hour, conn)
+	if err != nil {
+		t.Fatal("IssueOTP failed:", err)
+	}
+
+	attribute := conn.modified.ReplaceAttributes[0]
+	if attribute.Type != "prmOneTimeCode" || attribute.Vals[0] != prm.formatOtp(code, expires) {
+		t.Fatal("For: plain prmOneTimeCode got:", attribute)
+	}
+
+	// Users can type the code in lower case and split up
+	conn.entry.Attributes = []*ldap.EntryAttribute{{Name: "prmOneTimeCode", Values: attribute.Vals}}
+	typed := strings.ToLower(code[:5]) + "-" + code[5:]
+	if result, errorcode := prm.CheckOTP("abc123", typed, conn); !result {
+		t.Error("For:", typed, "got:", errorcode)
+	}
+}
+
+// Test bad settings are refused
+func TestCheckOTPConfig(t *testing.T) {
+	test_map := map[string]PRMConfig{
+		"default":   {},
+		"short":     {OTPLength: 4},
+		"repeated":  {OTPAlphabet: "0123456780"},
+		"space":     {OTPAlphabet: "01 23"},
+		"single":    {OTPAlphabet: "1"},
+		"encoding":  {OTPEncoding: "rot13"},
+		"plainonly": {OTPEncoding: OTPEncodingPlain, DisableLegacyOTP: true},
+	}
+
+	for name, config := range test_map {
+		var prm = new(PRM)
+		config := config
+		prm.Config = &config
+
+		err := prm.CheckOTPConfig()
+		if (err == nil) != (name == "default") {
+			t.Error("For:", name, "got:", err)
+		}
+	}
+}
+
+// Test issuing writes the attribute and show reads it back
+func TestIssueShowOTP(t *testing.T) {
+	prm := newOTPPRM()
+	conn := &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example"}}
+
+	code, expires, err := prm.IssueOTP("abc123", time.Hour, conn)
+	if err != nil {
+		t.Fatal("IssueOTP failed:", err)
+	}
+
+	if conn.modified == nil || conn.modified.DN != "uid=abc123,ou=People,dc=example" {
+		t.Fatal("Expected a modify of the users entry, got:", conn.modified)
+	}
+
+	value := conn.modified.ReplaceAttributes[0].Vals[0]
+	if !strings.HasPrefix(value, otpHashPrefix) || strings.Contains(value, code) {
+		t.Fatal("For: IssueOTP stored:", value)
+	}
+
+	conn.entry.Attributes = []*ldap.EntryAttribute{{Name: defaultOTPAttribute, Values: []string{value}}}
+
+	info, err := prm.ShowOTP("abc123", conn)
+	if err != nil || !info.Hashed || info.Code != "" || info.Expires.Unix() != expires.Unix() {
+		t.Error("For: ShowOTP got:", info, err)
+	}
+}
+
+// Test CheckOTP accepts hashed and legacy codes and deletes them once used
+func TestCheckOTPFormats(t *testing.T) {
+	prm := newOTPPRM()
+	expires := time.Now().Add(time.Hour)
+
+	hashed, err := prm.hashOtp("abc123", "123456789", expires)
+	if err != nil {
+		t.Fatal("hashOtp failed:", err)
+	}
+	legacy := prm.formatOtp("123456789", expires)
+
+	test_map := map[string]bool{
+		"123456789": true,
+		"123456788": false,
+		"":          false,
+	}
+
+	for _, value := range []string{hashed, legacy} {
+		for userotp, expected := range test_map {
+			conn := &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example",
+				Attributes: []*ldap.EntryAttribute{{Name: defaultOTPAttribute, Values: []string{value}}}}}
+
+			result, _ := prm.CheckOTP("abc123", userotp, conn)
+			if result != expected || (conn.modified != nil) != expected {
+				t.Error("For:", value, userotp, "got:", result)
+			}
+		}
+	}
+
+	// The MAC covers the username so a value can't be copied to another user
+	conn := &otpConn{entry: &ldap.Entry{DN: "uid=def456,ou=People,dc=example",
+		Attributes: []*ldap.EntryAttribute{{Name: defaultOTPAttribute, Values: []string{hashed}}}}}
+	if result, _ := prm.CheckOTP("def456", "123456789", conn); result {
+		t.Error("For: copied value got:", result)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	expired, _ := prm.hashOtp("abc123", "123456789", old)
+	conn = &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example",
+		Attributes: []*ldap.EntryAttribute{{Name: defaultOTPAttribute, Values: []string{expired}}}}}
+	if _, code := prm.CheckOTP("abc123", "123456789", conn); code != ErrorOTPExpired {
+		t.Error("For: expired got:", code)
+	}
+
+	prm.Config.DisableLegacyOTP = true
+	conn = &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example",
+		Attributes: []*ldap.EntryAttribute{{Name: defaultOTPAttribute, Values: []string{legacy}}}}}
+	if result, _ := prm.CheckOTP("abc123", "123456789", conn); result {
+		t.Error("For: legacy with DisableLegacyOTP got:", result)
+	}
+}
+
+// Test migrating rehashes a legacy code so the same code still works
+func TestMigrateOTP(t *testing.T) {
+	prm := newOTPPRM()
+	expires := time.Now().Add(time.Hour)
+	legacy := prm.formatOtp("123456789", expires)
+
+	conn := &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example",
+		Attributes: []*ldap.EntryAttribute{
+			{Name: "uid", Values: []string{"abc123"}},
+			{Name: defaultOTPAttribute, Values: []string{legacy}},
+		}}}
+
+	users, err := prm.LegacyOTPUsers(conn)
+	if err != nil || len(users) != 1 || users[0] != "abc123" {
+		t.Fatal("For: LegacyOTPUsers got:", users, err)
+	}
+
+	migrated, err := prm.MigrateOTP("abc123", conn)
+	if err != nil || !migrated {
+		t.Fatal("For: MigrateOTP got:", migrated, err)
+	}
+
+	value := conn.modified.ReplaceAttributes[0].Vals[0]
+	if !strings.HasPrefix(value, otpHashPrefix) {
+		t.Fatal("For: MigrateOTP stored:", value)
+	}
+
+	conn.entry.Attributes[1].Values = []string{value}
+	if migrated, _ := prm.MigrateOTP("abc123", conn); migrated {
+		t.Error("For: MigrateOTP twice got:", migrated)
+	}
+
+	epoch, matched, err := prm.verifyOtp("abc123", value, "123456789")
+	if err != nil || !matched || epoch != expires.Unix() {
+		t.Error("For: migrated value got:", epoch, matched, err)
+	}
+}
+
+// Test the errors for missing users and codes
+func TestOTPErrors(t *testing.T) {
+	prm := newOTPPRM()
+
+	if _, _, err := prm.IssueOTP("nobody", time.Hour, &otpConn{}); err != ErrNoUser {
+		t.Error("For: IssueOTP nobody got:", err)
+	}
+
+	conn := &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example"}}
+
+	if _, err := prm.ShowOTP("abc123", conn); err != ErrNoOTP {
+		t.Error("For: ShowOTP without a code got:", err)
+	}
+
+	if err := prm.RevokeOTP("abc123", conn); err != ErrNoOTP || conn.modified != nil {
+		t.Error("For: RevokeOTP without a code got:", err)
+	}
+
+	if _, err := prm.EmailOTP("abc123", "123456789", time.Now(), conn); err == nil {
+		t.Error("For: EmailOTP without an attribute got: nil")
+	}
+}
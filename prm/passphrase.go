@@ -0,0 +1,104 @@
+package prm
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Passphrases are long passwords made of several words. Character class and
+// dictionary rules are designed for short complex passwords and get in the
+// way of these, so passwords at least PassphraseLength long are instead
+// checked for a minimum number of words and a minimum entropy.
+
+// IsPassphrase returns true if the password is long enough to be treated as
+// a passphrase. Passphrase mode is off if no length is configured
+func (prm *PRM) IsPassphrase(password string) bool {
+	return prm.Config.PassphraseLength > 0 && len(password) >= prm.Config.PassphraseLength
+}
+
+// countWords counts the words in a passphrase. Words are runs of two or more
+// letters, separated by anything that is not a letter
+func countWords(password string) int {
+	count := 0
+	for _, word := range strings.FieldsFunc(password, func(c rune) bool { return !unicode.IsLetter(c) }) {
+		if len(word) >= 2 {
+			count++
+		}
+	}
+	return count
+}
+
+// entropyBits converts a number of guesses into bits of entropy
+func entropyBits(guesses float64) float64 {
+	return math.Log2(guesses)
+}
+
+// checkPassphrase checks a passphrase against the word count and entropy
+// thresholds, returning "GOOD" or a cracklib style message
+func (prm *PRM) checkPassphrase(password string, terms []personalTerm) string {
+	if countWords(password) < prm.Config.PassphraseMinWords {
+		return "it does not contain enough words"
+	}
+
+	if entropyBits(EstimateStrength(password, termWords(terms)...).Guesses) < prm.Config.PassphraseMinEntropy {
+		return "it is too easy to guess"
+	}
+
+	return "GOOD"
+}
+
+// loadWordList reads the word list used to generate passphrases, one word per line
+func loadWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+
+	return words, scanner.Err()
+}
+
+// GeneratePassphrase picks PassphraseWords words at random from the word list
+// and joins them with hyphens, diceware style
+func (prm *PRM) GeneratePassphrase() (string, error) {
+	words, err := loadWordList(prm.Config.WordListPath)
+	if err != nil {
+		return "", err
+	}
+
+	if len(words) < 2 {
+		return "", errors.New("word list " + prm.Config.WordListPath + " is too short")
+	}
+
+	count := prm.Config.PassphraseWords
+	if count < 1 {
+		count = 6
+	}
+
+	chosen := make([]string, count)
+	max := big.NewInt(int64(len(words)))
+	for i := range chosen {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		chosen[i] = words[n.Int64()]
+	}
+
+	return strings.Join(chosen, "-"), nil
+}
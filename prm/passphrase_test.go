@@ -0,0 +1,85 @@
+package prm
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Test word counting in passphrases
+func TestCountWords(t *testing.T) {
+	var test_map = map[string]int{
+		"correct horse battery staple": 4,
+		"velvet-quarry-lantern":        3,
+		"a1b2c3d4":                     0,
+		"Tr0ub4dor&3":                  3,
+	}
+
+	for passphrase, expected := range test_map {
+		if count := countWords(passphrase); count != expected {
+			t.Error("For:", passphrase, "got:", count, "expected:", expected)
+		}
+	}
+}
+
+// Test passphrases are checked for words and entropy rather than by cracklib
+func TestCheckPassphrase(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.PassphraseLength = 20
+	prm.Config.PassphraseMinWords = 4
+	prm.Config.PassphraseMinEntropy = 50
+
+	if prm.IsPassphrase("short password") {
+		t.Error("short password should not be a passphrase")
+	}
+
+	if !prm.IsPassphrase("velvet quarry lantern oboe tundra") {
+		t.Error("velvet quarry lantern oboe tundra should be a passphrase")
+	}
+
+	if msg := prm.checkPassphrase("velvet quarry lantern oboe tundra", nil); msg != "GOOD" {
+		t.Error("Expected GOOD, got:", msg)
+	}
+
+	if msg := prm.checkPassphrase("velvetquarrylanterntundra", nil); msg != "it does not contain enough words" {
+		t.Error("Expected not enough words, got:", msg)
+	}
+
+	if msg := prm.checkPassphrase("password password password password", nil); msg != "it is too easy to guess" {
+		t.Error("Expected too easy to guess, got:", msg)
+	}
+}
+
+// Test a generated passphrase has the right number of words from the list
+func TestGeneratePassphrase(t *testing.T) {
+	f, err := ioutil.TempFile("", "wordlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\napple\nbanana\ncherry\n\ndamson\n")
+	f.Close()
+
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.WordListPath = f.Name()
+	prm.Config.PassphraseWords = 5
+
+	passphrase, err := prm.GeneratePassphrase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	words := strings.Split(passphrase, "-")
+	if len(words) != 5 {
+		t.Fatal("Expected 5 words, got:", passphrase)
+	}
+
+	for _, word := range words {
+		if word != "apple" && word != "banana" && word != "cherry" && word != "damson" {
+			t.Error("Unexpected word in passphrase:", word)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package prm
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pending changes hold a validated new password on the server between the
+// first form and the terms and conditions page, so the password itself never
+// goes back out to the browser. The session token only carries the id.
+//
+// Under FastCGI the page that accepts the terms may well be served by a
+// different process to the one that took the form, so a directory can be
+// configured to share pending changes between processes. Without one they are
+// kept in memory, which is fine for a single long running process.
+
+// ErrPendingNotFound is returned when a pending change has expired, been used
+// or never existed
+var ErrPendingNotFound = errors.New("pending change not found")
+
+// PendingStore holds sealed pending changes until they are taken or expire
+type PendingStore interface {
+	Put(id string, sealed string, expires time.Time) error
+	Take(id string) (string, error)
+	Delete(id string) error
+}
+
+// newPendingID creates an opaque random id for a pending change
+func newPendingID() (string, error) {
+	id := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// validPendingID stops ids from tokens being used to walk the filesystem
+func validPendingID(id string) bool {
+	if len(id) != 48 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// memoryPendingStore keeps pending changes in a map in this process
+type memoryPendingStore struct {
+	sync.Mutex
+	entries map[string]memoryPendingEntry
+}
+
+type memoryPendingEntry struct {
+	sealed  string
+	expires time.Time
+}
+
+// memoryPending is shared by every PRM in the process that has no pending directory
+var memoryPending = &memoryPendingStore{entries: make(map[string]memoryPendingEntry)}
+
+// Put stores a pending change, clearing out any that have expired
+func (s *memoryPendingStore) Put(id string, sealed string, expires time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for k, v := range s.entries {
+		if now.After(v.expires) {
+			delete(s.entries, k)
+		}
+	}
+
+	s.entries[id] = memoryPendingEntry{sealed, expires}
+	return nil
+}
+
+// Take returns a pending change and removes it
+func (s *memoryPendingStore) Take(id string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	entry, ok := s.entries[id]
+	delete(s.entries, id)
+
+	if !ok || time.Now().After(entry.expires) {
+		return "", ErrPendingNotFound
+	}
+	return entry.sealed, nil
+}
+
+// Delete removes a pending change without using it
+func (s *memoryPendingStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.entries, id)
+	return nil
+}
+
+// filePendingStore keeps each pending change in its own file in a directory
+// only readable by the server. The first line is the expiry time, the second
+// the sealed change
+type filePendingStore struct {
+	dir string
+}
+
+// Put writes a pending change to a temporary file and renames it into place
+// so other processes never see half a change
+func (s filePendingStore) Put(id string, sealed string, expires time.Time) error {
+	if !validPendingID(id) {
+		return ErrPendingNotFound
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	s.expire()
+
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.WriteString(strconv.FormatInt(expires.Unix(), 10) + "\n" + sealed + "\n")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, id))
+}
+
+// Take claims a pending change by renaming it, so only one process can ever
+// use it, then reads and removes it
+func (s filePendingStore) Take(id string) (string, error) {
+	if !validPendingID(id) {
+		return "", ErrPendingNotFound
+	}
+
+	claimed := filepath.Join(s.dir, ".taken-"+id)
+	if err := os.Rename(filepath.Join(s.dir, id), claimed); err != nil {
+		return "", ErrPendingNotFound
+	}
+	defer os.Remove(claimed)
+
+	expires, sealed, err := readPendingFile(claimed)
+	if err != nil || time.Now().Unix() > expires {
+		return "", ErrPendingNotFound
+	}
+	return sealed, nil
+}
+
+// Delete removes a pending change without using it
+func (s filePendingStore) Delete(id string) error {
+	if !validPendingID(id) {
+		return ErrPendingNotFound
+	}
+	err := os.Remove(filepath.Join(s.dir, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// expire removes any pending changes that are past their expiry time
+func (s filePendingStore) expire() {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, f := range files {
+		path := filepath.Join(s.dir, f.Name())
+		if strings.HasPrefix(f.Name(), ".") {
+			// Leftovers from a crashed Put or Take
+			if time.Since(f.ModTime()) > time.Hour {
+				os.Remove(path)
+			}
+			continue
+		}
+		expires, _, err := readPendingFile(path)
+		if err != nil || now > expires {
+			os.Remove(path)
+		}
+	}
+}
+
+// readPendingFile reads the expiry time and sealed change from a file
+func readPendingFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, "", ErrPendingNotFound
+	}
+	expires, err := strconv.ParseInt(scanner.Text(), 10, 64)
+	if err != nil || !scanner.Scan() {
+		return 0, "", ErrPendingNotFound
+	}
+
+	return expires, scanner.Text(), nil
+}
+
+// pendingStore returns the configured store for pending changes
+func (prm *PRM) pendingStore() PendingStore {
+	if prm.Config.PendingPath != "" {
+		return filePendingStore{prm.Config.PendingPath}
+	}
+	return memoryPending
+}
+
+// putPendingPassword seals the new password and stores it, returning the id
+func (prm *PRM) putPendingPassword(password string) (string, error) {
+	id, err := newPendingID()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := prm.sealKeyed(ufferPending, []byte(password))
+	if err != nil {
+		return "", err
+	}
+
+	expires := time.Now().Add(time.Duration(prm.sessionTimeout()) * time.Second)
+	return id, prm.pendingStore().Put(id, sealed, expires)
+}
+
+// takePendingPassword fetches and removes the new password for a session
+func (prm *PRM) takePendingPassword(token SessionToken) (string, error) {
+	sealed, err := prm.pendingStore().Take(token.PendingID)
+	if err != nil {
+		return "", err
+	}
+
+	password, err := prm.openKeyed(ufferPending, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
@@ -0,0 +1,54 @@
+package prm
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Test both stores hand out a pending change once only and honour expiry
+func TestPendingStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]PendingStore{
+		"memory": &memoryPendingStore{entries: make(map[string]memoryPendingEntry)},
+		"file":   filePendingStore{dir},
+	}
+
+	for name, store := range stores {
+		id, _ := newPendingID()
+		expired, _ := newPendingID()
+
+		if err := store.Put(id, "sealed", time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(name, "Put failed:", err)
+		}
+		store.Put(expired, "sealed", time.Now().Add(-time.Minute))
+
+		sealed, err := store.Take(id)
+		if err != nil || sealed != "sealed" {
+			t.Error(name, "Take failed, got:", sealed, err)
+		}
+
+		if _, err := store.Take(id); err != ErrPendingNotFound {
+			t.Error(name, "second Take should fail, got:", err)
+		}
+
+		if _, err := store.Take(expired); err != ErrPendingNotFound {
+			t.Error(name, "Take of an expired change should fail, got:", err)
+		}
+	}
+}
+
+// Test ids that could escape the pending directory are refused
+func TestPendingID(t *testing.T) {
+	store := filePendingStore{os.TempDir()}
+
+	if _, err := store.Take("../../etc/passwd"); err != ErrPendingNotFound {
+		t.Error("Expected ErrPendingNotFound for a bad id, got:", err)
+	}
+}
@@ -11,13 +11,14 @@ package prm
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"gopkg.in/ldap.v2"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // PRM is a global struct object doofus - holds the secret config
@@ -50,6 +51,21 @@ const (
 	ErrorDeclined          = 13
 	ErrorOTPExpired        = 14
 	SuccessFinished        = 15
+	ErrorPasswordBreached  = 16
+	ErrorPasswordReused    = 17
+	ErrorPasswordPersonal  = 18
+	ErrorToken             = 19
+	ErrorTokenClient       = 20
+	ErrorTokenReplayed     = 21
+	ErrorCSRF              = 22
+	ErrorTOTP              = 23
+	ErrorTOTPRequired      = 24
+	SuccessEnrolled        = 25
+	SuccessResetSent       = 26
+	ErrorResetLink         = 27
+	ErrorOTPLocked         = 28
+	ErrorUnlockLimited     = 29
+	ErrorTOTPLocked        = 30
 )
 
 // ResultMap is a map to provide useful strings for the errors and successes.
@@ -63,10 +79,25 @@ var ResultMap = map[int]string{
 	ErrorPasswordLength:    "Error; your password is not long enough",
 	ErrorPasswordIncorrect: "Error; your username or password is incorrect",
 	ErrorNotImplemented:    "Error; this function has not been implemented",
-	ErrorOTP:               "Error; One-time account unlocking code failed. Please contact its-research-support@qmul.ac.uk for a new code.",
-	ErrorOTPExpired:        "Error; your one-time unlocking code has expired. Please contact its-research-support@qmul.ac.uk for a new code.",
+	ErrorOTP:               "Error; One-time account unlocking code failed. Please contact %HELPDESK% for a new code.",
+	ErrorOTPExpired:        "Error; your one-time unlocking code has expired. Please contact %HELPDESK% for a new code.",
 	ErrorDeclined:          "Error; you must accept the terms and conditions to continue",
 	SuccessFinished:        "Success: your password has been changed",
+	ErrorPasswordBreached:  "Error; your password has appeared in a known data breach, please choose another",
+	ErrorPasswordReused:    "Error; you have used this password recently, please choose another",
+	ErrorPasswordPersonal:  "Error; your password must not be based on your username, name or other personal details",
+	ErrorToken:             "Error; your session could not be verified, please start again",
+	ErrorTokenClient:       "Error; your session was started from a different browser or network, please start again",
+	ErrorTokenReplayed:     "Error; this form has already been submitted, please start again",
+	ErrorCSRF:              "Error; your request could not be verified, please reload the page and try again",
+	ErrorTOTP:              "Error; your authenticator code is incorrect",
+	ErrorTOTPRequired:      "Error; you must set up an authenticator app before changing your password",
+	SuccessEnrolled:        "Success: your authenticator app has been set up",
+	SuccessResetSent:       "If that username has an email address on record, a link to reset the password has been sent to it",
+	ErrorResetLink:         "Error; this password reset link is invalid, has expired or has already been used, please ask for a new one",
+	ErrorOTPLocked:         "Error; your one-time unlocking code was typed wrongly too many times and has been cancelled. Please contact %HELPDESK% for a new code.",
+	ErrorUnlockLimited:     "Error; too many unlocking codes have been tried for this account, please wait an hour and try again",
+	ErrorTOTPLocked:        "Error; too many authenticator codes have been tried for this account, please wait an hour and try again",
 }
 
 // Result is simply an int code from the return status types given above.
@@ -75,120 +106,122 @@ type Result struct {
 }
 
 // ToString probably needs a better name; it just converts int errors to their human strings.
+// The messages are in English with the default helpdesk contact, see ResultMessage for
+// what users are shown
 func (r *Result) ToString() string {
-	return ResultMap[r.Message]
+	return strings.Replace(ResultMap[r.Message], "%HELPDESK%", defaultHelpdeskContact, -1)
 }
 
 // parseForm takes a http.Request and looks for the form data and extracts it.
-func (prm *PRM) parseForm(r *http.Request) (string, string, string, string, string, string, string, string, string) {
+func (prm *PRM) parseForm(r *http.Request) (string, string, string, string, string, string, string) {
 	r.ParseForm()
 	username := strings.Join(r.Form["user"], "")
 	p0 := strings.Join(r.Form["p0"], "")
 	p1 := strings.Join(r.Form["p1"], "")
 	p2 := strings.Join(r.Form["p2"], "")
 	otp := strings.Join(r.Form["otp"], "")
-	puffer := strings.Join(r.Form["puffer"], "")
-	wuffer := strings.Join(r.Form["wuffer"], "")
-	tuffer := strings.Join(r.Form["tuffer"], "")
+	token := strings.Join(r.Form["token"], "")
 	verb := strings.Join(r.Form["verb"], "")
-	return username, p0, p1, p2, otp, puffer, wuffer, tuffer, verb
+	return username, p0, p1, p2, otp, token, verb
 }
 
-// ProcessSkipped takes the first form and immediately skips the terms and conditions
-// and tries to change the password
-func (prm *PRM) ProcessSkipped(r *http.Request) (result Result, data map[string]string) {
-
-	username, p0, p1, _, _, _, _, _, _ := prm.parseForm(r)
-
-	conn, err := prm.ldapConnect()
-	err = prm.ldapBindAdmin(conn)
-
-	defer conn.Close()
-
+// ProcessSkipped completes a change straight after the first form when the
+// terms and conditions do not need to be shown. The sealed token from
+// ProcessForm stands in for the checks already made there, so one-time codes
+// are not needed twice
+func (prm *PRM) ProcessSkipped(r *http.Request, sealed string) (result Result, data map[string]string) {
+	conn, err := prm.Connect()
 	if err != nil {
 		prm.LogPRM(err.Error(), LOG_ERROR)
 		return Result{ErrorFatal}, nil
 	}
+	defer conn.Close()
 
-	newpassword := p1
-
-	// Check that the username passed is legit to stop attacks on the hash
-	entry := prm.SearchUsername(username, conn)
-	if entry == nil {
-		return Result{ErrorFatal}, nil
+	token, err := prm.redeemSessionToken(sealed, r)
+	if err != nil {
+		return Result{tokenResult(err)}, nil
 	}
 
-	// Double check the existing password
-	if !prm.CheckPasswordCorrect(username, p0, conn) {
-		return Result{ErrorPasswordIncorrect}, nil
-	}
+	return prm.applyChange(token, conn, r)
+}
 
-	// Rebind as admin due to the check password correct above
-	err = prm.ldapBindAdmin(conn)
+// ProcessTerms deals with the acceptance of the terms and conditions form which is
+// the second page after a correct series of inputs from the user.
+func (prm *PRM) ProcessTerms(r *http.Request) (result Result, data map[string]string) {
+	_, _, _, _, _, sealed, verb := prm.parseForm(r)
+
+	if !prm.checkCSRF(r) {
+		return Result{ErrorCSRF}, nil
+	}
 
+	conn, err := prm.Connect()
 	if err != nil {
 		prm.LogPRM(err.Error(), LOG_ERROR)
 		return Result{ErrorFatal}, nil
 	}
+	defer conn.Close()
 
-	if !prm.ChangeLDAPPassword(username, newpassword, conn) {
-		return Result{ErrorLDAP}, nil
-	}
+	token, err := prm.redeemSessionToken(sealed, r)
 
-	// Check for a Linux password
-	if !prm.ChangeLinuxPassword(username, newpassword, conn) {
-		return Result{ErrorFatal}, nil
+	if verb != "Accept" {
+		// Throw away the pending change so the password is not kept around
+		if err == nil {
+			prm.pendingStore().Delete(token.PendingID)
+			prm.AuditPRM("terms-declined", token.Username, r, "version="+prm.Config.TermsVersion)
+		}
+		return Result{ErrorDeclined}, nil
 	}
 
-	// Check for the Samba Password
-	if !prm.ChangeSambaPassword(username, newpassword, conn) {
-		return Result{ErrorFatal}, nil
+	if err != nil {
+		return Result{tokenResult(err)}, nil
 	}
 
-	// If all is well, send the email
-	name, addy := prm.GetEmailDeets(username, conn)
-	SendEmail(name, addy, prm.Config)
+	result, data = prm.applyChange(token, conn, r)
 
-	m := make(map[string]string)
-	m["username"] = username
+	// The password has already changed so failing to record the acceptance
+	// is logged rather than returned
+	if result.Message == SuccessFinished && !prm.RecordTermsAccepted(token.Username, conn, r) {
+		prm.LogPRM("RecordTermsAccepted failed for "+token.Username, LOG_WARN)
+	}
 
-	return Result{SuccessFinished}, m
+	return result, data
 }
 
-// ProcessTerms deals with the acceptance of the terms and conditions form which is
-// the second page after a correct series of inputs from the user.
-func (prm *PRM) ProcessTerms(r *http.Request) (result Result, data map[string]string) {
-	_, _, _, _, _, puffer, wuffer, tuffer, verb := prm.parseForm(r)
-	conn, err := prm.ldapConnect()
-	err = prm.ldapBindAdmin(conn)
+// redeemSessionToken verifies a sealed token and marks it used. The token
+// covers the username, pending change and time so any tampering, expiry,
+// change of browser or second use is caught here
+func (prm *PRM) redeemSessionToken(sealed string, r *http.Request) (SessionToken, error) {
+	token, err := prm.VerifySessionToken(sealed, r)
 
-	defer conn.Close()
+	if err == nil {
+		err = prm.UseSessionToken(token)
+		if err == ErrTokenReplayed {
+			prm.AuditPRM("token-replayed", token.Username, r, "nonce="+token.Nonce)
+		}
+	}
 
 	if err != nil {
-		prm.LogPRM(err.Error(), LOG_ERROR)
-		return Result{ErrorFatal}, nil
+		prm.LogPRM("VerifySessionToken Warning: "+err.Error(), LOG_WARN)
 	}
+	return token, err
+}
 
-	if verb != "Accept" {
-		return Result{ErrorDeclined}, nil
+// applyChange sets the pending password for a redeemed token everywhere it
+// is needed and lets the user know by email
+func (prm *PRM) applyChange(token SessionToken, conn Conn, r *http.Request) (result Result, data map[string]string) {
+	username := token.Username
+	newpassword, err := prm.takePendingPassword(token)
+	if err != nil {
+		prm.LogPRM("takePendingPassword Warning: "+err.Error(), LOG_WARN)
+		return Result{tokenResult(err)}, nil
 	}
 
-	username := decryptUffer(wuffer, prm.Config.Uffer)
-	newpassword := decryptUffer(puffer, prm.Config.Uffer)
-	starttime, err := strconv.ParseInt(decryptUffer(tuffer, prm.Config.Uffer), 10, 64)
-
 	// Check that the username passed is legit to stop attacks on the hash
 	entry := prm.SearchUsername(username, conn)
 	if entry == nil {
 		return Result{ErrorFatal}, nil
 	}
 
-	// Check to see if time has expired
-	now := time.Now().Unix()
-	if now-starttime > 1800 {
-		return Result{ErrorTimeOut}, nil
-	}
-
 	if !prm.ChangeLDAPPassword(username, newpassword, conn) {
 		return Result{ErrorLDAP}, nil
 	}
@@ -203,13 +236,34 @@ func (prm *PRM) ProcessTerms(r *http.Request) (result Result, data map[string]st
 		return Result{ErrorFatal}, nil
 	}
 
+	// Record the new password so it cant be reused. The password has already
+	// changed at this point so a failure is logged rather than returned
+	if !prm.UpdatePasswordHistory(username, newpassword, entry, conn) {
+		prm.LogPRM("UpdatePasswordHistory failed for "+username, LOG_WARN)
+	}
+
 	// If all is well, send the email
-	name, addy := prm.GetEmailDeets(username, conn)
-	SendEmail(name, addy, prm.Config)
+	prm.sendChangedNotice(username, conn, r)
+
+	if prm.NotifyEnabled(NotifyNewNetwork) && prm.fromNewNetwork(username, r) {
+		prm.notify(NotifyNewNetwork, username, entry, r)
+	}
 
 	m := make(map[string]string)
 	m["username"] = username
 
+	// Hand out a fresh set of recovery codes, shown only this once. Failing
+	// to make them doesn't undo the change, the old set is kept instead
+	if prm.RecoveryEnabled() {
+		codes, err := prm.IssueRecoveryCodes(username, conn)
+		if err != nil {
+			prm.LogPRM("IssueRecoveryCodes Error: "+err.Error(), LOG_ERROR)
+		} else {
+			prm.AuditPRM("recovery-codes-issued", username, nil)
+			m["recovery"] = strings.Join(codes, " ")
+		}
+	}
+
 	return Result{SuccessFinished}, m
 }
 
@@ -217,17 +271,19 @@ func (prm *PRM) ProcessTerms(r *http.Request) (result Result, data map[string]st
 // it returns a Result which is then checked, directing the flow to pass or fail.
 func (prm *PRM) ProcessForm(r *http.Request) (result Result, data map[string]string) {
 	r.ParseForm()
-	conn, err := prm.ldapConnect()
-	err = prm.ldapBindAdmin(conn)
 
+	if !prm.checkCSRF(r) {
+		return Result{ErrorCSRF}, nil
+	}
+
+	conn, err := prm.Connect()
 	if err != nil {
 		prm.LogPRM(err.Error(), LOG_ERROR)
 		return Result{ErrorFatal}, nil
 	}
-
 	defer conn.Close()
 
-	username, p0, p1, p2, otp, _, _, _, _ := prm.parseForm(r)
+	username, p0, p1, p2, otp, _, _ := prm.parseForm(r)
 
 	// Find the user
 	entry := prm.SearchUsername(username, conn)
@@ -235,19 +291,111 @@ func (prm *PRM) ProcessForm(r *http.Request) (result Result, data map[string]str
 		return Result{ErrorNoUser}, nil
 	}
 
+	if result, data := prm.checkNewPassword(username, p1, p2); result.Message != Success {
+		return result, data
+	}
+
+	// Decide upon one-time-code or password as the way to go
+	if len(otp) > 0 {
+		result, code := prm.checkUnlockCode(username, entry, otp, strings.Join(r.Form["totp"], ""), conn, r)
+		if !result {
+			return Result{code}, nil
+		}
+	} else {
+		if !prm.CheckPasswordCorrect(username, p0, conn) {
+			prm.passwordFailed(username, entry, r)
+			return Result{ErrorPasswordIncorrect}, nil
+		}
+
+		// The old password alone is not enough for users with an authenticator
+		if prm.TOTPEnabled() {
+			if err := prm.ldapBindAdmin(conn); err != nil {
+				prm.LogPRM(err.Error(), LOG_ERROR)
+				return Result{ErrorFatal}, nil
+			}
+
+			if code := prm.CheckTOTP(username, entry, strings.Join(r.Form["totp"], ""), conn, r); code != Success {
+				return Result{code}, nil
+			}
+		}
+	}
+
+	if result, data := prm.checkPersonalPassword(username, entry, p0, p1); result.Message != Success {
+		return result, data
+	}
+
+	// The new password is only held for users who have proved who they are,
+	// so failed attempts can't fill up the pending store
+	token, err := prm.NewSessionToken(username, p1, r)
+	if err != nil {
+		prm.LogPRM("NewSessionToken Error: "+err.Error(), LOG_ERROR)
+		return Result{ErrorFatal}, nil
+	}
+
+	m := make(map[string]string)
+	m["token"] = token
+	m["username"] = username
+	m["otp"] = otp
+	if prm.TermsRequired(entry, otp != "") {
+		m["terms"] = "true"
+	}
+
+	return Result{Success}, m
+
+}
+
+// checkNewPassword runs the checks a new password must pass before the user
+// has proved who they are, returning Success or the reason it was refused.
+// Only the username they typed is used as a personal term, see
+// checkPersonalPassword for the rest
+func (prm *PRM) checkNewPassword(username string, p1 string, p2 string) (result Result, data map[string]string) {
 	// Check new passwords match..
 	if !(p1 == p2) {
 		return Result{ErrorPasswordMatch}, nil
 	}
 
+	// ... or aren't valid text
+	if !utf8.ValidString(p1) {
+		return Result{ErrorPasswordStrength}, nil
+	}
+
 	// ... or are too weak
 	if !prm.passwordStrength(p1) {
 		return Result{ErrorPasswordStrength}, nil
 	}
 
-	// ... or fail the #cracklib check
-	cracklibMsg := TestPassword(p1)
-	if cracklibMsg != "GOOD" {
+	terms := prm.personalTerms(username, nil)
+
+	// ... or fail the #cracklib check. Passphrases skip the character class
+	// rules and are checked for enough words and entropy instead
+	if prm.IsPassphrase(p1) {
+		if msg := prm.checkPassphrase(p1, terms); msg != "GOOD" {
+			return Result{ErrorPasswordStrength}, map[string]string{"reason": msg}
+		}
+	} else {
+		cracklibMsg := TestPassword(p1)
+		if cracklibMsg != "GOOD" {
+			return Result{ErrorPasswordStrength}, nil
+		}
+	}
+
+	// ... or appear in the breached password corpus
+	breached, err := prm.PasswordBreached(p1)
+	if err != nil {
+		prm.LogPRM("PasswordBreached Error: "+err.Error(), LOG_ERROR)
+		return Result{ErrorFatal}, nil
+	}
+	if breached {
+		return Result{ErrorPasswordBreached}, nil
+	}
+
+	// ... or are based on their username
+	if reason := containsPersonalTerm(p1, terms); reason != nil {
+		return Result{ErrorPasswordPersonal}, reason
+	}
+
+	// ... or are too easy to guess
+	if !prm.IsPassphrase(p1) && EstimateStrength(p1, termWords(terms)...).Score < prm.Config.MinPasswordScore {
 		return Result{ErrorPasswordStrength}, nil
 	}
 
@@ -256,28 +404,100 @@ func (prm *PRM) ProcessForm(r *http.Request) (result Result, data map[string]str
 		return Result{ErrorPasswordLength}, nil
 	}
 
-	m := make(map[string]string)
-	m["wuffer"] = createUffer(username, prm.Config.Uffer)
-	m["puffer"] = createUffer(p1, prm.Config.Uffer)
-	m["tuffer"] = createUffer(fmt.Sprintf("%d", time.Now().Unix()), prm.Config.Uffer)
-	m["username"] = username
-	m["otp"] = otp
+	return Result{Success}, nil
+}
 
-	// Decide upon one-time-code or password as the way to go
-	if len(otp) > 0 {
-		result, code := prm.CheckOTP(username, otp, conn)
-		if !result {
-			return Result{code}, nil
+// checkPersonalPassword runs the checks that compare a new password with
+// what is known about the user, the details on their entry and their old
+// passwords. It must only be called once the old password or a code has been
+// checked, as otherwise the answer would tell anyone about another users
+// details, or whether a guess was their password, without ever trying it
+// against LDAP
+func (prm *PRM) checkPersonalPassword(username string, entry *ldap.Entry, p0 string, p1 string) (result Result, data map[string]string) {
+	terms := prm.personalTerms(username, entry)
+
+	// Check new passwords aren't based on the users own details..
+	if reason := containsPersonalTerm(p1, terms); reason != nil {
+		return Result{ErrorPasswordPersonal}, reason
+	}
+
+	// ... or too easy to guess for someone who knows them
+	if prm.IsPassphrase(p1) {
+		if msg := prm.checkPassphrase(p1, terms); msg != "GOOD" {
+			return Result{ErrorPasswordStrength}, map[string]string{"reason": msg}
 		}
-		return Result{Success}, m
+	} else if EstimateStrength(p1, termWords(terms)...).Score < prm.Config.MinPasswordScore {
+		return Result{ErrorPasswordStrength}, nil
 	}
 
-	if !prm.CheckPasswordCorrect(username, p0, conn) {
-		return Result{ErrorPasswordIncorrect}, nil
+	// ... or have been used before
+	if p1 == p0 || prm.PasswordInHistory(entry, p1) {
+		return Result{ErrorPasswordReused}, nil
 	}
 
-	return Result{Success}, m
+	return Result{Success}, nil
+}
+
+// CheckPassword runs the checks that can be made before the form is
+// submitted and returns "GOOD" or a cracklib style message saying what is
+// wrong with the password. If a username is given the password is checked
+// against it too, but not against anything looked up about the user, as
+// anyone can ask
+func (prm *PRM) CheckPassword(username string, password string) string {
+	return prm.checkPassword(password, prm.personalTerms(username, nil))
+}
+
+// checkPassword does the work for CheckPassword given the users personal terms
+func (prm *PRM) checkPassword(password string, terms []personalTerm) string {
+	if !utf8.ValidString(password) {
+		return "it contains characters that can't be read"
+	}
+
+	if prm.IsPassphrase(password) {
+		if msg := prm.checkPassphrase(password, terms); msg != "GOOD" {
+			return msg
+		}
+	} else if msg := TestPassword(password); msg != "GOOD" {
+		return msg
+	}
 
+	breached, err := prm.PasswordBreached(password)
+	if err != nil {
+		prm.LogPRM("PasswordBreached Error: "+err.Error(), LOG_ERROR)
+		return "it could not be checked against known data breaches"
+	}
+	if breached {
+		return "it has appeared in a known data breach"
+	}
+
+	// Only the username is checked here, so there is no attribute to fill in
+	if reason := containsPersonalTerm(password, terms); reason != nil {
+		return reason["reason"]
+	}
+
+	if !prm.IsPassphrase(password) && EstimateStrength(password, termWords(terms)...).Score < prm.Config.MinPasswordScore {
+		return "it is too easy to guess"
+	}
+
+	return "GOOD"
+}
+
+// PasswordReport is the detailed answer given to clients of /check that ask
+// for JSON. Message is the same string older clients get as plain text, and
+// Reason is what is wrong in the users language
+type PasswordReport struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason,omitempty"`
+	Strength
+}
+
+// ReportPassword checks a password and estimates its strength in one go
+func (prm *PRM) ReportPassword(username string, password string) PasswordReport {
+	terms := prm.personalTerms(username, nil)
+	return PasswordReport{
+		Message:  prm.checkPassword(password, terms),
+		Strength: EstimateStrength(password, termWords(terms)...),
+	}
 }
 
 // passwordStrength is a null function that can probably be removed
@@ -388,13 +608,6 @@ func (prm *PRM) ChangeSambaPassword(username string, newpassword string, conn Co
 	return false
 }
 
-// parse_otp takes a string, trims it and returns epoch and actual otp
-func (prm *PRM) parseOtp(code string) (epoch int64, otp string) {
-	otp = strings.TrimLeft(code[:9], "0")
-	epoch, _ = strconv.ParseInt(code[9:], 10, 64)
-	return epoch, otp
-}
-
 // CheckOTP checks to see if the OTP exists and if so, does the one provided match. Returns true if
 // everything checks out, or false and an errorcode if not
 func (prm *PRM) CheckOTP(username string, userotp string, conn Conn) (result bool, errorcode int) {
@@ -406,27 +619,26 @@ func (prm *PRM) CheckOTP(username string, userotp string, conn Conn) (result boo
 		return false, ErrorOTP
 	}
 
-	code := entry.GetAttributeValue("internationaliSDNNumber")
+	code := entry.GetAttributeValue(prm.otpAttribute())
 
-	if len(code) < 10 {
-		prm.LogPRM("ChangeOTP Info: len(code) < 10", LOG_INFO)
+	epoch, matched, err := prm.verifyOtp(username, code, prm.normaliseOtp(userotp))
+
+	if err != nil {
+		prm.LogPRM("CheckOTP Info: "+err.Error(), LOG_INFO)
 		return false, ErrorOTP
 	}
 
-	epoch, storedOtp := prm.parseOtp(code)
-
 	if time.Now().Unix() > epoch {
 
-		prm.LogPRM("ChangeOTP Info: len(code) < 10", LOG_INFO)
 		prm.LogPRM("ChangeOTP Info: expired", LOG_WARN)
 
 		return false, ErrorOTPExpired
 	}
 
-	if storedOtp == userotp {
+	if matched {
 		// Success so delete the OTP
 		modify := ldap.NewModifyRequest(fmt.Sprintf(prm.Config.PasswordModifyLDAP+",%v", username, prm.Config.BaseDN))
-		modify.Delete("internationaliSDNNumber", []string{code})
+		modify.Delete(prm.otpAttribute(), []string{code})
 		err := conn.Modify(modify)
 
 		if err != nil {
@@ -442,13 +654,18 @@ func (prm *PRM) CheckOTP(username string, userotp string, conn Conn) (result boo
 	return false, ErrorOTP
 }
 
-// GetEmailDeets grabs the email details for a user out of LDAP
-// TODO - no error is given here for the user - we just trundle along :S
-func (prm *PRM) GetEmailDeets(username string, conn Conn) (givenName string, emailAddr string) {
-
-	givenName = "test"
-	emailAddr = "test"
+// GetEmailDeets grabs the email details for a user out of LDAP. It returns
+// ErrNoEmail if the user has no address
+func (prm *PRM) GetEmailDeets(username string, conn Conn) (givenName string, emailAddr string, err error) {
+	givenName, emailAddr, err = prm.lookupEmail(username, "mail", conn)
+	if err == nil && emailAddr == "" {
+		err = ErrNoEmail
+	}
+	return givenName, emailAddr, err
+}
 
+// lookupEmail finds a users first name and the address held in attribute
+func (prm *PRM) lookupEmail(username string, attribute string, conn Conn) (givenName string, emailAddr string, err error) {
 	searchRequest := ldap.NewSearchRequest(
 		fmt.Sprintf(prm.Config.ORGFieldLDAP+",%v", prm.Config.BaseDN),
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
@@ -460,17 +677,17 @@ func (prm *PRM) GetEmailDeets(username string, conn Conn) (givenName string, ema
 	sr, err := conn.Search(searchRequest)
 	if err != nil {
 		prm.LogPRM("GetEmailDeets Error:"+err.Error(), LOG_INFO)
-		return
+		return "", "", err
 	}
 
 	if len(sr.Entries) != 1 {
-		return
+		return "", "", ErrNoUser
 	}
 
 	givenName = sr.Entries[0].GetAttributeValue("givenName")
-	emailAddr = sr.Entries[0].GetAttributeValue("mail")
+	emailAddr = sr.Entries[0].GetAttributeValue(attribute)
 	prm.LogPRM("GetEmailDeets: "+givenName+" "+emailAddr, LOG_INFO)
-	return
+	return givenName, emailAddr, nil
 }
 
 // SearchUsername searches LDAP to find an entry given a username and connection
@@ -482,7 +699,7 @@ func (prm *PRM) SearchUsername(username string, conn Conn) (ldapentry *ldap.Entr
 		fmt.Sprintf(prm.Config.ORGFieldLDAP+",%v", prm.Config.BaseDN),
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		fmt.Sprintf("("+prm.Config.UserFieldLDAP+"=%v)", username),
-		nil,
+		prm.searchAttributes(),
 		nil,
 	)
 
@@ -503,12 +720,40 @@ func (prm *PRM) SearchUsername(username string, conn Conn) (ldapentry *ldap.Entr
 	return nil
 }
 
+// searchAttributes lists the attributes to fetch for a user. Group
+// membership is often an operational attribute which is only returned when
+// asked for by name
+func (prm *PRM) searchAttributes() []string {
+	if len(prm.Config.TOTPRequiredGroups) == 0 {
+		return nil
+	}
+	return []string{"*", prm.totpGroupAttribute()}
+}
+
 // ldapBindAdmin binds as the admin user for ldap operations
 func (prm *PRM) ldapBindAdmin(conn Conn) error {
 	err := conn.Bind(prm.Config.BindDN, prm.Config.BindPassword)
 	return err
 }
 
+// Connect connects to LDAP and binds as the admin user, for tools such as
+// prm-admin that work on entries directly. The caller must close it
+func (prm *PRM) Connect() (*ldap.Conn, error) {
+	conn, err := prm.ldapConnect()
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return nil, errors.New("could not connect to " + prm.Config.LDAPHost)
+	}
+
+	if err := prm.ldapBindAdmin(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 // ldapConnect connects to ldap as a basic non-admin user
 func (prm *PRM) ldapConnect() (*ldap.Conn, error) {
 	host := fmt.Sprintf("%v:%d", prm.Config.LDAPHost, prm.Config.LDAPPort)
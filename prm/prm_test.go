@@ -54,7 +54,7 @@ func TestFormParse(t *testing.T) {
 
 	var prm = new(PRM)
 	req := &http.Request{Method: "GET"}
-	username, p0, p1, p2, otp, puffer, wuffer, tuffer, verb := prm.parseForm(req)
+	username, p0, p1, p2, otp, token, verb := prm.parseForm(req)
 	if username != "" {
 		t.Errorf("Error in parseForm - username:" + username)
 	}
@@ -70,14 +70,8 @@ func TestFormParse(t *testing.T) {
 	if otp != "" {
 		t.Errorf("Error in parseForm - otp:" + otp)
 	}
-	if puffer != "" {
-		t.Errorf("Error in parseForm - puffer:" + puffer)
-	}
-	if wuffer != "" {
-		t.Errorf("Error in parseForm - wuffer:" + wuffer)
-	}
-	if tuffer != "" {
-		t.Errorf("Error in parseForm - tuffer:" + tuffer)
+	if token != "" {
+		t.Errorf("Error in parseForm - token:" + token)
 	}
 	if verb != "" {
 		t.Errorf("Error in parseForm - verb:" + verb)
@@ -90,14 +84,12 @@ func TestFormParse(t *testing.T) {
 	values.Add("p1", "password1")
 	values.Add("p2", "password2")
 	values.Add("otp", "otp")
-	values.Add("puffer", "puffer")
-	values.Add("wuffer", "wuffer")
-	values.Add("tuffer", "tuffer")
+	values.Add("token", "token")
 	values.Add("verb", "verb")
 
 	req = &http.Request{Method: "POST", Form: values}
 
-	username, p0, p1, p2, otp, puffer, wuffer, tuffer, verb = prm.parseForm(req)
+	username, p0, p1, p2, otp, token, verb = prm.parseForm(req)
 
 	if username != "username" {
 		t.Errorf("Error in username(2) - username:" + username)
@@ -119,16 +111,8 @@ func TestFormParse(t *testing.T) {
 		t.Errorf("Error in parseForm(2) - otp:" + otp)
 	}
 
-	if puffer != "puffer" {
-		t.Errorf("Error in parseForm(2) - puffer:" + puffer)
-	}
-
-	if wuffer != "wuffer" {
-		t.Errorf("Error in parseForm(2) - wuffer:" + wuffer)
-	}
-
-	if tuffer != "tuffer" {
-		t.Errorf("Error in parseForm(2) - tuffer:" + tuffer)
+	if token != "token" {
+		t.Errorf("Error in parseForm(2) - token:" + token)
 	}
 
 	if verb != "verb" {
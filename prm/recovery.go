@@ -0,0 +1,172 @@
+package prm
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"net/http"
+	"strings"
+)
+
+// Account recovery codes let users who have lost their password, and can't
+// get at their email, unlock their account without the helpdesk. A fresh set
+// of ten is made after every successful password change and shown to the
+// user once. Any one of them can then be typed in place of a one-time code.
+//
+// Each code is kept as a separate value of RecoveryAttribute, stored as
+//
+//	{RC1}keyid$salt$mac
+//
+// where mac is an HMAC-SHA256, keyed from the uffer keyring, of the username,
+// salt and code. A code is used up by deleting its value, which LDAP only
+// lets happen once, so the same code can't be used by two requests at once.
+
+// recoveryHashPrefix marks a hashed account recovery code and its version
+const recoveryHashPrefix = "{RC1}"
+
+// unlockMaxTries is how many codes may be typed in the one-time code box for
+// a user in failureWindow, so recovery codes can't be guessed. Unlike one-time
+// codes they aren't cancelled after too many failures, as anyone could then
+// take away another users codes
+const unlockMaxTries = 10
+
+// RecoveryEnabled checks if account recovery codes are in use
+func (prm *PRM) RecoveryEnabled() bool {
+	return prm.Config.RecoveryAttribute != ""
+}
+
+// recoveryMAC computes the MAC of a recovery code for a user
+func recoveryMAC(key string, username string, salt string, code string) string {
+	derived := sha256.Sum256([]byte("prm-recovery\n" + key))
+	mac := hmac.New(sha256.New, derived[:])
+	mac.Write([]byte(username + "\n" + salt + "\n" + normaliseCode(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashRecovery creates the stored value for a recovery code using the primary
+// uffer key
+func (prm *PRM) hashRecovery(username string, code string) (string, error) {
+	primary, keys := prm.ufferKeyring()
+
+	key, ok := keys[primary]
+	if !ok || key == "" {
+		return "", errors.New("uffer primary key " + primary + " is not in the keyring")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	encoded := hex.EncodeToString(salt)
+
+	return recoveryHashPrefix + primary + "$" + encoded + "$" + recoveryMAC(key, username, encoded, code), nil
+}
+
+// matchRecovery checks a code against one stored value
+func (prm *PRM) matchRecovery(username string, value string, code string) bool {
+	if !strings.HasPrefix(value, recoveryHashPrefix) {
+		return false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, recoveryHashPrefix), "$")
+	if len(parts) != 3 {
+		return false
+	}
+
+	_, keys := prm.ufferKeyring()
+	key, ok := keys[parts[0]]
+	if !ok {
+		return false
+	}
+
+	return hmac.Equal([]byte(recoveryMAC(key, username, parts[1], code)), []byte(parts[2]))
+}
+
+// IssueRecoveryCodes replaces a users account recovery codes with a new set,
+// returning the codes to show them. The connection must be bound as admin
+func (prm *PRM) IssueRecoveryCodes(username string, conn Conn) ([]string, error) {
+	if !prm.RecoveryEnabled() {
+		return nil, errors.New("recoveryattribute is not set")
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]string, len(codes))
+	for i, code := range codes {
+		if values[i], err = prm.hashRecovery(username, code); err != nil {
+			return nil, err
+		}
+	}
+
+	modify := ldap.NewModifyRequest(prm.userDN(username))
+	modify.Replace(prm.Config.RecoveryAttribute, values)
+	if err := conn.Modify(modify); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// findRecoveryCode returns the stored value matching a code, or ""
+func (prm *PRM) findRecoveryCode(username string, entry *ldap.Entry, code string) string {
+	if !prm.RecoveryEnabled() || entry == nil || normaliseCode(code) == "" {
+		return ""
+	}
+
+	for _, value := range entry.GetAttributeValues(prm.Config.RecoveryAttribute) {
+		if prm.matchRecovery(username, value, code) {
+			return value
+		}
+	}
+	return ""
+}
+
+// checkUnlockCode checks a code typed in the one-time code box, which may be
+// a one-time code from the helpdesk or one of the users recovery codes.
+// Recovery codes are self-service, so unlike codes from the helpdesk they
+// don't stand in for an authenticator app. The connection must be bound as
+// admin
+func (prm *PRM) checkUnlockCode(username string, entry *ldap.Entry, code string, totp string, conn Conn, r *http.Request) (bool, int) {
+	// Every try is counted, as guesses have to stop before the code is
+	// checked. A right code is used up, so counting it does no harm
+	if prm.countFailure("unlock-tried", username, unlockMaxTries+1) > unlockMaxTries {
+		prm.AuditPRM("unlock-limited", username, r)
+		return false, ErrorUnlockLimited
+	}
+
+	value := prm.findRecoveryCode(username, entry, code)
+	if value == "" {
+		ok, result := prm.CheckOTP(username, code, conn)
+		switch {
+		case ok:
+			prm.notify(NotifyOTPUsed, username, entry, r)
+		case result == ErrorOTP && prm.otpFailed(username, entry, conn, r):
+			result = ErrorOTPLocked
+		}
+		return ok, result
+	}
+
+	if result := prm.CheckTOTP(username, entry, totp, conn, r); result != Success {
+		return false, result
+	}
+
+	// Deleting a value that has gone fails, so a code only works once
+	modify := ldap.NewModifyRequest(prm.userDN(username))
+	modify.Delete(prm.Config.RecoveryAttribute, []string{value})
+	if err := conn.Modify(modify); err != nil {
+		prm.LogPRM("checkUnlockCode Error: "+err.Error(), LOG_ERROR)
+		return false, ErrorOTP
+	}
+
+	left := len(entry.GetAttributeValues(prm.Config.RecoveryAttribute)) - 1
+	prm.AuditPRM("recovery-code-used", username, r, fmt.Sprintf("recovery-codes-left=%d", left))
+	prm.notify(NotifyOTPUsed, username, entry, r)
+	return true, Success
+}
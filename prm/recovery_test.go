@@ -0,0 +1,122 @@
+package prm
+
+import (
+	"gopkg.in/ldap.v2"
+	"strings"
+	"testing"
+)
+
+func newRecoveryPRM() *PRM {
+	prm := newOTPPRM()
+	prm.Config.RecoveryAttribute = "prmRecoveryCode"
+	return prm
+}
+
+// Test issuing stores ten hashed codes and each can be used in place of a
+// one-time code
+func TestAccountRecoveryCodes(t *testing.T) {
+	prm := newRecoveryPRM()
+	conn := &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example"}}
+
+	codes, err := prm.IssueRecoveryCodes("abc123", conn)
+	if err != nil || len(codes) != recoveryCodeCount {
+		t.Fatal("For: IssueRecoveryCodes got:", codes, err)
+	}
+
+	stored := conn.modified.ReplaceAttributes[0]
+	if stored.Type != "prmRecoveryCode" || len(stored.Vals) != recoveryCodeCount {
+		t.Fatal("For: IssueRecoveryCodes stored:", stored)
+	}
+	for i, value := range stored.Vals {
+		if !strings.HasPrefix(value, recoveryHashPrefix) || strings.Contains(value, normaliseCode(codes[i])) {
+			t.Error("For:", codes[i], "stored:", value)
+		}
+	}
+
+	conn.entry.Attributes = []*ldap.EntryAttribute{{Name: "prmRecoveryCode", Values: stored.Vals}}
+
+	// Codes may be typed in upper case and without the dash
+	typed := strings.ToUpper(strings.Replace(codes[3], "-", "", -1))
+	conn.modified = nil
+	if result, code := prm.checkUnlockCode("abc123", conn.entry, typed, "", conn, nil); !result || code != Success {
+		t.Fatal("For:", typed, "got:", result, code)
+	}
+
+	deleted := conn.modified.DeleteAttributes[0]
+	if deleted.Type != "prmRecoveryCode" || len(deleted.Vals) != 1 || deleted.Vals[0] != stored.Vals[3] {
+		t.Error("For:", typed, "deleted:", deleted)
+	}
+}
+
+// Test wrong codes, codes for other users and codes when the feature is off
+// are all refused
+func TestAccountRecoveryCodesRefused(t *testing.T) {
+	prm := newRecoveryPRM()
+
+	value, err := prm.hashRecovery("abc123", "abcde-fghjk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := &ldap.Entry{DN: "uid=abc123,ou=People,dc=example",
+		Attributes: []*ldap.EntryAttribute{{Name: "prmRecoveryCode", Values: []string{value}}}}
+
+	test_map := map[string]string{
+		"abc123": "abcde-fghjm",
+		"def456": "abcde-fghjk",
+	}
+
+	for username, code := range test_map {
+		if prm.findRecoveryCode(username, entry, code) != "" {
+			t.Error("For:", username, code, "got a match")
+		}
+	}
+
+	if prm.findRecoveryCode("abc123", entry, "abcde-fghjk") != value {
+		t.Error("For: abcde-fghjk got no match")
+	}
+
+	prm.Config.RecoveryAttribute = ""
+	if prm.findRecoveryCode("abc123", entry, "abcde-fghjk") != "" {
+		t.Error("For: feature off got a match")
+	}
+
+	// Anything that isn't a recovery code is checked as a one-time code
+	conn := &otpConn{entry: entry}
+	if result, code := prm.checkUnlockCode("abc123", entry, "abcde-fghjk", "", conn, nil); result || code != ErrorOTP {
+		t.Error("For: feature off got:", result, code)
+	}
+}
+
+// Test codes stop being checked once too many have been tried for a user,
+// even when the user has no one-time code to cancel
+func TestUnlockCodeLimit(t *testing.T) {
+	prm, cleanup := newNotifyPRM(t)
+	defer cleanup()
+	prm.Config.RecoveryAttribute = "prmRecoveryCode"
+
+	value, err := prm.hashRecovery("abc123", "abcde-fghjk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := notifyEntry(&ldap.EntryAttribute{Name: "prmRecoveryCode", Values: []string{value}})
+	conn := &otpConn{entry: entry}
+
+	for i := 0; i < unlockMaxTries; i++ {
+		if ok, code := prm.checkUnlockCode("abc123", entry, "abcde-fghjm", "", conn, nil); ok || code != ErrorOTP {
+			t.Fatal("For: wrong code", i, "got:", ok, code)
+		}
+	}
+
+	if ok, code := prm.checkUnlockCode("abc123", entry, "abcde-fghjk", "", conn, nil); ok || code != ErrorUnlockLimited {
+		t.Error("For: right code after the limit got:", ok, code)
+	}
+	if conn.modified != nil {
+		t.Error("For: right code after the limit got a modify")
+	}
+
+	// Other users are unaffected
+	if ok, code := prm.checkUnlockCode("def456", entry, "abcde-fghjm", "", conn, nil); ok || code != ErrorOTP {
+		t.Error("For: another user got:", ok, code)
+	}
+}
@@ -0,0 +1,156 @@
+package prm
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The replay cache records the nonce of every session token once it has been
+// used, so a captured terms form can't be sent again to set the password
+// back to a known value. Like pending changes it can be kept in a directory
+// shared by all the FastCGI processes, or in memory for a single process.
+
+// ErrTokenReplayed is returned when a session token has already been used
+var ErrTokenReplayed = errors.New("token has already been used")
+
+// expireInterval is how often a cache clears out ids that have expired.
+// Clearing out means looking at everything in it, so it isn't done on every
+// use. A file cache may also treat an id as used for up to this long after it
+// expires
+const expireInterval = time.Minute
+
+// ReplayCache remembers ids until they expire
+type ReplayCache interface {
+	// Use records the id, returning ErrTokenReplayed if it was already there
+	Use(id string, expires time.Time) error
+}
+
+// memoryReplayCache keeps used ids in a map in this process
+type memoryReplayCache struct {
+	sync.Mutex
+	used    map[string]time.Time
+	expired time.Time
+}
+
+// memoryReplay is shared by every PRM in the process that has no replay directory
+var memoryReplay = &memoryReplayCache{used: make(map[string]time.Time)}
+
+// Use records the id, now and then clearing out any that have expired
+func (c *memoryReplayCache) Use(id string, expires time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.expired) >= expireInterval {
+		for k, v := range c.used {
+			if now.After(v) {
+				delete(c.used, k)
+			}
+		}
+		c.expired = now
+	}
+
+	if v, ok := c.used[id]; ok && !now.After(v) {
+		return ErrTokenReplayed
+	}
+	c.used[id] = expires
+	return nil
+}
+
+// fileReplayCache records each used id as a file in a directory. Creating the
+// file exclusively is atomic, so two processes can't both use the same id.
+// The file's modification time is set to when the id expires, so expired
+// ones can be found from the directory listing alone
+type fileReplayCache struct {
+	dir string
+}
+
+// fileExpired is when this process last cleared out each directory
+var fileExpired = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+// Use creates a file for the id, failing if it already exists
+func (c fileReplayCache) Use(id string, expires time.Time) error {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return ErrTokenInvalid
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	c.expire()
+
+	path := filepath.Join(c.dir, id)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) && c.expired(path) {
+		os.Remove(path)
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if os.IsExist(err) {
+		return ErrTokenReplayed
+	}
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return os.Chtimes(path, expires, expires)
+}
+
+// expired checks if the file for an id expired long enough ago that it can't
+// be one just created whose expiry hasn't been set yet
+func (c fileReplayCache) expired(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) > expireInterval
+}
+
+// expire removes ids whose tokens could no longer be used anyway, at most
+// once every expireInterval
+func (c fileReplayCache) expire() {
+	fileExpired.Lock()
+	now := time.Now()
+	due := now.Sub(fileExpired.at[c.dir]) >= expireInterval
+	if due {
+		fileExpired.at[c.dir] = now
+	}
+	fileExpired.Unlock()
+
+	if !due {
+		return
+	}
+
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	// A file only just created has not had its expiry set yet, so anything
+	// that looks to have expired within the last interval is left be
+	for _, f := range files {
+		if now.Sub(f.ModTime()) > expireInterval {
+			os.Remove(filepath.Join(c.dir, f.Name()))
+		}
+	}
+}
+
+// replayCache returns the configured replay cache
+func (prm *PRM) replayCache() ReplayCache {
+	if prm.Config.ReplayPath != "" {
+		return fileReplayCache{prm.Config.ReplayPath}
+	}
+	return memoryReplay
+}
+
+// UseSessionToken marks a verified token as used. It returns ErrTokenReplayed
+// if the token has been used before
+func (prm *PRM) UseSessionToken(token SessionToken) error {
+	expires := time.Unix(token.Issued+prm.sessionTimeout(), 0)
+	return prm.replayCache().Use(token.Nonce, expires)
+}
@@ -0,0 +1,98 @@
+package prm
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Test both caches refuse an id the second time and forget expired ones
+func TestReplayCaches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caches := map[string]ReplayCache{
+		"memory": &memoryReplayCache{used: make(map[string]time.Time)},
+		"file":   fileReplayCache{dir},
+	}
+
+	for name, cache := range caches {
+		if err := cache.Use("00ff", time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(name, "first Use failed:", err)
+		}
+
+		if err := cache.Use("00ff", time.Now().Add(time.Minute)); err != ErrTokenReplayed {
+			t.Error(name, "second Use should be a replay, got:", err)
+		}
+
+		cache.Use("aa11", time.Now().Add(-time.Hour))
+		cache.Use("bb22", time.Now().Add(time.Minute))
+		if err := cache.Use("aa11", time.Now().Add(time.Minute)); err != nil {
+			t.Error(name, "expired id should have been forgotten, got:", err)
+		}
+	}
+}
+
+// Test the file cache keeps each id's expiry as its modification time and
+// clears out expired ones from the listing alone
+func TestFileReplayExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := fileReplayCache{dir}
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	cache.Use("00ff", expires)
+	cache.Use("aa11", time.Now().Add(-time.Hour))
+
+	if info, err := os.Stat(dir + "/00ff"); err != nil || !info.ModTime().Equal(expires) {
+		t.Error("For: modification time got:", info, err)
+	}
+
+	fileExpired.Lock()
+	fileExpired.at[dir] = time.Time{}
+	fileExpired.Unlock()
+	cache.expire()
+
+	if _, err := os.Stat(dir + "/aa11"); !os.IsNotExist(err) {
+		t.Error("For: expired id got:", err)
+	}
+	if _, err := os.Stat(dir + "/00ff"); err != nil {
+		t.Error("For: live id got:", err)
+	}
+}
+
+// Test ids that could escape the replay directory are refused
+func TestReplayID(t *testing.T) {
+	cache := fileReplayCache{os.TempDir()}
+
+	if err := cache.Use("../../etc/passwd", time.Now()); err != ErrTokenInvalid {
+		t.Error("Expected ErrTokenInvalid for a bad id, got:", err)
+	}
+}
+
+// Test a session token can only be used once
+func TestUseSessionToken(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	nonce, _ := newPendingID()
+	token := SessionToken{Username: "abc123", Nonce: nonce, Issued: time.Now().Unix()}
+
+	if err := prm.UseSessionToken(token); err != nil {
+		t.Error("First use failed:", err)
+	}
+
+	if err := prm.UseSessionToken(token); err != ErrTokenReplayed {
+		t.Error("Expected ErrTokenReplayed, got:", err)
+	}
+
+	if code := tokenResult(ErrTokenReplayed); code != ErrorTokenReplayed {
+		t.Error("For: ErrTokenReplayed got:", code)
+	}
+}
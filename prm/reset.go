@@ -0,0 +1,295 @@
+package prm
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"gopkg.in/ldap.v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Users who have forgotten their password can ask for a reset link. The link
+// carries a sealed ResetToken and lands on a form for the new password, which
+// goes through the same checks as any other change. Opening the link uses
+// nothing up, as mail scanners often fetch links before the user does; the
+// token is only marked used once a new password has been accepted.
+//
+// The answer to a request is the same whether or not the user exists or has
+// an address, so the form can't be used to find out who has an account. What
+// actually happened is recorded in the audit log.
+
+// defaultResetTimeout is how long, in seconds, a reset link lasts if no
+// timeout is configured
+const defaultResetTimeout = 900
+
+// resetInterval is how long a user must wait between reset emails, so the
+// form can't be used to flood their inbox
+const resetInterval = 5 * time.Minute
+
+// ResetToken is sealed into the link emailed to a user who has forgotten
+// their password
+type ResetToken struct {
+	Username string `json:"u"`
+	Issued   int64  `json:"t"`
+	Nonce    string `json:"n"`
+}
+
+// resetTimeout is how long a reset link lasts
+func (prm *PRM) resetTimeout() int64 {
+	if prm.Config.ResetTimeout > 0 {
+		return int64(prm.Config.ResetTimeout)
+	}
+	return defaultResetTimeout
+}
+
+// resetEmailAttribute is the attribute holding the address reset links are
+// sent to
+func (prm *PRM) resetEmailAttribute() string {
+	if prm.Config.ResetEmailAttribute != "" {
+		return prm.Config.ResetEmailAttribute
+	}
+	return "mail"
+}
+
+// ResetEnabled checks if users can ask for a reset link
+func (prm *PRM) ResetEnabled() bool {
+	return prm.Config.ResetURL != ""
+}
+
+// NewResetToken seals a new reset token for a user
+func (prm *PRM) NewResetToken(username string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	token := ResetToken{
+		Username: username,
+		Issued:   time.Now().Unix(),
+		Nonce:    hex.EncodeToString(nonce),
+	}
+
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+
+	return prm.sealKeyed(ufferReset, plaintext)
+}
+
+// VerifyResetToken opens a sealed reset token and checks it has not expired.
+// It does not check whether the token has been used
+func (prm *PRM) VerifyResetToken(sealed string) (ResetToken, error) {
+	var token ResetToken
+
+	plaintext, err := prm.openKeyed(ufferReset, sealed)
+	if err != nil {
+		return token, ErrTokenInvalid
+	}
+
+	if err := json.Unmarshal(plaintext, &token); err != nil || token.Username == "" || token.Nonce == "" {
+		return token, ErrTokenInvalid
+	}
+
+	if time.Now().Unix()-token.Issued > prm.resetTimeout() {
+		return token, ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+// resetLink builds the link for a sealed token
+func (prm *PRM) resetLink(sealed string) (string, error) {
+	link, err := url.Parse(prm.Config.ResetURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := link.Query()
+	query.Set("reset", sealed)
+	link.RawQuery = query.Encode()
+	return link.String(), nil
+}
+
+// resetThrottleID is the replay cache id used to limit how often a user is
+// sent a link. The username is hashed as it may not be safe as a file name
+func resetThrottleID(username string) string {
+	sum := sha256.Sum256([]byte("reset\n" + username))
+	return hex.EncodeToString(sum[:16])
+}
+
+// ProcessForgot handles a request for a reset link. Unless the request itself
+// is bad the result is always SuccessResetSent
+func (prm *PRM) ProcessForgot(r *http.Request) Result {
+	r.ParseForm()
+
+	if !prm.checkCSRF(r) {
+		return Result{ErrorCSRF}
+	}
+
+	if !prm.ResetEnabled() {
+		return Result{ErrorNotImplemented}
+	}
+
+	username := strings.TrimSpace(strings.Join(r.Form["user"], ""))
+
+	if err := prm.sendResetLink(username, r); err != nil {
+		prm.AuditPRM("reset-not-sent", username, r, "reason="+err.Error())
+	}
+
+	return Result{SuccessResetSent}
+}
+
+// sendResetLink emails a reset link to a user if they can have one. The email
+// goes through the queue so the time taken doesn't give away whether the user
+// exists
+func (prm *PRM) sendResetLink(username string, r *http.Request) error {
+	// Anything that could change the meaning of the search is refused
+	if username == "" || ldap.EscapeFilter(username) != username {
+		return ErrNoUser
+	}
+
+	conn, err := prm.ldapConnect()
+	if err != nil || conn == nil {
+		return errors.New("could not connect to LDAP")
+	}
+	defer conn.Close()
+
+	if err := prm.ldapBindAdmin(conn); err != nil {
+		prm.LogPRM(err.Error(), LOG_ERROR)
+		return errors.New("could not bind to LDAP")
+	}
+
+	name, address, err := prm.lookupEmail(username, prm.resetEmailAttribute(), conn)
+	if err != nil {
+		return err
+	}
+	if address == "" {
+		return errors.New("no " + prm.resetEmailAttribute())
+	}
+
+	if err := prm.replayCache().Use(resetThrottleID(username), time.Now().Add(resetInterval)); err != nil {
+		return errors.New("a link was sent recently")
+	}
+
+	sealed, err := prm.NewResetToken(username)
+	if err != nil {
+		prm.LogPRM("NewResetToken Error: "+err.Error(), LOG_ERROR)
+		return err
+	}
+
+	link, err := prm.resetLink(sealed)
+	if err != nil {
+		prm.LogPRM("resetLink Error: "+err.Error(), LOG_ERROR)
+		return err
+	}
+
+	expires := time.Now().Add(time.Duration(prm.resetTimeout()) * time.Second)
+
+	legacy := prm.Config.ResetEmailMsg
+	if legacy == "" {
+		legacy = "Dear %NAME%\n\nSomeone, hopefully you, asked to reset your password. To choose a new one follow this link before %EXPIRES%:\n\n%LINK%\n\nIf you did not ask for this you can ignore this email.\n"
+	}
+
+	subject := prm.Config.ResetEmailSub
+	if subject == "" {
+		subject = "Reset your password"
+	}
+
+	data := NewEmailData(prm.Config, username, name, r)
+	data.Link = link
+	data.Expires = emailTime(prm.Config, data.Lang, expires)
+
+	email, err := RenderEmail(prm.Config, "reset", address, subject, legacy, data)
+	if err != nil {
+		prm.LogPRM("RenderEmail Error: "+err.Error(), LOG_ERROR)
+		return err
+	}
+
+	if err := prm.QueueEmail(email); err != nil {
+		prm.LogPRM("QueueEmail Error: "+err.Error(), LOG_ERROR)
+		return err
+	}
+
+	prm.AuditPRM("reset-sent", username, r)
+	return nil
+}
+
+// ProcessReset handles the form a reset link lands on. The new password goes
+// through the same checks as on the first form and, if the user has an
+// authenticator app, a code from it is needed too. Once they pass the link is
+// used up and a session token is returned, just as ProcessForm does, so the
+// change is finished by ProcessSkipped or ProcessTerms
+func (prm *PRM) ProcessReset(r *http.Request) (result Result, data map[string]string) {
+	r.ParseForm()
+
+	if !prm.checkCSRF(r) {
+		return Result{ErrorCSRF}, nil
+	}
+
+	if !prm.ResetEnabled() {
+		return Result{ErrorNotImplemented}, nil
+	}
+
+	token, err := prm.VerifyResetToken(strings.Join(r.Form["reset"], ""))
+	if err != nil {
+		prm.LogPRM("VerifyResetToken Warning: "+err.Error(), LOG_WARN)
+		return Result{ErrorResetLink}, nil
+	}
+
+	conn, err := prm.Connect()
+	if err != nil {
+		prm.LogPRM(err.Error(), LOG_ERROR)
+		return Result{ErrorFatal}, nil
+	}
+	defer conn.Close()
+
+	username := token.Username
+	entry := prm.SearchUsername(username, conn)
+	if entry == nil {
+		return Result{ErrorResetLink}, nil
+	}
+
+	p1 := strings.Join(r.Form["p1"], "")
+	p2 := strings.Join(r.Form["p2"], "")
+
+	if result, data := prm.checkNewPassword(username, p1, p2); result.Message != Success {
+		return result, data
+	}
+
+	// A reset link is no stronger than the old password, so users with an
+	// authenticator still need it
+	if code := prm.CheckTOTP(username, entry, strings.Join(r.Form["totp"], ""), conn, r); code != Success {
+		return Result{code}, nil
+	}
+
+	if result, data := prm.checkPersonalPassword(username, entry, "", p1); result.Message != Success {
+		return result, data
+	}
+
+	if err := prm.replayCache().Use(token.Nonce, time.Unix(token.Issued+prm.resetTimeout(), 0)); err != nil {
+		prm.AuditPRM("reset-link-replayed", username, r, "nonce="+token.Nonce)
+		return Result{ErrorResetLink}, nil
+	}
+	prm.AuditPRM("reset-link-used", username, r)
+
+	sealed, err := prm.NewSessionToken(username, p1, r)
+	if err != nil {
+		prm.LogPRM("NewSessionToken Error: "+err.Error(), LOG_ERROR)
+		return Result{ErrorFatal}, nil
+	}
+
+	m := make(map[string]string)
+	m["token"] = sealed
+	m["username"] = username
+	if prm.TermsRequired(entry, true) {
+		m["terms"] = "true"
+	}
+
+	return Result{Success}, m
+}
@@ -0,0 +1,152 @@
+package prm
+
+import (
+	"encoding/json"
+	"gopkg.in/ldap.v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newResetPRM() *PRM {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.Uffer = "0123456789ABCDEF"
+	prm.Config.ResetURL = "https://pass.example.com/reset"
+	return prm
+}
+
+// Test a reset token round trips and expires
+func TestResetToken(t *testing.T) {
+	prm := newResetPRM()
+
+	sealed, err := prm.NewResetToken("abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := prm.VerifyResetToken(sealed)
+	if err != nil || token.Username != "abc123" {
+		t.Fatal("VerifyResetToken got:", token, err)
+	}
+
+	if _, err := prm.VerifyResetToken(tamperUffer(t, sealed)); err != ErrTokenInvalid {
+		t.Error("For: tampered token got:", err)
+	}
+
+	old, _ := json.Marshal(ResetToken{Username: "abc123", Issued: time.Now().Unix() - 3600, Nonce: "00ff"})
+	expired, _ := prm.sealKeyed(ufferReset, old)
+	if _, err := prm.VerifyResetToken(expired); err != ErrTokenExpired {
+		t.Error("For: expired token got:", err)
+	}
+}
+
+// Test a session token can't be used as a reset link
+func TestResetTokenPurpose(t *testing.T) {
+	prm := newResetPRM()
+	req := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{"User-Agent": {"test"}}}
+
+	session, err := prm.NewSessionToken("abc123", "n4klxui!Q", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := prm.VerifyResetToken(session); err != ErrTokenInvalid {
+		t.Error("For: session token got:", err)
+	}
+}
+
+// Test the link keeps the configured address and carries the token
+func TestResetLink(t *testing.T) {
+	prm := newResetPRM()
+	prm.Config.ResetURL = "https://pass.example.com/reset?lang=en"
+
+	sealed, _ := prm.NewResetToken("abc123")
+	link, err := prm.resetLink(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _ := url.Parse(link)
+	if parsed.Host != "pass.example.com" || parsed.Path != "/reset" || parsed.Query().Get("lang") != "en" || parsed.Query().Get("reset") != sealed {
+		t.Error("For:", sealed, "got:", link)
+	}
+}
+
+// Test the answer to a request is the same whatever the username, and that
+// the feature is off without a reset url
+func TestProcessForgot(t *testing.T) {
+	prm := newResetPRM()
+
+	for _, username := range []string{"abc123", "nobody", "*", "abc)(uid=*", ""} {
+		w := httptest.NewRecorder()
+		csrf, _ := prm.CSRFToken(w, httptest.NewRequest("GET", "https://pass.example.com/forgot", nil))
+
+		form := url.Values{"user": {username}, csrfField: {csrf}}
+		r := httptest.NewRequest("POST", "https://pass.example.com/forgot/send", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "https://pass.example.com")
+		r.AddCookie(&http.Cookie{Name: csrfCookie, Value: csrf})
+
+		if result := prm.ProcessForgot(r); result.Message != SuccessResetSent {
+			t.Error("For:", username, "got:", result.ToString())
+		}
+	}
+
+	prm.Config.ResetURL = ""
+	r := httptest.NewRequest("POST", "https://pass.example.com/forgot/send", nil)
+	if result := prm.ProcessForgot(r); result.Message == SuccessResetSent {
+		t.Error("For: no reset url got:", result.ToString())
+	}
+}
+
+// Test a good reset link with LDAP out of reach is an error, not a crash
+func TestProcessResetNoLDAP(t *testing.T) {
+	prm := newResetPRM()
+	prm.Config.CertFilePath = "/nonexistent/ca.pem"
+
+	sealed, _ := prm.NewResetToken("abc123")
+	w := httptest.NewRecorder()
+	csrf, _ := prm.CSRFToken(w, httptest.NewRequest("GET", "https://pass.example.com/reset", nil))
+
+	form := url.Values{"reset": {sealed}, "p1": {"n4klxui!Q2w"}, "p2": {"n4klxui!Q2w"}, csrfField: {csrf}}
+	r := httptest.NewRequest("POST", "https://pass.example.com/reset", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "https://pass.example.com")
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: csrf})
+
+	if result, _ := prm.ProcessReset(r); result.Message != ErrorFatal {
+		t.Error("For: no LDAP got:", result.ToString())
+	}
+}
+
+// Test the address comes from the attribute asked for
+func TestLookupEmail(t *testing.T) {
+	prm := newResetPRM()
+	conn := &otpConn{entry: &ldap.Entry{DN: "uid=abc123,ou=People,dc=example",
+		Attributes: []*ldap.EntryAttribute{
+			{Name: "givenName", Values: []string{"Alice"}},
+			{Name: "mail", Values: []string{"alice@example.com"}},
+			{Name: "prmAlternateMail", Values: []string{"alice@example.org"}},
+		}}}
+
+	test_map := map[string]string{
+		"mail":             "alice@example.com",
+		"prmAlternateMail": "alice@example.org",
+		"missing":          "",
+	}
+
+	for attribute, expected := range test_map {
+		name, address, err := prm.lookupEmail("abc123", attribute, conn)
+		if err != nil || name != "Alice" || address != expected {
+			t.Error("For:", attribute, "got:", name, address, err)
+		}
+	}
+
+	if _, _, err := prm.lookupEmail("nobody", "mail", &otpConn{}); err != ErrNoUser {
+		t.Error("For: nobody got:", err)
+	}
+}
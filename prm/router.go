@@ -0,0 +1,128 @@
+package prm
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// defaultMaxRequestBytes is the largest request body accepted if no limit is
+// configured. The forms are a few hundred bytes at most
+const defaultMaxRequestBytes = 64 * 1024
+
+// credentialFields are form fields that must never be sent in a query
+// string, where they would end up in access logs and browser history
+var credentialFields = []string{"user", "p0", "p1", "p2", "otp", "password", "token", "csrf"}
+
+// HandlerFunc is the signature of the page handlers in prm_server
+type HandlerFunc func(w http.ResponseWriter, r *http.Request, p *PRM)
+
+// route is a handler and the methods it accepts
+type route struct {
+	methods []string
+	handler HandlerFunc
+}
+
+// Router sends requests to handlers by exact path, refusing methods a path
+// does not accept, oversized bodies and credentials in query strings
+type Router struct {
+	PRM    *PRM
+	routes map[string]route
+}
+
+// NewRouter creates an empty router for the given PRM
+func NewRouter(p *PRM) *Router {
+	return &Router{PRM: p, routes: make(map[string]route)}
+}
+
+// Handle adds a handler for a path, accepting only the methods given
+func (rt *Router) Handle(path string, handler HandlerFunc, methods ...string) {
+	rt.routes[path] = route{methods, handler}
+}
+
+// maxRequestBytes returns the configured body size limit
+func (prm *PRM) maxRequestBytes() int64 {
+	if prm.Config.MaxRequestBytes > 0 {
+		return prm.Config.MaxRequestBytes
+	}
+	return defaultMaxRequestBytes
+}
+
+// CredentialsInQuery checks a request for credentials in its query string
+func CredentialsInQuery(r *http.Request) bool {
+	query := r.URL.Query()
+	for _, field := range credentialFields {
+		if _, ok := query[field]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed checks if a route accepts a method
+func (rt route) allowed(method string) bool {
+	for _, m := range rt.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP checks the request against the route and passes it on
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := rt.PRM
+
+	route, ok := rt.routes[r.URL.Path]
+	if !ok {
+		p.LogPRM("Path not found: "+r.URL.Path, LOG_DEBUG)
+		p.NotFound(w, r)
+		return
+	}
+
+	if !route.allowed(r.Method) {
+		methods := append([]string(nil), route.methods...)
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The password is already in the access log by now, but at least it
+	// goes no further and the user learns not to do it again
+	if CredentialsInQuery(r) {
+		p.AuditPRM("credentials-in-query", r.URL.Query().Get("user"), r, "path="+r.URL.Path)
+		http.Error(w, "Credentials must not be sent in the URL", http.StatusBadRequest)
+		return
+	}
+
+	if r.ContentLength > p.maxRequestBytes() {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, p.maxRequestBytes())
+
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			p.LogPRM("ParseForm Warning: "+err.Error(), LOG_WARN)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	route.handler(w, r, p)
+}
+
+// NotFound renders the notfound.html template with a 404 status, falling
+// back to a plain 404 if the template is missing
+func (prm *PRM) NotFound(w http.ResponseWriter, r *http.Request) {
+	t, err := prm.Template(r, prm.Language(w, r), "notfound.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	t.Execute(w, map[string]string{"Title": "Page not found", "Path": r.URL.Path})
+}
@@ -0,0 +1,110 @@
+package prm
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestRouter() (*Router, *int) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.MaxRequestBytes = 100
+	prm.Config.TemplatePath = os.TempDir() + "/no-such-templates/"
+
+	called := 0
+	handler := func(w http.ResponseWriter, r *http.Request, p *PRM) {
+		called++
+	}
+
+	router := NewRouter(prm)
+	router.Handle("/", handler, "GET", "HEAD")
+	router.Handle("/change", handler, "POST")
+	return router, &called
+}
+
+// Test requests are routed, or refused with the right status
+func TestRouter(t *testing.T) {
+	router, called := newTestRouter()
+
+	test_map := []struct {
+		method string
+		target string
+		body   string
+		status int
+		routed bool
+	}{
+		{"GET", "/", "", http.StatusOK, true},
+		{"POST", "/change", "user=abc123", http.StatusOK, true},
+		{"GET", "/change", "", http.StatusMethodNotAllowed, false},
+		{"POST", "/", "", http.StatusMethodNotAllowed, false},
+		{"GET", "/nowhere", "", http.StatusNotFound, false},
+		{"POST", "/change?user=abc123&p0=secret", "", http.StatusBadRequest, false},
+		{"GET", "/?otp=123456", "", http.StatusBadRequest, false},
+		{"POST", "/change", "user=" + strings.Repeat("a", 200), http.StatusRequestEntityTooLarge, false},
+	}
+
+	for _, test := range test_map {
+		*called = 0
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		if w.Code != test.status || (*called == 1) != test.routed {
+			t.Error("For:", test.method, test.target, "got:", w.Code, *called)
+		}
+	}
+}
+
+// Test a 405 lists the allowed methods
+func TestRouterAllow(t *testing.T) {
+	router, _ := newTestRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/", nil))
+
+	if w.Header().Get("Allow") != "GET, HEAD" {
+		t.Error("For: DELETE / got Allow:", w.Header().Get("Allow"))
+	}
+}
+
+// Test a body without a length is still cut off at the limit
+func TestRouterChunkedBody(t *testing.T) {
+	router, called := newTestRouter()
+
+	r := httptest.NewRequest("POST", "/change", ioutil.NopCloser(strings.NewReader("user="+strings.Repeat("a", 200))))
+	r.ContentLength = -1
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest || *called != 0 {
+		t.Error("For: chunked body got:", w.Code, *called)
+	}
+}
+
+// Test the 404 template is used when there is one
+func TestNotFoundTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/notfound.html", []byte("missing {{.Path}}"), 0600)
+
+	router, _ := newTestRouter()
+	router.PRM.Config.TemplatePath = dir + "/"
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/nowhere", nil))
+
+	if w.Code != http.StatusNotFound || w.Body.String() != "missing /nowhere" {
+		t.Error("For: /nowhere got:", w.Code, w.Body.String())
+	}
+}
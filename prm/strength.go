@@ -0,0 +1,656 @@
+package prm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The strength estimator is a cut down take on Dropbox's zxcvbn. A password
+// is broken into patterns an attacker would try first (common words, keyboard
+// runs, sequences, repeats and dates), each pattern is given a number of
+// guesses and the cheapest way of covering the whole password is taken as its
+// strength. Anything not covered by a pattern is assumed to be brute forced.
+
+// Strength is the result of estimating how hard a password is to guess
+type Strength struct {
+	Score       int      `json:"score"`
+	Guesses     float64  `json:"guesses"`
+	CrackTime   string   `json:"crack_time"`
+	Warning     string   `json:"warning"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// strengthMatch is one pattern found within a password, from i to j inclusive
+type strengthMatch struct {
+	pattern string
+	i, j    int
+	token   string
+	rank    int
+	guesses float64
+
+	reversed bool
+	l33t     bool
+}
+
+const (
+	bruteforceCardinality = 10
+	minSubmatchGuesses    = 50
+	guessesPerSecond      = 1e4 // offline attack on a slow hash
+	maxEstimateLength     = 100
+)
+
+var rankedWords = buildRankedWords(commonPasswords)
+
+// buildRankedWords turns a whitespace separated list into a rank lookup
+func buildRankedWords(words string) map[string]int {
+	ranked := make(map[string]int)
+	for i, word := range strings.Fields(words) {
+		if _, ok := ranked[word]; !ok {
+			ranked[word] = i + 1
+		}
+	}
+	return ranked
+}
+
+var l33tTable = map[rune][]rune{
+	'4': {'a'}, '@': {'a'}, '8': {'b'}, '(': {'c'}, '{': {'c'}, '3': {'e'},
+	'6': {'g'}, '9': {'g'}, '1': {'i', 'l'}, '!': {'i'}, '|': {'i', 'l'},
+	'0': {'o'}, '$': {'s'}, '5': {'s'}, '7': {'t'}, '+': {'t'}, '2': {'z'},
+}
+
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+var keyboardShifted = map[rune]rune{
+	'~': '`', '!': '1', '@': '2', '#': '3', '$': '4', '%': '5', '^': '6',
+	'&': '7', '*': '8', '(': '9', ')': '0', '_': '-', '+': '=', '{': '[',
+	'}': ']', '|': '\\', ':': ';', '"': '\'', '<': ',', '>': '.', '?': '/',
+}
+
+type keyPosition struct {
+	row, col int
+}
+
+var keyboardPositions = buildKeyboardPositions()
+
+func buildKeyboardPositions() map[rune]keyPosition {
+	positions := make(map[rune]keyPosition)
+	for row, keys := range keyboardRows {
+		for col, key := range keys {
+			positions[key] = keyPosition{row, col}
+		}
+	}
+	return positions
+}
+
+// keyAt returns the unshifted key position of a character
+func keyAt(c rune) (keyPosition, bool) {
+	if c >= 'A' && c <= 'Z' {
+		c = c - 'A' + 'a'
+	}
+	if unshifted, ok := keyboardShifted[c]; ok {
+		c = unshifted
+	}
+	pos, ok := keyboardPositions[c]
+	return pos, ok
+}
+
+// keyDirection returns the direction taken from one key to the next, or false
+// if the keys are not neighbours on a staggered qwerty keyboard
+func keyDirection(a, b keyPosition) (keyPosition, bool) {
+	d := keyPosition{b.row - a.row, b.col - a.col}
+	switch d {
+	case keyPosition{0, -1}, keyPosition{0, 1},
+		keyPosition{-1, 0}, keyPosition{-1, 1},
+		keyPosition{1, -1}, keyPosition{1, 0}:
+		return d, true
+	}
+	return d, false
+}
+
+// binomial is n choose k as a float
+func binomial(n, k int) float64 {
+	if k > n {
+		return 0
+	}
+	if k == 0 {
+		return 1
+	}
+	r := 1.0
+	for d := 1; d <= k; d++ {
+		r *= float64(n)
+		r /= float64(d)
+		n--
+	}
+	return r
+}
+
+// uppercaseVariations estimates the extra guesses caused by capitals
+func uppercaseVariations(word string) float64 {
+	lower := asciiLower(word)
+	if word == lower {
+		return 1
+	}
+
+	upper := asciiUpper(word)
+	if word == upper || (word[:1] == upper[:1] && word[1:] == lower[1:]) ||
+		(word[len(word)-1:] == upper[len(word)-1:] && word[:len(word)-1] == lower[:len(word)-1]) {
+		return 2
+	}
+
+	u, l := 0, 0
+	for _, c := range word {
+		if c >= 'A' && c <= 'Z' {
+			u++
+		} else if c >= 'a' && c <= 'z' {
+			l++
+		}
+	}
+
+	variations := 0.0
+	for i := 1; i <= u && i <= l; i++ {
+		variations += binomial(u+l, i)
+	}
+	return math.Max(variations, 1)
+}
+
+// asciiLower lowercases A-Z only, a byte at a time, so byte offsets into the
+// result line up with the original password whatever else is in it
+func asciiLower(password string) string {
+	b := []byte(password)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// asciiUpper uppercases a-z only, in the same way as asciiLower
+func asciiUpper(password string) string {
+	b := []byte(password)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	return string(b)
+}
+
+// unl33t returns the plain versions of a password with l33t substitutions
+// undone, along with the number of characters substituted
+func unl33t(password string) ([]string, int) {
+	variants := []string{""}
+	subs := 0
+
+	for _, c := range password {
+		replacements, ok := l33tTable[c]
+		if !ok {
+			for i := range variants {
+				variants[i] += string(c)
+			}
+			continue
+		}
+
+		subs++
+		var next []string
+		for _, v := range variants {
+			for _, r := range replacements {
+				next = append(next, v+string(r))
+			}
+		}
+		// Keep the number of variants from blowing up on symbol heavy passwords
+		if len(next) > 16 {
+			next = next[:16]
+		}
+		variants = next
+	}
+
+	return variants, subs
+}
+
+// dictionaryMatches finds common words, their reversals and l33t versions
+func dictionaryMatches(password string, ranked map[string]int) []strengthMatch {
+	var matches []strengthMatch
+	lower := asciiLower(password)
+	n := len(lower)
+
+	reversed := []byte(lower)
+	for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+
+	variants, subs := unl33t(lower)
+
+	for i := 0; i < n; i++ {
+		for j := i + 2; j < n; j++ {
+			token := password[i : j+1]
+
+			if rank, ok := ranked[lower[i:j+1]]; ok {
+				matches = append(matches, strengthMatch{pattern: "dictionary", i: i, j: j, token: token, rank: rank,
+					guesses: float64(rank) * uppercaseVariations(token)})
+			}
+
+			if rank, ok := ranked[string(reversed[n-1-j:n-i])]; ok {
+				matches = append(matches, strengthMatch{pattern: "dictionary", i: i, j: j, token: token, rank: rank,
+					guesses: float64(rank) * uppercaseVariations(token) * 2, reversed: true})
+			}
+
+			if subs == 0 {
+				continue
+			}
+			for _, v := range variants {
+				if len(v) != n || v[i:j+1] == lower[i:j+1] {
+					continue
+				}
+				if rank, ok := ranked[v[i:j+1]]; ok {
+					matches = append(matches, strengthMatch{pattern: "dictionary", i: i, j: j, token: token, rank: rank,
+						guesses: float64(rank) * uppercaseVariations(token) * 2, l33t: true})
+					break
+				}
+			}
+		}
+	}
+
+	return matches
+}
+
+// spatialMatches finds runs of three or more neighbouring keys
+func spatialMatches(password string) []strengthMatch {
+	var matches []strengthMatch
+	n := len(password)
+
+	const startingPositions = 94.0
+	const averageDegree = 4.6
+
+	i := 0
+	for i < n-2 {
+		j := i
+		turns := 0
+		var last keyPosition
+		for j+1 < n {
+			a, okA := keyAt(rune(password[j]))
+			b, okB := keyAt(rune(password[j+1]))
+			if !okA || !okB {
+				break
+			}
+			d, ok := keyDirection(a, b)
+			if !ok {
+				break
+			}
+			if j == i || d != last {
+				turns++
+			}
+			last = d
+			j++
+		}
+
+		if j-i+1 >= 3 {
+			length := j - i + 1
+			guesses := 0.0
+			for l := 2; l <= length; l++ {
+				for t := 1; t <= turns && t <= l-1; t++ {
+					guesses += binomial(l-1, t-1) * startingPositions * math.Pow(averageDegree, float64(t))
+				}
+			}
+			matches = append(matches, strengthMatch{pattern: "spatial", i: i, j: j, token: password[i : j+1], guesses: guesses})
+			i = j
+			continue
+		}
+		i++
+	}
+
+	return matches
+}
+
+// sequenceMatches finds runs such as abcd, 4321 or STUV
+func sequenceMatches(password string) []strengthMatch {
+	var matches []strengthMatch
+	n := len(password)
+
+	i := 0
+	for i < n-2 {
+		delta := int(password[i+1]) - int(password[i])
+		if delta != 1 && delta != -1 {
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j+1 < n && int(password[j+1])-int(password[j]) == delta {
+			j++
+		}
+
+		if j-i+1 >= 3 {
+			first := password[i]
+			base := 26.0
+			switch {
+			case first == 'a' || first == 'A' || first == 'z' || first == 'Z' || first == '0' || first == '1' || first == '9':
+				base = 4
+			case first >= '0' && first <= '9':
+				base = 10
+			}
+			if delta < 0 {
+				base *= 2
+			}
+			matches = append(matches, strengthMatch{pattern: "sequence", i: i, j: j, token: password[i : j+1], guesses: base * float64(j-i+1)})
+			i = j
+			continue
+		}
+		i++
+	}
+
+	return matches
+}
+
+// repeatMatches finds a base string repeated two or more times, or a single
+// character repeated three or more times
+func repeatMatches(password string, ranked map[string]int) []strengthMatch {
+	var matches []strengthMatch
+	n := len(password)
+
+	for i := 0; i < n; i++ {
+		best := strengthMatch{}
+		for l := 1; i+2*l <= n; l++ {
+			base := password[i : i+l]
+			count := 1
+			for i+(count+1)*l <= n && password[i+count*l:i+(count+1)*l] == base {
+				count++
+			}
+			if count < 2 || (l == 1 && count < 3) {
+				continue
+			}
+			j := i + count*l - 1
+			if j-i > best.j-best.i || best.pattern == "" {
+				baseGuesses := estimateGuesses(base, ranked, false)
+				best = strengthMatch{pattern: "repeat", i: i, j: j, token: password[i : j+1], guesses: baseGuesses * float64(count)}
+			}
+		}
+		if best.pattern != "" {
+			matches = append(matches, best)
+		}
+	}
+
+	return matches
+}
+
+// dateMatches finds four digit years and eight digit dates
+func dateMatches(password string) []strengthMatch {
+	var matches []strengthMatch
+	n := len(password)
+	reference := time.Now().Year()
+
+	isDigits := func(s string) bool {
+		for _, c := range s {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+		return true
+	}
+
+	yearSpace := func(year int) float64 {
+		return math.Max(math.Abs(float64(year-reference)), 20)
+	}
+
+	atoi := func(s string) int {
+		v := 0
+		for _, c := range s {
+			v = v*10 + int(c-'0')
+		}
+		return v
+	}
+
+	for i := 0; i+4 <= n; i++ {
+		token := password[i : i+4]
+		if !isDigits(token) {
+			continue
+		}
+		year := atoi(token)
+		if year >= 1900 && year <= 2099 {
+			matches = append(matches, strengthMatch{pattern: "date", i: i, j: i + 3, token: token, guesses: yearSpace(year)})
+		}
+	}
+
+	for i := 0; i+8 <= n; i++ {
+		token := password[i : i+8]
+		if !isDigits(token) {
+			continue
+		}
+		// ddmmyyyy or yyyymmdd
+		day, month, year := atoi(token[0:2]), atoi(token[2:4]), atoi(token[4:8])
+		if !(day >= 1 && day <= 31 && month >= 1 && month <= 12 && year >= 1900 && year <= 2099) {
+			year, month, day = atoi(token[0:4]), atoi(token[4:6]), atoi(token[6:8])
+			if !(day >= 1 && day <= 31 && month >= 1 && month <= 12 && year >= 1900 && year <= 2099) {
+				continue
+			}
+		}
+		matches = append(matches, strengthMatch{pattern: "date", i: i, j: i + 7, token: token, guesses: 365 * yearSpace(year)})
+	}
+
+	return matches
+}
+
+// allMatches collects every pattern found in the password
+func allMatches(password string, ranked map[string]int, repeats bool) []strengthMatch {
+	matches := dictionaryMatches(password, ranked)
+	matches = append(matches, spatialMatches(password)...)
+	matches = append(matches, sequenceMatches(password)...)
+	matches = append(matches, dateMatches(password)...)
+	if repeats {
+		matches = append(matches, repeatMatches(password, ranked)...)
+	}
+	return matches
+}
+
+// minimumGuesses works out the cheapest way to cover the password with the
+// matches given, brute forcing any gaps. It returns the guesses and the
+// matches used
+func minimumGuesses(password string, matches []strengthMatch) (float64, []strengthMatch) {
+	n := len(password)
+	best := make([]float64, n+1)
+	from := make([]int, n+1)
+	used := make([]*strengthMatch, n+1)
+	best[0] = 1
+
+	for k := 1; k <= n; k++ {
+		best[k] = best[k-1] * bruteforceCardinality
+		from[k] = k - 1
+		used[k] = nil
+
+		for m := range matches {
+			if matches[m].j != k-1 {
+				continue
+			}
+			guesses := math.Max(matches[m].guesses, minSubmatchGuesses)
+			if matches[m].j == matches[m].i {
+				guesses = math.Max(matches[m].guesses, bruteforceCardinality+1)
+			}
+			candidate := best[matches[m].i] * guesses
+			if candidate < best[k] {
+				best[k] = candidate
+				from[k] = matches[m].i
+				used[k] = &matches[m]
+			}
+		}
+	}
+
+	var sequence []strengthMatch
+	for k := n; k > 0; k = from[k] {
+		if used[k] != nil {
+			sequence = append([]strengthMatch{*used[k]}, sequence...)
+		}
+	}
+
+	return best[n], sequence
+}
+
+// estimateGuesses returns the number of guesses needed to find a password
+func estimateGuesses(password string, ranked map[string]int, repeats bool) float64 {
+	guesses, _ := minimumGuesses(password, allMatches(password, ranked, repeats))
+	return guesses
+}
+
+// guessesToScore converts guesses into a 0 (terrible) to 4 (great) score
+func guessesToScore(guesses float64) int {
+	const delta = 5
+	switch {
+	case guesses < 1e3+delta:
+		return 0
+	case guesses < 1e6+delta:
+		return 1
+	case guesses < 1e8+delta:
+		return 2
+	case guesses < 1e10+delta:
+		return 3
+	}
+	return 4
+}
+
+// displayCrackTime turns seconds into something a human can read
+func displayCrackTime(seconds float64) string {
+	const (
+		minute  = 60.0
+		hour    = minute * 60
+		day     = hour * 24
+		month   = day * 31
+		year    = month * 12
+		century = year * 100
+	)
+
+	unit := func(value float64, name string) string {
+		n := int(math.Floor(value))
+		if n == 1 {
+			return "1 " + name
+		}
+		return fmt.Sprintf("%d %vs", n, name)
+	}
+
+	switch {
+	case seconds < 1:
+		return "less than a second"
+	case seconds < minute:
+		return unit(seconds, "second")
+	case seconds < hour:
+		return unit(seconds/minute, "minute")
+	case seconds < day:
+		return unit(seconds/hour, "hour")
+	case seconds < month:
+		return unit(seconds/day, "day")
+	case seconds < year:
+		return unit(seconds/month, "month")
+	case seconds < century:
+		return unit(seconds/year, "year")
+	}
+	return "centuries"
+}
+
+// strengthFeedback gives a warning and suggestions based on the longest
+// pattern found in a weak password
+func strengthFeedback(score int, sequence []strengthMatch) (string, []string) {
+	if score > 2 {
+		return "", []string{}
+	}
+
+	suggestions := []string{"Add another word or two. Uncommon words are better."}
+
+	if len(sequence) == 0 {
+		return "", append([]string{"Use a few words, avoid common phrases."}, suggestions...)
+	}
+
+	longest := sequence[0]
+	for _, m := range sequence[1:] {
+		if m.j-m.i > longest.j-longest.i {
+			longest = m
+		}
+	}
+
+	switch longest.pattern {
+	case "dictionary":
+		warning := "This is similar to a commonly used password."
+		if len(sequence) == 1 && longest.rank <= 10 {
+			warning = "This is a top-10 common password."
+		} else if len(sequence) == 1 && longest.rank <= 100 {
+			warning = "This is a top-100 common password."
+		}
+		if asciiLower(longest.token) != longest.token {
+			suggestions = append(suggestions, "Capitalisation doesn't help very much.")
+		}
+		if longest.reversed {
+			suggestions = append(suggestions, "Reversed words aren't much harder to guess.")
+		}
+		if longest.l33t {
+			suggestions = append(suggestions, "Predictable substitutions like '@' instead of 'a' don't help very much.")
+		}
+		return warning, suggestions
+	case "spatial":
+		return "Straight rows and short patterns of keys are easy to guess.",
+			append(suggestions, "Use a longer keyboard pattern with more turns.")
+	case "repeat":
+		return "Repeats like \"abcabcabc\" are only slightly harder to guess than \"abc\".",
+			append(suggestions, "Avoid repeated words and characters.")
+	case "sequence":
+		return "Sequences like abc or 6543 are easy to guess.",
+			append(suggestions, "Avoid sequences.")
+	case "date":
+		return "Dates and years are often easy to guess.",
+			append(suggestions, "Avoid dates and years that are associated with you.")
+	}
+
+	return "", suggestions
+}
+
+// limitLength cuts a password to at most max bytes, without splitting a
+// character
+func limitLength(password string, max int) string {
+	if len(password) <= max {
+		return password
+	}
+	for max > 0 && !utf8.RuneStart(password[max]) {
+		max--
+	}
+	return password[:max]
+}
+
+// EstimateStrength estimates how many guesses it would take to find the
+// password and converts that into a score, crack time and advice. Any
+// userInputs (names and the like) are treated as very common words. A
+// password that isn't valid UTF-8 is given the lowest score
+func EstimateStrength(password string, userInputs ...string) Strength {
+	if !utf8.ValidString(password) {
+		warning, suggestions := strengthFeedback(0, nil)
+		return Strength{Score: 0, Guesses: 1, CrackTime: displayCrackTime(0), Warning: warning, Suggestions: suggestions}
+	}
+
+	password = limitLength(password, maxEstimateLength)
+
+	ranked := rankedWords
+	if len(userInputs) > 0 {
+		ranked = make(map[string]int, len(rankedWords)+len(userInputs))
+		for word, rank := range rankedWords {
+			ranked[word] = rank
+		}
+		for i, input := range userInputs {
+			ranked[strings.ToLower(input)] = i + 1
+		}
+	}
+
+	guesses, sequence := minimumGuesses(password, allMatches(password, ranked, true))
+	score := guessesToScore(guesses)
+	warning, suggestions := strengthFeedback(score, sequence)
+
+	return Strength{
+		Score:       score,
+		Guesses:     guesses,
+		CrackTime:   displayCrackTime(guesses / guessesPerSecond),
+		Warning:     warning,
+		Suggestions: suggestions,
+	}
+}
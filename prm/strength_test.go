@@ -0,0 +1,75 @@
+package prm
+
+import (
+	"strings"
+	"testing"
+)
+
+// Setup test cases - password against the highest score it should get
+var weak_map = map[string]int{
+	"password":     0,
+	"P@ssw0rd":     1,
+	"qwertyuiop":   1,
+	"abcdefghijk":  1,
+	"aaaaaaaaaaaa": 1,
+	"19071984":     1,
+	"drowssap":     1,
+}
+
+// Test obviously weak passwords score badly and get some advice
+func TestEstimateStrengthWeak(t *testing.T) {
+	for password, max := range weak_map {
+		strength := EstimateStrength(password)
+		if strength.Score > max {
+			t.Error("For:", password, "got score:", strength.Score, "expected at most:", max)
+		}
+		if strength.Warning == "" || len(strength.Suggestions) == 0 {
+			t.Error("For:", password, "expected a warning and suggestions, got:", strength)
+		}
+	}
+}
+
+// Test a long random password scores well
+func TestEstimateStrengthStrong(t *testing.T) {
+	strength := EstimateStrength("adoiah1223423sfdiunIOH")
+	if strength.Score != 4 {
+		t.Error("Expected a score of 4, got:", strength.Score)
+	}
+	if strength.CrackTime != "centuries" {
+		t.Error("Expected centuries to crack, got:", strength.CrackTime)
+	}
+}
+
+// Test user inputs are treated as common words
+func TestEstimateStrengthUserInputs(t *testing.T) {
+	without := EstimateStrength("Wellington")
+	with := EstimateStrength("Wellington", "wellington")
+	if with.Guesses >= without.Guesses {
+		t.Error("Expected fewer guesses with the user input, got:", with.Guesses, without.Guesses)
+	}
+}
+
+// Test passwords that aren't valid UTF-8, or whose case changes their length
+// outside ASCII, are estimated without going out of bounds
+func TestEstimateStrengthNotASCII(t *testing.T) {
+	test_map := map[string]int{
+		"\xff\xfe\xfd":       0,
+		"pass\xffword":       0,
+		"ıİıİpassword":       2,
+		"Straße Ⱥpple ıpass": 4,
+		"ǅungleWORDıı":       4,
+		"PASSWORDẞ":          2,
+	}
+
+	for password, max := range test_map {
+		strength := EstimateStrength(password)
+		if strength.Score > max {
+			t.Error("For:", password, "got score:", strength.Score, "expected at most:", max)
+		}
+	}
+
+	long := strings.Repeat("a", maxEstimateLength-1) + "é"
+	if strength := EstimateStrength(long); strength.Score > 1 {
+		t.Error("For: long password cut inside a character got:", strength)
+	}
+}
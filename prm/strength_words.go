@@ -0,0 +1,49 @@
+package prm
+
+// commonPasswords is a ranked list of frequently used passwords and words,
+// most common first. The rank is used as the number of guesses an attacker
+// would need to reach a word, so order matters.
+const commonPasswords = `
+123456 password 12345678 qwerty 123456789 12345 1234 111111 1234567 dragon
+123123 baseball abc123 football monkey letmein 696969 shadow master 666666
+qwertyuiop 123321 mustang 1234567890 michael 654321 superman 1qaz2wsx 7777777 121212
+000000 qazwsx 123qwe killer trustno1 jordan jennifer zxcvbnm asdfgh hunter
+buster soccer harley batman andrew tigger sunshine iloveyou 2000 charlie
+robert thomas hockey ranger daniel starwars klaster 112233 george computer
+michelle jessica pepper 1111 zxcvbn 555555 11111111 131313 freedom 777777
+pass maggie 159753 aaaaaa ginger princess joshua cheese amanda summer
+love ashley nicole chelsea biteme matthew access yankees 987654321 dallas
+austin thunder taylor matrix william corvette hello martin heather secret
+merlin diamond 1234qwer gfhjkm hammer silver 222222 88888888 anthony justin
+test bailey q1w2e3r4t5 patrick internet scooter orange 11111 golfer cookie
+richard samantha bigdog guitar jackson whatever mickey chicken sparky snoopy
+maverick phoenix camaro peanut morgan welcome falcon cowboy ferrari samsung
+andrea smokey steelers joseph mercedes dakota arsenal eagles melissa boomer
+booboo spider nascar monster tigers yellow xxxxxx 123123123 gateway marina
+diablo bulldog qwer1234 compaq purple banana junior hannah 123654
+porsche lakers iceman money cowboys 987654 london tennis 999999 ncc1701
+coffee scooby 0000 miller boston q1w2e3r4 brandon yamaha chester mother
+forever johnny edward 333333 oliver redsox player nikita knight fender
+barney midnight please brandy chicago badboy slayer rangers charles angel
+flower bigdaddy rabbit wizard jasper enter rachel chris steven
+winner adidas victoria natasha 1q2w3e4r jasmine winter prince marine
+ghbdtn fishing cocacola casper james 232323 raiders 888888 marlboro gandalf
+qweasd welcome1 password1 password123 admin administrator login abc
+changeme letmein1 passw0rd p@ssw0rd qwerty123 iloveyou1 monkey1 dragon1 football1
+baseball1 master1 shadow1 sunshine1 princess1 trustno1 superman1 azerty
+solo loveme whatever1 starwars1 hello123 welcome123 zaq12wsx 1q2w3e 1qazxsw2
+research university college student teacher london2012 queen mary qmul
+summer2016 winter2016 spring autumn january february march april may june july
+august september october november december monday tuesday wednesday thursday
+friday saturday sunday apple orange lemon cherry banana grape mango peach
+family friend friends happy lucky angel angels baby babygirl babyboy sweet
+secret1 private public default guest user root toor system server linux
+unix windows apache oracle mysql cluster compute physics chemistry biology
+science maths history english music dance football1 rugby cricket tennis1
+golf hockey1 running runner swimming cycling horse horses dog dogs cat cats
+kitty puppy tiger lion bear eagle shark wolf fox dolphin pony unicorn dragon2
+red blue green black white pink gold silver1 yellow1 orange1 purple1 brown
+love123 loveyou lovely lover hottie beautiful pretty cutie honey
+correct battery staple horse1 house home garden flower1 water fire earth
+wind light dark night day sun moon star stars heaven hell god jesus christ
+`
@@ -0,0 +1,89 @@
+package prm
+
+import (
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"net/http"
+	"time"
+)
+
+// When the terms and conditions are shown is set by TermsMode:
+//
+//	otp     - only to users unlocking their account with a one-time code or
+//	          a reset link
+//	always  - on every password change
+//	first   - until the user has accepted them once
+//	version - whenever TermsVersion differs from the version last accepted
+//
+// The version a user last accepted is kept in TermsAttribute on their entry.
+
+// Terms modes
+const (
+	TermsModeOTP     = "otp"
+	TermsModeAlways  = "always"
+	TermsModeFirst   = "first"
+	TermsModeVersion = "version"
+)
+
+// defaultTermsTimeout is how long, in seconds, a user has to accept the terms
+// and conditions if no timeout is configured
+const defaultTermsTimeout = 1800
+
+// sessionTimeout is how long a session token and its pending change last
+func (prm *PRM) sessionTimeout() int64 {
+	if prm.Config.TermsTimeout > 0 {
+		return int64(prm.Config.TermsTimeout)
+	}
+	return defaultTermsTimeout
+}
+
+// acceptedTermsVersion returns the terms version the user last accepted, or ""
+func (prm *PRM) acceptedTermsVersion(entry *ldap.Entry) string {
+	if entry == nil || prm.Config.TermsAttribute == "" {
+		return ""
+	}
+	return entry.GetAttributeValue(prm.Config.TermsAttribute)
+}
+
+// TermsRequired decides whether the user must accept the terms and
+// conditions before their password is changed. unlocked says the user got in
+// with a one-time code or a reset link rather than their old password.
+// Without a TermsAttribute there is no record of what was accepted, so the
+// first and version modes always show the terms
+func (prm *PRM) TermsRequired(entry *ldap.Entry, unlocked bool) bool {
+	switch prm.Config.TermsMode {
+	case TermsModeAlways:
+		return true
+	case TermsModeFirst:
+		return prm.Config.TermsAttribute == "" || prm.acceptedTermsVersion(entry) == ""
+	case TermsModeVersion:
+		return prm.Config.TermsAttribute == "" || prm.acceptedTermsVersion(entry) != prm.Config.TermsVersion
+	}
+	return unlocked
+}
+
+// RecordTermsAccepted notes the accepted terms version in the audit log and,
+// if configured, on the users entry
+func (prm *PRM) RecordTermsAccepted(username string, conn Conn, r *http.Request) bool {
+	prm.AuditPRM("terms-accepted", username, r, "version="+prm.Config.TermsVersion)
+
+	if prm.Config.TermsAttribute == "" {
+		return true
+	}
+
+	version := prm.Config.TermsVersion
+	if version == "" {
+		// Something must be stored so the first mode knows they have accepted
+		version = fmt.Sprintf("%d", time.Now().Unix())
+	}
+
+	modify := ldap.NewModifyRequest(fmt.Sprintf(prm.Config.PasswordModifyLDAP+",%v", username, prm.Config.BaseDN))
+	modify.Replace(prm.Config.TermsAttribute, []string{version})
+	err := conn.Modify(modify)
+
+	if err != nil {
+		prm.LogPRM("RecordTermsAccepted Error: "+err.Error(), LOG_ERROR)
+		return false
+	}
+	return true
+}
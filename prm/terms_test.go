@@ -0,0 +1,110 @@
+package prm
+
+import (
+	"gopkg.in/ldap.v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Test each terms mode against users who have and haven't accepted
+func TestTermsRequired(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.TermsAttribute = "prmTermsAccepted"
+	prm.Config.TermsVersion = "2"
+
+	accepted := func(version string) *ldap.Entry {
+		return &ldap.Entry{DN: "uid=abc123", Attributes: []*ldap.EntryAttribute{
+			{Name: "prmTermsAccepted", Values: []string{version}},
+		}}
+	}
+	never := &ldap.Entry{DN: "uid=abc123"}
+
+	test_map := []struct {
+		mode     string
+		entry    *ldap.Entry
+		unlocked bool
+		want     bool
+	}{
+		{TermsModeOTP, never, false, false},
+		{TermsModeOTP, never, true, true},
+		{"", never, true, true},
+		{TermsModeAlways, accepted("2"), false, true},
+		{TermsModeFirst, never, false, true},
+		{TermsModeFirst, accepted("1"), false, false},
+		{TermsModeVersion, accepted("1"), false, true},
+		{TermsModeVersion, accepted("2"), false, false},
+		{TermsModeVersion, never, false, true},
+	}
+
+	for _, test := range test_map {
+		prm.Config.TermsMode = test.mode
+		if got := prm.TermsRequired(test.entry, test.unlocked); got != test.want {
+			t.Error("For:", test.mode, test.entry.GetAttributeValue("prmTermsAccepted"), test.unlocked, "got:", got)
+		}
+	}
+
+	// Without an attribute there is no record, so always show them
+	prm.Config.TermsAttribute = ""
+	prm.Config.TermsMode = TermsModeFirst
+	if !prm.TermsRequired(accepted("2"), false) {
+		t.Error("For: first without an attribute got: false")
+	}
+}
+
+// Test the timeout falls back to the default
+func TestSessionTimeout(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+
+	if prm.sessionTimeout() != defaultTermsTimeout {
+		t.Error("For: no timeout got:", prm.sessionTimeout())
+	}
+
+	prm.Config.TermsTimeout = 600
+	if prm.sessionTimeout() != 600 {
+		t.Error("For: 600 got:", prm.sessionTimeout())
+	}
+}
+
+// Test a failed write of the accepted version is reported
+func TestRecordTermsAccepted(t *testing.T) {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	var conn = new(TestConn)
+
+	if !prm.RecordTermsAccepted("abc123", conn, nil) {
+		t.Error("For: no attribute got: false")
+	}
+
+	prm.Config.TermsAttribute = "prmTermsAccepted"
+	if prm.RecordTermsAccepted("abc123", conn, nil) {
+		t.Error("For: failing modify got: true")
+	}
+}
+
+// Test accepting or skipping the terms with LDAP out of reach is an error,
+// not a crash
+func TestProcessTermsNoLDAP(t *testing.T) {
+	prm := newResetPRM()
+	prm.Config.CertFilePath = "/nonexistent/ca.pem"
+
+	w := httptest.NewRecorder()
+	csrf, _ := prm.CSRFToken(w, httptest.NewRequest("GET", "https://pass.example.com/", nil))
+
+	form := url.Values{"token": {"abc"}, "verb": {"Accept"}, csrfField: {csrf}}
+	r := httptest.NewRequest("POST", "https://pass.example.com/accept", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "https://pass.example.com")
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: csrf})
+
+	if result, _ := prm.ProcessTerms(r); result.Message != ErrorFatal {
+		t.Error("For: ProcessTerms got:", result.ToString())
+	}
+	if result, _ := prm.ProcessSkipped(r, "abc"); result.Message != ErrorFatal {
+		t.Error("For: ProcessSkipped got:", result.ToString())
+	}
+}
@@ -0,0 +1,111 @@
+package prm
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// SessionToken carries a validated password change from the first form to
+// the terms and conditions page. Everything is sealed together in a single
+// uffer so parts of one session can't be mixed with another. The new password
+// itself stays on the server in the pending store under PendingID.
+type SessionToken struct {
+	Username    string `json:"u"`
+	PendingID   string `json:"i"`
+	Issued      int64  `json:"t"`
+	Nonce       string `json:"n"`
+	Fingerprint string `json:"f"`
+}
+
+// Token verification errors
+var (
+	ErrTokenInvalid     = errors.New("token failed verification")
+	ErrTokenExpired     = errors.New("token has expired")
+	ErrTokenFingerprint = errors.New("token was issued to a different client")
+)
+
+// clientFingerprint identifies the browser a token was issued to. It is a
+// hash so the token doesn't carry the users IP and browser around in it
+func clientFingerprint(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	sum := sha256.Sum256([]byte(host + "\n" + r.Header.Get("User-Agent")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// NewSessionToken stores the new password as a pending change and seals the
+// username and pending id into a token bound to the client making the request
+func (prm *PRM) NewSessionToken(username string, password string, r *http.Request) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	id, err := prm.putPendingPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	token := SessionToken{
+		Username:    username,
+		PendingID:   id,
+		Issued:      time.Now().Unix(),
+		Nonce:       hex.EncodeToString(nonce),
+		Fingerprint: clientFingerprint(r),
+	}
+
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+
+	return prm.sealKeyed(ufferSession, plaintext)
+}
+
+// VerifySessionToken opens a sealed token and checks it has not expired and
+// was issued to the same client
+func (prm *PRM) VerifySessionToken(sealed string, r *http.Request) (SessionToken, error) {
+	var token SessionToken
+
+	plaintext, err := prm.openKeyed(ufferSession, sealed)
+	if err != nil {
+		return token, ErrTokenInvalid
+	}
+
+	if err := json.Unmarshal(plaintext, &token); err != nil || token.Username == "" || token.PendingID == "" || token.Nonce == "" {
+		return token, ErrTokenInvalid
+	}
+
+	if time.Now().Unix()-token.Issued > prm.sessionTimeout() {
+		return token, ErrTokenExpired
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token.Fingerprint), []byte(clientFingerprint(r))) != 1 {
+		return token, ErrTokenFingerprint
+	}
+
+	return token, nil
+}
+
+// tokenResult maps a token verification error onto a result code
+func tokenResult(err error) int {
+	switch err {
+	case ErrTokenExpired, ErrPendingNotFound:
+		return ErrorTimeOut
+	case ErrTokenFingerprint:
+		return ErrorTokenClient
+	case ErrTokenReplayed:
+		return ErrorTokenReplayed
+	}
+	return ErrorToken
+}
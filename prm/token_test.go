@@ -0,0 +1,67 @@
+package prm
+
+import (
+	"net/http"
+	"testing"
+)
+
+func newTokenPRM() *PRM {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.Uffer = "0123456789ABCDEF"
+	return prm
+}
+
+// Test a token round trips with the username and password intact
+func TestSessionToken(t *testing.T) {
+	prm := newTokenPRM()
+	req := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{"User-Agent": {"test"}}}
+
+	sealed, err := prm.NewSessionToken("user", "n4klxui!Q", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := prm.VerifySessionToken(sealed, req)
+	if err != nil {
+		t.Fatal("VerifySessionToken failed:", err)
+	}
+
+	if token.Username != "user" {
+		t.Error("token username wrong, got:", token.Username)
+	}
+
+	password, err := prm.takePendingPassword(token)
+	if err != nil || password != "n4klxui!Q" {
+		t.Error("pending password wrong, got:", password, err)
+	}
+
+	// Once taken the pending change is gone
+	if _, err := prm.takePendingPassword(token); err != ErrPendingNotFound {
+		t.Error("Expected ErrPendingNotFound on second take, got:", err)
+	}
+}
+
+// Test a token from another client, or a forged one, is refused with the
+// right result code
+func TestSessionTokenRejected(t *testing.T) {
+	prm := newTokenPRM()
+	req := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{"User-Agent": {"test"}}}
+	other := &http.Request{RemoteAddr: "10.0.0.2:1234", Header: http.Header{"User-Agent": {"test"}}}
+
+	sealed, _ := prm.NewSessionToken("user", "n4klxui!Q", req)
+
+	_, err := prm.VerifySessionToken(sealed, other)
+	if err != ErrTokenFingerprint || tokenResult(err) != ErrorTokenClient {
+		t.Error("Expected ErrTokenFingerprint, got:", err)
+	}
+
+	_, err = prm.VerifySessionToken(sealed[:len(sealed)-2], req)
+	if err != ErrTokenInvalid || tokenResult(err) != ErrorToken {
+		t.Error("Expected ErrTokenInvalid, got:", err)
+	}
+
+	if tokenResult(ErrTokenExpired) != ErrorTimeOut {
+		t.Error("Expected ErrTokenExpired to map to ErrorTimeOut")
+	}
+}
@@ -0,0 +1,552 @@
+package prm
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"gopkg.in/ldap.v2"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP (RFC 6238) gives users changing their password with the old one a
+// second factor. Users enrol an authenticator app once, after which a code
+// from it is needed on every change. The secret, the last time step used and
+// hashes of the users recovery codes are sealed with the uffer keyring and
+// kept in TOTPAttribute on their entry. Users in TOTPRequiredGroups must
+// enrol before they can change their password at all.
+
+// TOTP parameters, the defaults every authenticator app understands
+const (
+	totpDigits      = 6
+	totpPeriod      = 30
+	totpSkew        = 1
+	totpSecretBytes = 20
+)
+
+// recoveryCodeCount is how many recovery codes are issued at enrolment
+const recoveryCodeCount = 10
+
+// totpEnrolAttempts is how many codes may be tried with one enrolment token
+// before it is used up and the user has to start again
+const totpEnrolAttempts = 5
+
+// recoveryCodeChars leaves out characters that are easily confused
+const recoveryCodeChars = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// totpEncoding is the unpadded base32 used by authenticator apps
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP errors
+var (
+	ErrTOTPNotEnrolled = errors.New("no authenticator enrolled")
+	ErrTOTPEnrolment   = errors.New("enrolment token failed verification")
+)
+
+// totpRecord is sealed into the users TOTP attribute
+type totpRecord struct {
+	Secret   string   `json:"s"`
+	LastStep int64    `json:"l"`
+	Recovery []string `json:"r"`
+}
+
+// totpEnrolment carries a new secret from the enrolment page to the
+// confirmation, so nothing is stored until the user proves their app works
+type totpEnrolment struct {
+	Username    string `json:"u"`
+	Secret      string `json:"s"`
+	Issued      int64  `json:"t"`
+	Nonce       string `json:"n"`
+	Fingerprint string `json:"f"`
+}
+
+// TOTPEnrolment is what the enrolment page needs to show the user
+type TOTPEnrolment struct {
+	Token  string
+	Secret string
+	URI    string
+	QR     string
+}
+
+// hotp computes the RFC 4226 code for a counter
+func hotp(secret []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// totpStep returns the time step for a time
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// verifyTOTP checks a code against the steps either side of now, refusing
+// any step at or before the last one used so a code only works once. It
+// returns the step that matched
+func verifyTOTP(secret []byte, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = normaliseCode(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, uint64(step), totpDigits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normaliseCode removes the spaces and hyphens people type into codes
+func normaliseCode(code string) string {
+	code = strings.Replace(code, " ", "", -1)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.ToLower(code)
+}
+
+// newTOTPSecret creates a random secret, base32 encoded
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpURI builds the otpauth URI that authenticator apps read from the QR code
+func (prm *PRM) totpURI(username string, secret string) string {
+	issuer := prm.Config.TOTPIssuer
+	if issuer == "" {
+		issuer = "PRM"
+	}
+
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("digits", fmt.Sprintf("%d", totpDigits))
+	values.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// totpQR renders a URI as a PNG QR code in a data URI
+func totpQR(uri string) (string, error) {
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}
+
+// newRecoveryCodes creates a set of recovery codes, formatted xxxxx-xxxxx
+func newRecoveryCodes() ([]string, error) {
+	max := big.NewInt(int64(len(recoveryCodeChars)))
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		code := make([]byte, 10)
+		for j := range code {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return nil, err
+			}
+			code[j] = recoveryCodeChars[n.Int64()]
+		}
+		codes[i] = string(code[:5]) + "-" + string(code[5:])
+	}
+	return codes, nil
+}
+
+// useRecoveryCode removes a matching recovery code from the record,
+// returning false if there is none
+func (prm *PRM) useRecoveryCode(username string, record *totpRecord, code string) bool {
+	for i, stored := range record.Recovery {
+		if prm.matchRecovery(username, stored, code) {
+			record.Recovery = append(record.Recovery[:i], record.Recovery[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// newTOTPRecord creates the record for a new enrolment, returning the
+// recovery codes to show the user once. The codes are hashed in the same way
+// as account recovery codes
+func (prm *PRM) newTOTPRecord(username string, secret string, step int64) (*totpRecord, []string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	record := &totpRecord{Secret: secret, LastStep: step}
+	for _, code := range codes {
+		value, err := prm.hashRecovery(username, code)
+		if err != nil {
+			return nil, nil, err
+		}
+		record.Recovery = append(record.Recovery, value)
+	}
+	return record, codes, nil
+}
+
+// TOTPEnabled returns true if TOTP is configured
+func (prm *PRM) TOTPEnabled() bool {
+	return prm.Config.TOTPAttribute != ""
+}
+
+// readTOTPRecord opens the TOTP record on a users entry
+func (prm *PRM) readTOTPRecord(entry *ldap.Entry) (*totpRecord, error) {
+	value := ""
+	if entry != nil {
+		value = entry.GetAttributeValue(prm.Config.TOTPAttribute)
+	}
+	if value == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+
+	plaintext, err := prm.openKeyed(ufferTOTP, value)
+	if err != nil {
+		return nil, err
+	}
+
+	var record totpRecord
+	if err := json.Unmarshal(plaintext, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// writeTOTPRecord seals a TOTP record with the primary key and stores it.
+// Every use rewrites the record, so it moves onto the newest key over time
+func (prm *PRM) writeTOTPRecord(username string, record *totpRecord, conn Conn) error {
+	plaintext, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := prm.sealKeyed(ufferTOTP, plaintext)
+	if err != nil {
+		return err
+	}
+
+	modify := ldap.NewModifyRequest(fmt.Sprintf(prm.Config.PasswordModifyLDAP+",%v", username, prm.Config.BaseDN))
+	modify.Replace(prm.Config.TOTPAttribute, []string{sealed})
+	return conn.Modify(modify)
+}
+
+// inTOTPRequiredGroup checks the users group attribute against the groups
+// that must use TOTP. Groups may be given as a full DN or just the cn
+func (prm *PRM) inTOTPRequiredGroup(entry *ldap.Entry) bool {
+	if entry == nil {
+		return false
+	}
+
+	for _, value := range entry.GetAttributeValues(prm.totpGroupAttribute()) {
+		lower := strings.ToLower(value)
+		for _, group := range prm.Config.TOTPRequiredGroups {
+			group = strings.ToLower(group)
+			if lower == group || strings.HasPrefix(lower, "cn="+group+",") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// totpGroupAttribute returns the attribute listing a users groups
+func (prm *PRM) totpGroupAttribute() string {
+	if prm.Config.TOTPGroupAttribute != "" {
+		return prm.Config.TOTPGroupAttribute
+	}
+	return "memberOf"
+}
+
+// CheckTOTP checks the second factor for a user changing their password.
+// Users who have not enrolled pass unless they are in a required group. A
+// code from the app or an unused recovery code is accepted, and the record
+// is updated so neither can be used again. The connection must be bound as
+// admin
+func (prm *PRM) CheckTOTP(username string, entry *ldap.Entry, code string, conn Conn, r *http.Request) int {
+	if !prm.TOTPEnabled() {
+		return Success
+	}
+
+	record, err := prm.readTOTPRecord(entry)
+	if err == ErrTOTPNotEnrolled {
+		if prm.inTOTPRequiredGroup(entry) {
+			return ErrorTOTPRequired
+		}
+		return Success
+	}
+	if err != nil {
+		prm.LogPRM("CheckTOTP Error: "+err.Error(), LOG_ERROR)
+		return ErrorFatal
+	}
+
+	secret, err := totpEncoding.DecodeString(record.Secret)
+	if err != nil {
+		prm.LogPRM("CheckTOTP Error: "+err.Error(), LOG_ERROR)
+		return ErrorFatal
+	}
+
+	// Every code typed is counted, as guesses have to stop before the code
+	// is checked
+	if prm.countFailure("totp-tried", username, prm.totpMaxTries()+1) > prm.totpMaxTries() {
+		prm.AuditPRM("totp-locked", username, r, fmt.Sprintf("tries=%d", prm.totpMaxTries()))
+		prm.notify(NotifyTOTPLocked, username, entry, r)
+		return ErrorTOTPLocked
+	}
+
+	event := "totp-used"
+	if step, ok := verifyTOTP(secret, code, time.Now(), record.LastStep); ok {
+		record.LastStep = step
+	} else if code != "" && prm.useRecoveryCode(username, record, code) {
+		event = "totp-recovery-code-used"
+	} else {
+		prm.AuditPRM("totp-failed", username, r)
+		return ErrorTOTP
+	}
+
+	// If the use can't be recorded the code could be used again, so refuse
+	if err := prm.writeTOTPRecord(username, record, conn); err != nil {
+		prm.LogPRM("CheckTOTP Error: "+err.Error(), LOG_ERROR)
+		return ErrorFatal
+	}
+
+	prm.AuditPRM(event, username, r, fmt.Sprintf("recovery-codes-left=%d", len(record.Recovery)))
+	return Success
+}
+
+// BeginTOTPEnrolment checks the users password, and their current code if
+// they have already enrolled, then creates a new secret for them to add to
+// their app. The secret is sealed into the returned token rather than stored
+func (prm *PRM) BeginTOTPEnrolment(r *http.Request) (enrolment TOTPEnrolment, code int) {
+	r.ParseForm()
+
+	if !prm.TOTPEnabled() {
+		return enrolment, ErrorNotImplemented
+	}
+
+	if !prm.checkCSRF(r) {
+		return enrolment, ErrorCSRF
+	}
+
+	username, p0, _, _, _, _, _ := prm.parseForm(r)
+	totp := strings.Join(r.Form["totp"], "")
+
+	conn, err := prm.ldapConnect()
+	if err != nil || conn == nil {
+		return enrolment, ErrorFatal
+	}
+	defer conn.Close()
+
+	if err := prm.ldapBindAdmin(conn); err != nil {
+		prm.LogPRM(err.Error(), LOG_ERROR)
+		return enrolment, ErrorFatal
+	}
+
+	entry := prm.SearchUsername(username, conn)
+	if entry == nil || !prm.CheckPasswordCorrect(username, p0, conn) {
+		return enrolment, ErrorPasswordIncorrect
+	}
+
+	if err := prm.ldapBindAdmin(conn); err != nil {
+		prm.LogPRM(err.Error(), LOG_ERROR)
+		return enrolment, ErrorFatal
+	}
+
+	// Replacing an existing authenticator needs a code from it, or a
+	// recovery code, so a stolen password alone can't take it over
+	if _, err := prm.readTOTPRecord(entry); err != ErrTOTPNotEnrolled {
+		if result := prm.CheckTOTP(username, entry, totp, conn, r); result != Success {
+			return enrolment, result
+		}
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		prm.LogPRM("BeginTOTPEnrolment Error: "+err.Error(), LOG_ERROR)
+		return enrolment, ErrorFatal
+	}
+
+	nonce, err := newPendingID()
+	if err != nil {
+		return enrolment, ErrorFatal
+	}
+
+	plaintext, _ := json.Marshal(totpEnrolment{
+		Username:    username,
+		Secret:      secret,
+		Issued:      time.Now().Unix(),
+		Nonce:       nonce,
+		Fingerprint: clientFingerprint(r),
+	})
+
+	token, err := prm.sealKeyed(ufferEnrolment, plaintext)
+	if err != nil {
+		prm.LogPRM("BeginTOTPEnrolment Error: "+err.Error(), LOG_ERROR)
+		return enrolment, ErrorFatal
+	}
+
+	enrolment, err = prm.newTOTPEnrolment(token, username, secret)
+	if err != nil {
+		prm.LogPRM("BeginTOTPEnrolment Error: "+err.Error(), LOG_ERROR)
+		return enrolment, ErrorFatal
+	}
+
+	return enrolment, Success
+}
+
+// newTOTPEnrolment fills in what the enrolment page shows for a token
+func (prm *PRM) newTOTPEnrolment(token string, username string, secret string) (TOTPEnrolment, error) {
+	uri := prm.totpURI(username, secret)
+	qr, err := totpQR(uri)
+	if err != nil {
+		return TOTPEnrolment{}, err
+	}
+
+	return TOTPEnrolment{Token: token, Secret: secret, URI: uri, QR: qr}, nil
+}
+
+// openTOTPEnrolment verifies an enrolment token. It is only marked used once
+// a code has been checked against it, see checkTOTPEnrolment
+func (prm *PRM) openTOTPEnrolment(sealed string, r *http.Request) (totpEnrolment, error) {
+	var enrolment totpEnrolment
+
+	plaintext, err := prm.openKeyed(ufferEnrolment, sealed)
+	if err != nil || json.Unmarshal(plaintext, &enrolment) != nil || enrolment.Username == "" || enrolment.Secret == "" {
+		return enrolment, ErrTOTPEnrolment
+	}
+
+	if time.Now().Unix()-enrolment.Issued > prm.sessionTimeout() {
+		return enrolment, ErrTokenExpired
+	}
+
+	if subtle.ConstantTimeCompare([]byte(enrolment.Fingerprint), []byte(clientFingerprint(r))) != 1 {
+		return enrolment, ErrTokenFingerprint
+	}
+
+	return enrolment, nil
+}
+
+// checkTOTPEnrolment checks a code from the users app against an enrolment
+// token, returning the enrolment and the step the code was for. The token is
+// only used up by a right code, so a mistyped one can be tried again, up to
+// totpEnrolAttempts times
+func (prm *PRM) checkTOTPEnrolment(sealed string, totp string, r *http.Request) (enrolment totpEnrolment, step int64, code int) {
+	enrolment, err := prm.openTOTPEnrolment(sealed, r)
+	if err != nil {
+		prm.LogPRM("ConfirmTOTPEnrolment Warning: "+err.Error(), LOG_WARN)
+		return enrolment, 0, tokenResult(err)
+	}
+
+	secret, err := totpEncoding.DecodeString(enrolment.Secret)
+	if err != nil {
+		return enrolment, 0, ErrorFatal
+	}
+
+	expires := time.Unix(enrolment.Issued+prm.sessionTimeout(), 0)
+
+	step, ok := verifyTOTP(secret, totp, time.Now(), 0)
+	if !ok {
+		prm.AuditPRM("totp-enrol-failed", enrolment.Username, r)
+
+		// Too many wrong codes use the token up, so it can't be guessed
+		if prm.countFailure("totp-enrol-failed\n"+enrolment.Nonce, enrolment.Username, totpEnrolAttempts) >= totpEnrolAttempts {
+			prm.replayCache().Use(enrolment.Nonce, expires)
+			return enrolment, 0, ErrorToken
+		}
+		return enrolment, 0, ErrorTOTP
+	}
+
+	if err := prm.replayCache().Use(enrolment.Nonce, expires); err != nil {
+		prm.LogPRM("ConfirmTOTPEnrolment Warning: "+err.Error(), LOG_WARN)
+		return enrolment, 0, tokenResult(err)
+	}
+
+	return enrolment, step, Success
+}
+
+// ConfirmTOTPEnrolment checks a code from the users app against the new
+// secret and, if it matches, stores the secret. It returns the recovery
+// codes, which are only ever shown this once. If the code was wrong but can
+// be tried again the enrolment is returned too, to show the page again
+func (prm *PRM) ConfirmTOTPEnrolment(r *http.Request) (codes []string, retry TOTPEnrolment, code int) {
+	r.ParseForm()
+
+	if !prm.TOTPEnabled() {
+		return nil, retry, ErrorNotImplemented
+	}
+
+	if !prm.checkCSRF(r) {
+		return nil, retry, ErrorCSRF
+	}
+
+	_, _, _, _, _, sealed, _ := prm.parseForm(r)
+	totp := strings.Join(r.Form["totp"], "")
+
+	enrolment, step, code := prm.checkTOTPEnrolment(sealed, totp, r)
+	if code == ErrorTOTP {
+		var err error
+		if retry, err = prm.newTOTPEnrolment(sealed, enrolment.Username, enrolment.Secret); err != nil {
+			prm.LogPRM("ConfirmTOTPEnrolment Error: "+err.Error(), LOG_ERROR)
+		}
+		return nil, retry, code
+	}
+	if code != Success {
+		return nil, retry, code
+	}
+
+	record, codes, err := prm.newTOTPRecord(enrolment.Username, enrolment.Secret, step)
+	if err != nil {
+		prm.LogPRM("ConfirmTOTPEnrolment Error: "+err.Error(), LOG_ERROR)
+		return nil, retry, ErrorFatal
+	}
+
+	conn, err := prm.ldapConnect()
+	if err != nil || conn == nil {
+		return nil, retry, ErrorFatal
+	}
+	defer conn.Close()
+
+	if err := prm.ldapBindAdmin(conn); err != nil {
+		prm.LogPRM(err.Error(), LOG_ERROR)
+		return nil, retry, ErrorFatal
+	}
+
+	if err := prm.writeTOTPRecord(enrolment.Username, record, conn); err != nil {
+		prm.LogPRM("ConfirmTOTPEnrolment Error: "+err.Error(), LOG_ERROR)
+		return nil, retry, ErrorLDAP
+	}
+
+	prm.AuditPRM("totp-enrolled", enrolment.Username, r)
+	return codes, retry, SuccessEnrolled
+}
@@ -0,0 +1,311 @@
+package prm
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test against the SHA1 vectors from RFC 6238 appendix B
+func TestHOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	test_map := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+
+	for unix, want := range test_map {
+		if got := hotp(secret, uint64(totpStep(time.Unix(unix, 0))), 8); got != want {
+			t.Error("For:", unix, "got:", got)
+		}
+	}
+}
+
+// Test codes are accepted either side of now, and only once
+func TestVerifyTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+
+	code := hotp(secret, uint64(step), totpDigits)
+	if got, ok := verifyTOTP(secret, code[:3]+" "+code[3:], now, 0); !ok || got != step {
+		t.Error("For: current code got:", got, ok)
+	}
+
+	if _, ok := verifyTOTP(secret, hotp(secret, uint64(step-1), totpDigits), now, 0); !ok {
+		t.Error("For: previous code got: false")
+	}
+
+	if _, ok := verifyTOTP(secret, hotp(secret, uint64(step-2), totpDigits), now, 0); ok {
+		t.Error("For: stale code got: true")
+	}
+
+	if _, ok := verifyTOTP(secret, code, now, step); ok {
+		t.Error("For: reused code got: true")
+	}
+
+	if _, ok := verifyTOTP(secret, "", now, 0); ok {
+		t.Error("For: empty code got: true")
+	}
+}
+
+// Test recovery codes match however they are typed and only work once
+func TestRecoveryCodes(t *testing.T) {
+	prm := newTOTPPRM()
+	record, codes, err := prm.newTOTPRecord("abc123", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != recoveryCodeCount || len(record.Recovery) != recoveryCodeCount {
+		t.Fatal("Expected", recoveryCodeCount, "codes, got:", len(codes), len(record.Recovery))
+	}
+
+	if strings.Contains(strings.Join(record.Recovery, ""), normaliseCode(codes[0])) || !strings.HasPrefix(record.Recovery[0], recoveryHashPrefix) {
+		t.Error("For: stored codes got:", record.Recovery)
+	}
+
+	if prm.useRecoveryCode("def456", record, codes[3]) {
+		t.Error("For: another user got: true")
+	}
+
+	typed := strings.ToUpper(strings.Replace(codes[3], "-", " ", -1))
+	if !prm.useRecoveryCode("abc123", record, typed) {
+		t.Error("For:", typed, "got: false")
+	}
+
+	if prm.useRecoveryCode("abc123", record, codes[3]) {
+		t.Error("For: reused", codes[3], "got: true")
+	}
+
+	if len(record.Recovery) != recoveryCodeCount-1 {
+		t.Error("Expected one code used, got:", len(record.Recovery))
+	}
+}
+
+func newTOTPPRM() *PRM {
+	var prm = new(PRM)
+	prm.Config = new(PRMConfig)
+	prm.Config.Uffer = "0123456789ABCDEF"
+	prm.Config.TOTPAttribute = "prmTOTPSecret"
+	prm.Config.TOTPRequiredGroups = []string{"admins"}
+	return prm
+}
+
+// Test the record survives sealing into the attribute
+func TestTOTPRecordSealed(t *testing.T) {
+	prm := newTOTPPRM()
+	record, _, _ := prm.newTOTPRecord("abc123", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", 42)
+
+	plaintext := `{"s":"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ","l":42,"r":[]}`
+	sealed, err := prm.sealKeyed(ufferTOTP, []byte(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := &ldap.Entry{DN: "uid=abc123", Attributes: []*ldap.EntryAttribute{
+		{Name: "prmTOTPSecret", Values: []string{sealed}},
+	}}
+
+	got, err := prm.readTOTPRecord(entry)
+	if err != nil || got.Secret != record.Secret || got.LastStep != 42 {
+		t.Error("For: sealed record got:", got, err)
+	}
+
+	if _, err := prm.readTOTPRecord(&ldap.Entry{DN: "uid=abc123"}); err != ErrTOTPNotEnrolled {
+		t.Error("For: no attribute got:", err)
+	}
+}
+
+// Test the group policy and the handling of users who have not enrolled
+func TestCheckTOTPPolicy(t *testing.T) {
+	prm := newTOTPPRM()
+	var conn = new(TestConn)
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234"}
+
+	member := &ldap.Entry{DN: "uid=abc123", Attributes: []*ldap.EntryAttribute{
+		{Name: "memberOf", Values: []string{"cn=Admins,ou=Groups,dc=example"}},
+	}}
+	other := &ldap.Entry{DN: "uid=abc123", Attributes: []*ldap.EntryAttribute{
+		{Name: "memberOf", Values: []string{"cn=users,ou=Groups,dc=example"}},
+	}}
+
+	if code := prm.CheckTOTP("abc123", member, "", conn, r); code != ErrorTOTPRequired {
+		t.Error("For: unenrolled admin got:", code)
+	}
+
+	if code := prm.CheckTOTP("abc123", other, "", conn, r); code != Success {
+		t.Error("For: unenrolled user got:", code)
+	}
+
+	prm.Config.TOTPAttribute = ""
+	if code := prm.CheckTOTP("abc123", member, "", conn, r); code != Success {
+		t.Error("For: TOTP disabled got:", code)
+	}
+}
+
+// Test a good code is refused if its use can't be recorded
+func TestCheckTOTPRecordFails(t *testing.T) {
+	prm := newTOTPPRM()
+	var conn = new(TestConn)
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234"}
+
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	sealed, _ := prm.sealKeyed(ufferTOTP, []byte(`{"s":"`+secret+`","l":0,"r":[]}`))
+	entry := &ldap.Entry{DN: "uid=abc123", Attributes: []*ldap.EntryAttribute{
+		{Name: "prmTOTPSecret", Values: []string{sealed}},
+	}}
+
+	raw, _ := totpEncoding.DecodeString(secret)
+	code := hotp(raw, uint64(totpStep(time.Now())), totpDigits)
+
+	if result := prm.CheckTOTP("abc123", entry, "000000x", conn, r); result != ErrorTOTP {
+		t.Error("For: wrong code got:", result)
+	}
+
+	if result := prm.CheckTOTP("abc123", entry, code, conn, r); result != ErrorFatal {
+		t.Error("For: failing modify got:", result)
+	}
+}
+
+// Test codes stop being checked once too many have been tried, even a right
+// one
+func TestCheckTOTPLocked(t *testing.T) {
+	prm, cleanup := newNotifyPRM(t, NotifyTOTPLocked)
+	defer cleanup()
+	prm.Config.TOTPAttribute = "prmTOTPSecret"
+	prm.Config.TOTPMaxTries = 3
+	var conn = new(TestConn)
+	r := httptest.NewRequest("POST", "/change", nil)
+
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	sealed, _ := prm.sealKeyed(ufferTOTP, []byte(`{"s":"`+secret+`","l":0,"r":[]}`))
+	entry := notifyEntry(&ldap.EntryAttribute{Name: "prmTOTPSecret", Values: []string{sealed}})
+
+	raw, _ := totpEncoding.DecodeString(secret)
+	code := hotp(raw, uint64(totpStep(time.Now())), totpDigits)
+
+	for i := 0; i < prm.Config.TOTPMaxTries; i++ {
+		if result := prm.CheckTOTP("abc123", entry, "000000x", conn, r); result != ErrorTOTP {
+			t.Error("For: wrong code", i, "got:", result)
+		}
+	}
+
+	if result := prm.CheckTOTP("abc123", entry, code, conn, r); result != ErrorTOTPLocked {
+		t.Error("For: right code after too many wrong ones got:", result)
+	}
+
+	if n := queued(t, prm); n != 1 {
+		t.Error("For: notices got:", n)
+	}
+}
+
+// Test the URI and QR code for the app
+func TestTOTPEnrolmentURI(t *testing.T) {
+	prm := newTOTPPRM()
+	prm.Config.TOTPIssuer = "ITS Research"
+
+	uri := prm.totpURI("abc123", "GEZDGNBV")
+	if !strings.HasPrefix(uri, "otpauth://totp/ITS%20Research:abc123?") || !strings.Contains(uri, "secret=GEZDGNBV") {
+		t.Error("For: abc123 got:", uri)
+	}
+
+	qr, err := totpQR(uri)
+	if err != nil || !strings.HasPrefix(qr, "data:image/png;base64,") {
+		t.Error("For: QR got:", qr[:30], err)
+	}
+}
+
+// newEnrolmentToken seals an enrolment token for a request, as
+// BeginTOTPEnrolment does
+func newEnrolmentToken(t *testing.T, prm *PRM, secret string, r *http.Request) string {
+	nonce, _ := newPendingID()
+	plaintext, _ := json.Marshal(totpEnrolment{Username: "abc123", Secret: secret, Issued: time.Now().Unix(),
+		Nonce: nonce, Fingerprint: clientFingerprint(r)})
+
+	sealed, err := prm.sealKeyed(ufferEnrolment, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+// Test a mistyped code doesn't use up the enrolment token, but a right code
+// does, and too many wrong codes do too
+func TestCheckTOTPEnrolment(t *testing.T) {
+	prm := newTOTPPRM()
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234"}
+
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	raw, _ := totpEncoding.DecodeString(secret)
+	code := hotp(raw, uint64(totpStep(time.Now())), totpDigits)
+	// A wrong code that isn't right for any step either side of now either
+	var n int
+	fmt.Sscanf(code, "%d", &n)
+	wrong := code
+	for _, ok := verifyTOTP(raw, wrong, time.Now(), 0); ok; _, ok = verifyTOTP(raw, wrong, time.Now(), 0) {
+		n = (n + 1) % 1000000
+		wrong = fmt.Sprintf("%06d", n)
+	}
+
+	sealed := newEnrolmentToken(t, prm, secret, r)
+
+	if _, _, result := prm.checkTOTPEnrolment(sealed, wrong, r); result != ErrorTOTP {
+		t.Error("For: wrong code got:", result)
+	}
+	if enrolment, step, result := prm.checkTOTPEnrolment(sealed, code, r); result != Success || step == 0 || enrolment.Secret != secret {
+		t.Error("For: right code after a wrong one got:", result, step)
+	}
+	if _, _, result := prm.checkTOTPEnrolment(sealed, code, r); result != ErrorTokenReplayed {
+		t.Error("For: right code again got:", result)
+	}
+
+	sealed = newEnrolmentToken(t, prm, secret, r)
+	for i := 1; i < totpEnrolAttempts; i++ {
+		if _, _, result := prm.checkTOTPEnrolment(sealed, wrong, r); result != ErrorTOTP {
+			t.Error("For: wrong code", i, "got:", result)
+		}
+	}
+	if _, _, result := prm.checkTOTPEnrolment(sealed, wrong, r); result != ErrorToken {
+		t.Error("For: last wrong code got:", result)
+	}
+	if _, _, result := prm.checkTOTPEnrolment(sealed, code, r); result != ErrorTokenReplayed {
+		t.Error("For: right code after too many wrong ones got:", result)
+	}
+
+	other := &http.Request{RemoteAddr: "10.0.0.2:1234"}
+	if _, _, result := prm.checkTOTPEnrolment(newEnrolmentToken(t, prm, secret, r), code, other); result != ErrorTokenClient {
+		t.Error("For: another client got:", result)
+	}
+}
+
+// Test an enrolment token can't be used as a session token, even one with
+// every field a session token needs
+func TestEnrolmentTokenNotSession(t *testing.T) {
+	prm := newTOTPPRM()
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{"User-Agent": {"test"}}}
+
+	plaintext, _ := json.Marshal(map[string]interface{}{"u": "abc123", "i": "00ff", "s": "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		"t": time.Now().Unix(), "n": "00ff", "f": clientFingerprint(r)})
+	sealed, err := prm.sealKeyed(ufferEnrolment, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := prm.openTOTPEnrolment(sealed, r); err != nil {
+		t.Fatal("For: enrolment got:", err)
+	}
+	if _, err := prm.VerifySessionToken(sealed, r); err != ErrTokenInvalid {
+		t.Error("For: enrolment as a session got:", err)
+	}
+}
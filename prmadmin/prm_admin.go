@@ -0,0 +1,335 @@
+/*
+prm-admin
+
+This is a command line tool for the helpdesk, working directly on the LDAP
+entries the password manager uses. It reads the same config file as the
+server, given with -config or in UPRM_CONFIG_FILE.
+
+Command-line interface:
+
+To give a user a one-time account unlocking code, optionally emailing it to
+their alternate address:
+
+	prm-admin otp issue <user> [-ttl 72h] [-email]
+
+To show or remove a users one-time code. Codes are stored hashed, so show
+can only tell you when they expire:
+
+	prm-admin otp show <user>
+	prm-admin otp revoke <user>
+
+To rehash every one-time code still stored in the clear:
+
+	prm-admin otp migrate [-n]
+
+To list the emails waiting to be sent, and those that have given up:
+
+	prm-admin mail queue
+
+To try every waiting email now, or put dead ones back in the queue:
+
+	prm-admin mail flush
+	prm-admin mail requeue <id>... | -all
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"pass.hpc.qmul.ac.uk/prm"
+	"path/filepath"
+	"time"
+)
+
+// usage is printed for -h or when a command is not recognised
+const usage = `Usage:
+  prm-admin [-config file] otp issue <user> [-ttl 72h] [-email]
+  prm-admin [-config file] otp show <user>
+  prm-admin [-config file] otp revoke <user>
+  prm-admin [-config file] otp migrate [-n]
+  prm-admin [-config file] mail queue
+  prm-admin [-config file] mail flush
+  prm-admin [-config file] mail requeue <id>... | -all
+`
+
+// fatal prints an error and exits
+func fatal(msg string) {
+	fmt.Fprintln(os.Stderr, "prm-admin: "+msg)
+	os.Exit(1)
+}
+
+// actor is who ran the command, for the audit log
+func actor() string {
+	if user := os.Getenv("SUDO_USER"); user != "" {
+		return user
+	}
+	return os.Getenv("USER")
+}
+
+// parseInterspersed parses flags that may come before or after the
+// positional arguments, returning the positional arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// otpIssue gives a user a new one-time code
+func otpIssue(p *prm.PRM, args []string) {
+	fs := flag.NewFlagSet("otp issue", flag.ExitOnError)
+	ttl := fs.Duration("ttl", 72*time.Hour, "how long the code lasts")
+	email := fs.Bool("email", false, "email the code to the users alternate address")
+	users := parseInterspersed(fs, args)
+
+	if len(users) != 1 {
+		fatal("otp issue needs exactly one user")
+	}
+	if *ttl <= 0 {
+		fatal("-ttl must be positive")
+	}
+
+	conn, err := p.Connect()
+	if err != nil {
+		fatal(err.Error())
+	}
+	defer conn.Close()
+
+	code, expires, err := p.IssueOTP(users[0], *ttl, conn)
+	if err != nil {
+		fatal(users[0] + ": " + err.Error())
+	}
+	p.AuditPRM("otp-issued", users[0], nil, "by="+actor(), "expires="+expires.Format(time.RFC3339))
+
+	fmt.Printf("%v: %v (expires %v)\n", users[0], code, expires.Format("2006-01-02 15:04 MST"))
+
+	if *email {
+		address, err := p.EmailOTP(users[0], code, expires, conn)
+		if err != nil {
+			fatal("the code was issued but could not be emailed: " + err.Error())
+		}
+		fmt.Println("Emailed to", address)
+	}
+}
+
+// otpShow prints a users one-time code
+func otpShow(p *prm.PRM, args []string) {
+	fs := flag.NewFlagSet("otp show", flag.ExitOnError)
+	users := parseInterspersed(fs, args)
+
+	if len(users) != 1 {
+		fatal("otp show needs exactly one user")
+	}
+
+	conn, err := p.Connect()
+	if err != nil {
+		fatal(err.Error())
+	}
+	defer conn.Close()
+
+	info, err := p.ShowOTP(users[0], conn)
+	if err != nil {
+		fatal(users[0] + ": " + err.Error())
+	}
+
+	state := "expires"
+	if time.Now().After(info.Expires) {
+		state = "expired"
+	}
+	code := info.Code
+	if info.Hashed {
+		code = "code stored hashed"
+	}
+	fmt.Printf("%v: %v (%v %v)\n", users[0], code, state, info.Expires.Format("2006-01-02 15:04 MST"))
+}
+
+// otpRevoke removes a users one-time code
+func otpRevoke(p *prm.PRM, args []string) {
+	fs := flag.NewFlagSet("otp revoke", flag.ExitOnError)
+	users := parseInterspersed(fs, args)
+
+	if len(users) != 1 {
+		fatal("otp revoke needs exactly one user")
+	}
+
+	conn, err := p.Connect()
+	if err != nil {
+		fatal(err.Error())
+	}
+	defer conn.Close()
+
+	if err := p.RevokeOTP(users[0], conn); err != nil {
+		fatal(users[0] + ": " + err.Error())
+	}
+	p.AuditPRM("otp-revoked", users[0], nil, "by="+actor())
+
+	fmt.Println(users[0] + ": one-time code revoked")
+}
+
+// otpMigrate rehashes every one-time code still stored in the clear
+func otpMigrate(p *prm.PRM, args []string) {
+	fs := flag.NewFlagSet("otp migrate", flag.ExitOnError)
+	dryRun := fs.Bool("n", false, "only list the users that would be migrated")
+	if len(parseInterspersed(fs, args)) != 0 {
+		fatal("otp migrate takes no users")
+	}
+	if p.Config.OTPEncoding == prm.OTPEncodingPlain {
+		fatal("otpencoding is plain, so there is nothing to migrate to")
+	}
+
+	conn, err := p.Connect()
+	if err != nil {
+		fatal(err.Error())
+	}
+	defer conn.Close()
+
+	users, err := p.LegacyOTPUsers(conn)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	failed := 0
+	for _, user := range users {
+		if *dryRun {
+			fmt.Println(user + ": would be migrated")
+			continue
+		}
+
+		migrated, err := p.MigrateOTP(user, conn)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "prm-admin: "+user+": "+err.Error())
+			failed++
+			continue
+		}
+		if migrated {
+			p.AuditPRM("otp-migrated", user, nil, "by="+actor())
+			fmt.Println(user + ": migrated")
+		}
+	}
+
+	if failed > 0 {
+		fatal(fmt.Sprintf("%d of %d codes could not be migrated", failed, len(users)))
+	}
+}
+
+// mailQueue lists the emails in the spool
+func mailQueue(p *prm.PRM, args []string) {
+	fs := flag.NewFlagSet("mail queue", flag.ExitOnError)
+	if len(parseInterspersed(fs, args)) != 0 {
+		fatal("mail queue takes no arguments")
+	}
+
+	emails, err := p.MailQueue()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	for _, email := range emails {
+		state := "next try " + time.Unix(email.Next, 0).Format("2006-01-02 15:04 MST")
+		if email.Dead {
+			state = "dead"
+		}
+		fmt.Printf("%v %v %q queued %v, %d tries, %v\n", email.ID, email.To, email.Subject,
+			time.Unix(email.Queued, 0).Format("2006-01-02 15:04 MST"), email.Attempts, state)
+		if email.Error != "" {
+			fmt.Println("    " + email.Error)
+		}
+	}
+	fmt.Printf("%d emails\n", len(emails))
+}
+
+// mailFlush tries every waiting email now
+func mailFlush(p *prm.PRM, args []string) {
+	fs := flag.NewFlagSet("mail flush", flag.ExitOnError)
+	if len(parseInterspersed(fs, args)) != 0 {
+		fatal("mail flush takes no arguments")
+	}
+	if p.Config.MailSpoolPath == "" {
+		fatal("mailspoolpath is not set")
+	}
+
+	sent, failed := p.ProcessMailQueue(true)
+	fmt.Printf("%d sent, %d failed\n", sent, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// mailRequeue puts dead emails back in the queue
+func mailRequeue(p *prm.PRM, args []string) {
+	fs := flag.NewFlagSet("mail requeue", flag.ExitOnError)
+	all := fs.Bool("all", false, "requeue every dead email")
+	ids := parseInterspersed(fs, args)
+
+	if *all == (len(ids) != 0) {
+		fatal("mail requeue needs ids or -all")
+	}
+
+	if *all {
+		emails, err := p.MailQueue()
+		if err != nil {
+			fatal(err.Error())
+		}
+		for _, email := range emails {
+			if email.Dead {
+				ids = append(ids, email.ID)
+			}
+		}
+	}
+
+	failed := 0
+	for _, id := range ids {
+		if err := p.RequeueMail(id); err != nil {
+			fmt.Fprintln(os.Stderr, "prm-admin: "+id+": "+err.Error())
+			failed++
+			continue
+		}
+		p.AuditPRM("mail-requeued", "", nil, "by="+actor(), "id="+id)
+		fmt.Println(id + ": requeued")
+	}
+
+	if failed > 0 {
+		fatal(fmt.Sprintf("%d of %d emails could not be requeued", failed, len(ids)))
+	}
+}
+
+func main() {
+	configFile := flag.String("config", os.Getenv("UPRM_CONFIG_FILE"), "the prm config file")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	commands := map[string]map[string]func(*prm.PRM, []string){
+		"otp": {
+			"issue":   otpIssue,
+			"show":    otpShow,
+			"revoke":  otpRevoke,
+			"migrate": otpMigrate,
+		},
+		"mail": {
+			"queue":   mailQueue,
+			"flush":   mailFlush,
+			"requeue": mailRequeue,
+		},
+	}
+
+	args := flag.Args()
+	if len(args) < 2 || commands[args[0]][args[1]] == nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	p := new(prm.PRM)
+	filename, _ := filepath.Abs(*configFile)
+	if err := prm.ReadConfigFile(p, filename); err != nil {
+		fatal(err.Error())
+	}
+
+	commands[args[0]][args[1]](p, args[2:])
+}
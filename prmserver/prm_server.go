@@ -9,22 +9,27 @@ Command-line interface:
 
 To return the current version number:
 
-		prm_server -v
+	prm_server -v
+
+To print a new random key for the uffer keyring:
+
+	prm_server keygen
+
+To check the mail settings by sending a test message:
+
+	prm_server -test-email <address>
 */
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"gopkg.in/yaml.v2"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/fcgi"
-	"os"
 	"pass.hpc.qmul.ac.uk/prm"
-	"path/filepath"
 	"strings"
 )
 
@@ -32,50 +37,70 @@ import (
 type Page struct {
 	Title   string
 	Message string
-	Wuffer  string
-	Puffer  string
-	Tuffer  string
+	Token   string
+	CSRF    string
+	Secret  string
+	QR      template.URL
+	Codes   []string
 }
 
 // FastCGIServer is our basic struct for state on the server
 type FastCGIServer struct {
 	PRMHandler prm.PRM
+	router     *prm.Router
 }
 
 // renderIndex renders the first index page reading in the index.html template and setting it
 func renderIndex(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
-	config := p.Config
+	lang := p.Language(w, r)
 	title := r.URL.Path[len("/"):]
-	g := &Page{Title: title, Message: ""}
-	t, _ := template.ParseFiles(config.TemplatePath + "index.html")
+	csrf, err := p.CSRFToken(w, r)
+	if err != nil {
+		p.LogPRM("CSRFToken Error: "+err.Error(), prm.LOG_ERROR)
+	}
+	g := &Page{Title: title, Message: "", CSRF: csrf}
+	t, _ := p.Template(r, lang, "index.html")
 	t.Execute(w, g)
 }
 
 // processForm handles the form on the first page, passing the form to the prm module
 func processForm(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
-	config := p.Config
+	lang := p.Language(w, r)
 	result, data := p.ProcessForm(r)
 	if result.Message != prm.Success {
-		g := &Page{Title: "Error", Message: result.ToString()}
-		t, _ := template.ParseFiles(config.TemplatePath + "error.html")
+		message := p.ResultMessage(result, lang)
+		if data["reason"] != "" {
+			message += " (" + prm.TranslateReason(p.Config, lang, data) + ")"
+		}
+		g := &Page{Title: "Error", Message: message}
+		t, _ := p.Template(r, lang, "error.html")
 		p.LogPRM(result.ToString(), prm.LOG_DEBUG)
 
 		t.Execute(w, g)
 		return
 	}
-	// If we have an otp show terms and conditions otherwise dont
-	if len(data["otp"]) > 0 {
-		g := &Page{Title: "Terms and conditions", Message: result.ToString(), Wuffer: data["wuffer"], Puffer: data["puffer"], Tuffer: data["tuffer"]}
-		t, _ := template.ParseFiles(config.TemplatePath + "terms.html")
+
+	finishChange(w, r, p, result, data)
+}
+
+// finishChange shows the terms and conditions after a form has been accepted
+// or, if they are not needed, makes the change straight away
+func finishChange(w http.ResponseWriter, r *http.Request, p *prm.PRM, result prm.Result, data map[string]string) {
+	lang := p.Language(w, r)
+	// Show the terms and conditions if prm says this user needs them
+	if data["terms"] != "" {
+		csrf, _ := p.CSRFToken(w, r)
+		g := &Page{Title: "Terms and conditions", Message: p.ResultMessage(result, lang), Token: data["token"], CSRF: csrf}
+		t, _ := p.Template(r, lang, "terms.html")
 		t.Execute(w, g)
 	} else {
 
 		// Make the attempt to change the data now
-		result, data = p.ProcessSkipped(r)
+		result, data = p.ProcessSkipped(r, data["token"])
 
 		if result.Message != prm.SuccessFinished {
-			g := &Page{Title: "Error", Message: result.ToString()}
-			t, _ := template.ParseFiles(config.TemplatePath + "error.html")
+			g := &Page{Title: "Error", Message: p.ResultMessage(result, lang)}
+			t, _ := p.Template(r, lang, "error.html")
 			p.LogPRM(result.ToString(), prm.LOG_ERROR)
 
 			t.Execute(w, g)
@@ -86,8 +111,9 @@ func processForm(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
 			username := data["username"]
 			p.LogPRM(username+" with IP "+r.RemoteAddr+" successfully set password", prm.LOG_INFO)
 
-			g := &Page{Title: "Success", Message: result.ToString()}
-			t, _ := template.ParseFiles(config.TemplatePath + "success.html")
+			// Any new recovery codes are shown here and never again
+			g := &Page{Title: "Success", Message: p.ResultMessage(result, lang), Codes: strings.Fields(data["recovery"])}
+			t, _ := p.Template(r, lang, "success.html")
 			t.Execute(w, g)
 		}
 	}
@@ -97,11 +123,11 @@ func processForm(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
 // Essentially the same as above for now
 func processTerms(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
 
-	config := p.Config
+	lang := p.Language(w, r)
 	result, data := p.ProcessTerms(r)
 	if result.Message != prm.SuccessFinished {
-		g := &Page{Title: "Error", Message: result.ToString()}
-		t, _ := template.ParseFiles(config.TemplatePath + "error.html")
+		g := &Page{Title: "Error", Message: p.ResultMessage(result, lang)}
+		t, _ := p.Template(r, lang, "error.html")
 		p.LogPRM(result.ToString(), prm.LOG_DEBUG)
 
 		t.Execute(w, g)
@@ -112,153 +138,275 @@ func processTerms(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
 	username := data["username"]
 	p.LogPRM(username+" with IP "+r.RemoteAddr+" successfully set password", prm.LOG_INFO)
 
-	g := &Page{Title: "Success", Message: result.ToString()}
-	t, _ := template.ParseFiles(config.TemplatePath + "success.html")
+	g := &Page{Title: "Success", Message: p.ResultMessage(result, lang), Codes: strings.Fields(data["recovery"])}
+	t, _ := p.Template(r, lang, "success.html")
 	t.Execute(w, g)
 	return
 
 }
 
-// processPassword processes a password in an ajax style. It is here for the
-// cracklib check which is sent by jquery everytime the user enters a new password
-func processPassword(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
-	r.ParseForm()
-	password := strings.Join(r.Form["password"], "")
-	fmt.Fprintf(w, prm.TestPassword(password))
+// renderEnrol shows the form for setting up an authenticator app
+func renderEnrol(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
+	lang := p.Language(w, r)
+	csrf, err := p.CSRFToken(w, r)
+	if err != nil {
+		p.LogPRM("CSRFToken Error: "+err.Error(), prm.LOG_ERROR)
+	}
+	g := &Page{Title: "Set up an authenticator app", CSRF: csrf}
+	t, _ := p.Template(r, lang, "enrol.html")
+	t.Execute(w, g)
 }
 
-// ServeHTTP deals with the URLs, providing the correct response given the URL
-func (s *FastCGIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-
-	//http.HandleFunc("/", renderIndex)
-	//http.HandleFunc("/change", processForm)
+// processEnrol checks the users password and shows the new secret as a QR
+// code for them to scan
+func processEnrol(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
+	lang := p.Language(w, r)
+	enrolment, code := p.BeginTOTPEnrolment(r)
+	if code != prm.Success {
+		result := prm.Result{Message: code}
+		g := &Page{Title: "Error", Message: p.ResultMessage(result, lang)}
+		t, _ := p.Template(r, lang, "error.html")
+		p.LogPRM(result.ToString(), prm.LOG_DEBUG)
 
-	if r.URL.Path == "/" {
-		renderIndex(w, r, &s.PRMHandler)
-		return
-	} else if r.URL.Path == "/change" {
-		processForm(w, r, &s.PRMHandler)
-		return
-	} else if r.URL.Path == "/accept" {
-		processTerms(w, r, &s.PRMHandler)
-		return
-	} else if r.URL.Path == "/check" {
-		processPassword(w, r, &s.PRMHandler)
+		t.Execute(w, g)
 		return
 	}
 
-	s.PRMHandler.LogPRM("Path not found: "+r.URL.Path, prm.LOG_DEBUG)
-	http.NotFound(w, r)
-	return
+	// The QR code is a data URI made by prm, so it is safe to use as is
+	csrf, _ := p.CSRFToken(w, r)
+	g := &Page{Title: "Scan the code", Token: enrolment.Token, CSRF: csrf, Secret: enrolment.Secret, QR: template.URL(enrolment.QR)}
+	t, _ := p.Template(r, lang, "enrol_confirm.html")
+	t.Execute(w, g)
 }
 
-// ReadConfig reads in the YAML config file, setting the PRMConfig used
-// throughout the system
-func ReadConfig(p *prm.PRM) {
+// processEnrolConfirm checks a code from the newly set up app and shows the
+// recovery codes, the only time they are ever shown
+func processEnrolConfirm(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
+	lang := p.Language(w, r)
+	codes, retry, code := p.ConfirmTOTPEnrolment(r)
+	result := prm.Result{Message: code}
+
+	// A mistyped code can be tried again without scanning a new QR code
+	if retry.Token != "" {
+		csrf, _ := p.CSRFToken(w, r)
+		g := &Page{Title: "Scan the code", Message: p.ResultMessage(result, lang), Token: retry.Token, CSRF: csrf, Secret: retry.Secret, QR: template.URL(retry.QR)}
+		t, _ := p.Template(r, lang, "enrol_confirm.html")
+		t.Execute(w, g)
+		return
+	}
 
-	yamlConfig := prm.YamlConfig{}
-	// Attempt an env read then /usr/local/secret first then locally
-	filename, _ := filepath.Abs(os.Getenv("UPRM_CONFIG_FILE"))
-	yamlFile, err := ioutil.ReadFile(filename)
+	if code != prm.SuccessEnrolled {
+		g := &Page{Title: "Error", Message: p.ResultMessage(result, lang)}
+		t, _ := p.Template(r, lang, "error.html")
+		p.LogPRM(result.ToString(), prm.LOG_DEBUG)
 
-	if err != nil {
-		panic(err)
+		t.Execute(w, g)
+		return
 	}
 
-	err = yaml.Unmarshal(yamlFile, &yamlConfig)
+	g := &Page{Title: "Recovery codes", Message: p.ResultMessage(result, lang), Codes: codes}
+	t, _ := p.Template(r, lang, "enrol_done.html")
+	t.Execute(w, g)
+}
+
+// renderForgot shows the form for asking for a reset link
+func renderForgot(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
+	lang := p.Language(w, r)
+	csrf, err := p.CSRFToken(w, r)
 	if err != nil {
-		panic(err)
+		p.LogPRM("CSRFToken Error: "+err.Error(), prm.LOG_ERROR)
 	}
+	g := &Page{Title: "Forgotten password", CSRF: csrf}
+	t, _ := p.Template(r, lang, "forgot.html")
+	t.Execute(w, g)
+}
+
+// processForgot emails a reset link. The page shown is the same whether or
+// not one was sent
+func processForgot(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
+	lang := p.Language(w, r)
+	result := p.ProcessForgot(r)
+	if result.Message != prm.SuccessResetSent {
+		g := &Page{Title: "Error", Message: p.ResultMessage(result, lang)}
+		t, _ := p.Template(r, lang, "error.html")
+		p.LogPRM(result.ToString(), prm.LOG_DEBUG)
 
-	// Now convert
-	p.Config = new(prm.PRMConfig)
-	config := p.Config
-
-	// Potentially we should set all to defaults and check for missing
-	config.TemplatePath = yamlConfig.TemplatePath
-	config.ListenAddress = yamlConfig.ListenAddress
-	config.LDAPHost = yamlConfig.LDAPHost
-	config.LDAPPort = yamlConfig.LDAPPort
-	config.BindPassword = yamlConfig.BindPassword
-	config.CertFilePath = yamlConfig.CertFilePath
-	config.BaseDN = yamlConfig.BaseDN
-	config.BindDN = yamlConfig.BindDN
-	config.EmailMsg = yamlConfig.EmailMsg
-	config.EmailSub = yamlConfig.EmailSub
-	config.LogLevel = prm.LOG_ERROR
-	config.Uffer = yamlConfig.Uffer
-	config.LDAPInsecureSkipVerify = yamlConfig.LDAPInsecureSkipVerify
-	config.PasswordModifyLDAP = yamlConfig.PasswordModifyLDAP
-	config.ORGFieldLDAP = yamlConfig.ORGFieldLDAP
-	config.UserFieldLDAP = yamlConfig.UserFieldLDAP
-
-	if yamlConfig.LogLevel == "DEBUG" {
-		config.LogLevel = prm.LOG_DEBUG
+		t.Execute(w, g)
+		return
 	}
 
-	if yamlConfig.LogLevel == "INFO" {
-		config.LogLevel = prm.LOG_INFO
+	g := &Page{Title: "Check your email", Message: p.ResultMessage(result, lang)}
+	t, _ := p.Template(r, lang, "forgot_sent.html")
+	t.Execute(w, g)
+}
+
+// renderReset shows the new password form a reset link lands on. The link is
+// only checked here, it is not used up until the form is sent
+func renderReset(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
+	lang := p.Language(w, r)
+	sealed := r.URL.Query().Get("reset")
+	token, err := p.VerifyResetToken(sealed)
+	if err != nil || !p.ResetEnabled() {
+		result := prm.Result{Message: prm.ErrorResetLink}
+		g := &Page{Title: "Error", Message: p.ResultMessage(result, lang)}
+		t, _ := p.Template(r, lang, "error.html")
+
+		t.Execute(w, g)
+		return
 	}
 
-	if yamlConfig.LogLevel == "WARN" {
-		config.LogLevel = prm.LOG_DEBUG
+	csrf, err := p.CSRFToken(w, r)
+	if err != nil {
+		p.LogPRM("CSRFToken Error: "+err.Error(), prm.LOG_ERROR)
 	}
+	g := &Page{Title: "Choose a new password", Message: token.Username, Token: sealed, CSRF: csrf}
+	t, _ := p.Template(r, lang, "reset.html")
+	t.Execute(w, g)
+}
 
-	if yamlConfig.LogLevel == "ERROR" {
-		config.LogLevel = prm.LOG_ERROR
+// processReset checks the new password from a reset link and carries on
+// just as the first form does
+func processReset(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
+	lang := p.Language(w, r)
+	result, data := p.ProcessReset(r)
+	if result.Message != prm.Success {
+		message := p.ResultMessage(result, lang)
+		if data["reason"] != "" {
+			message += " (" + prm.TranslateReason(p.Config, lang, data) + ")"
+		}
+		g := &Page{Title: "Error", Message: message}
+		t, _ := p.Template(r, lang, "error.html")
+		p.LogPRM(result.ToString(), prm.LOG_DEBUG)
+
+		t.Execute(w, g)
+		return
 	}
 
-	//fmt.Printf("Listening on: %#v\n", config.ListenAddress)
+	finishChange(w, r, p, result, data)
+}
 
-	p.Config = config
+// processPassword processes a password in an ajax style. It is here for the
+// cracklib check which is sent by jquery everytime the user enters a new password.
+// Clients that accept JSON get the strength estimate too, with the advice in
+// their language, everyone else just gets the cracklib style message as plain
+// text
+func processPassword(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
+	r.ParseForm()
+	password := strings.Join(r.Form["password"], "")
+	username := strings.Join(r.Form["user"], "")
 
-	p.LogPRM("Path to Templates: "+config.TemplatePath, prm.LOG_INFO)
-	p.LogPRM("Path to CertFile: "+config.CertFilePath, prm.LOG_INFO)
-	p.LogPRM("Log level: "+prm.LogLevelToString(config.LogLevel), prm.LOG_INFO)
-	p.LogPRM("Listen address: "+config.ListenAddress, prm.LOG_DEBUG)
-	p.LogPRM("LDAP Host address: "+config.LDAPHost, prm.LOG_DEBUG)
-	p.LogPRM("LDAP Port: "+string(config.LDAPPort), prm.LOG_DEBUG)
-	p.LogPRM("BaseDN: "+config.BaseDN, prm.LOG_DEBUG)
-	p.LogPRM("BindDN: "+config.BindDN, prm.LOG_DEBUG)
-	p.LogPRM("PasswordModifyLDAP: "+config.PasswordModifyLDAP, prm.LOG_DEBUG)
-	p.LogPRM("ORGFieldLDAP: "+config.ORGFieldLDAP, prm.LOG_DEBUG)
-	p.LogPRM("UserFieldLDAP: "+config.UserFieldLDAP, prm.LOG_DEBUG)
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		report := p.ReportPassword(username, password)
+		json.NewEncoder(w).Encode(p.TranslateReport(report, prm.RequestLanguage(p.Config, r)))
+		return
+	}
 
-	if config.LDAPInsecureSkipVerify {
-		p.LogPRM("LDAP insecure skip verify: true", prm.LOG_DEBUG)
-	} else {
-		p.LogPRM("LDAP insecure skip verify: false", prm.LOG_DEBUG)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, p.CheckPassword(username, password))
+}
+
+// generatePassphrase returns a random diceware style passphrase for users
+// who would rather not invent their own
+func generatePassphrase(w http.ResponseWriter, r *http.Request, p *prm.PRM) {
+	passphrase, err := p.GeneratePassphrase()
+	if err != nil {
+		p.LogPRM("GeneratePassphrase Error: "+err.Error(), prm.LOG_ERROR)
+		http.Error(w, "Unable to generate a passphrase", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"passphrase": passphrase})
+		return
 	}
-	p.LogPRM("uffer: "+config.Uffer, prm.LOG_DEBUG)
-	p.LogPRM("Email message: "+config.EmailMsg, prm.LOG_DEBUG)
-	p.LogPRM("Email subject: "+config.EmailSub, prm.LOG_DEBUG)
 
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, passphrase)
+}
+
+// secureHeaders wraps a handler so every response carries the security
+// headers from the config
+func secureHeaders(p *prm.PRM, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.SetSecurityHeaders(w)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routes sets up which handler serves each URL and the methods it accepts
+func (s *FastCGIServer) routes() {
+	s.router = prm.NewRouter(&s.PRMHandler)
+	s.router.Handle("/", renderIndex, "GET", "HEAD")
+	s.router.Handle("/change", processForm, "POST")
+	s.router.Handle("/accept", processTerms, "POST")
+	s.router.Handle("/check", processPassword, "POST")
+	s.router.Handle("/generate", generatePassphrase, "GET")
+	s.router.Handle("/enrol", renderEnrol, "GET", "HEAD")
+	s.router.Handle("/enrol/begin", processEnrol, "POST")
+	s.router.Handle("/enrol/confirm", processEnrolConfirm, "POST")
+	s.router.Handle("/forgot", renderForgot, "GET", "HEAD")
+	s.router.Handle("/forgot/send", processForgot, "POST")
+	s.router.Handle("/reset", renderReset, "GET", "HEAD")
+	s.router.Handle("/reset/change", processReset, "POST")
+}
+
+// ServeHTTP deals with the URLs, providing the correct response given the URL
+func (s *FastCGIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
 }
 
 func main() {
 	// Test for the version flag
 	var ip = flag.Bool("v", false, "display the version and quit")
+	var testEmail = flag.String("test-email", "", "send a test email to this address and quit")
 	flag.Parse()
 	if *ip == true {
 		fmt.Println(prm.GetVersionString())
 		return
 	}
 
+	// keygen prints a new uffer key for the keyring and quits
+	if flag.Arg(0) == "keygen" {
+		key, err := prm.GenerateUfferKey()
+		if err != nil {
+			log.Fatal("[prm:error]", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
 	fmt.Println("Welcome to the Password Manager - The Next Generation!")
 	prmHandler := new(prm.PRM)
-	ReadConfig(prmHandler)
+	prm.ReadConfig(prmHandler)
+
+	// -test-email sends a message with the configured mail settings and quits
+	if *testEmail != "" {
+		if err := prm.SendTestEmail(prmHandler.Config, *testEmail); err != nil {
+			log.Fatal("[prm:error] test email failed: ", err)
+		}
+		fmt.Println("Test email sent to", *testEmail)
+		return
+	}
 	//listener, err := net.Listen("unix", config.ListenAddress)
 	//if err != nil {
 	//	log.Fatal(err)
 	//}
 	//defer listener.Close()
 
+	// Send queued emails in the background
+	go prmHandler.RunMailQueue()
+
 	// create a server object with the config and PRM handler
 	srv := new(FastCGIServer)
 
 	srv.PRMHandler = *prmHandler
+	srv.routes()
 
-	err := fcgi.Serve(nil, srv)
+	err := fcgi.Serve(nil, secureHeaders(&srv.PRMHandler, srv))
 
 	if err != nil {
 		fmt.Println("error on serve")
@@ -8,11 +8,22 @@ $( document ).ready(function() {
   is_valid["username"] = false;
   is_valid["passwords"] = false;
   is_valid["cracklib"] = false;
-  is_valid["otporpass"] = false;
+  // The reset form has no old password or code to check
+  is_valid["otporpass"] = $('#p0').length == 0;
 
   var p1_visited = false;
   var p2_visited = false;
 
+  // Messages come translated from data attributes on the form, with %s
+  // replaced by the values given in turn
+  function message(name, fallback) {
+    var text = $('#main_form').data(name) || fallback;
+    for (var i = 2; i < arguments.length; i++) {
+      text = text.replace("%s", arguments[i]);
+    }
+    return text;
+  }
+
 
   // is the username valid but dont blank
   function is_username_valid() {
@@ -42,7 +53,7 @@ $( document ).ready(function() {
     if (on){
       if (!($('#user').parent().is('div'))){
         $('#user').wrap("<div class=\"alert alert-danger\"  role=\"alert\">");
-        $('#user').before("<div id=\"user_warning_msg\">Username cannot be blank.</div>");
+        $('#user').before($("<div id=\"user_warning_msg\"/>").text(message("msg-username", "Username cannot be blank.")));
       }
     } 
 
@@ -100,7 +111,7 @@ $( document ).ready(function() {
     if (on) {
       if (!($('#new_password_fields').parent().is('div'))){
         $('#new_password_fields').wrap("<div class=\"alert alert-danger\"  role=\"alert\">");
-        $('#new_password_fields').before("<div id=\"password_warning_msg\">New passwords must match and be 9 characters or more.</div>");
+        $('#new_password_fields').before($("<div id=\"password_warning_msg\"/>").text(message("msg-passwords", "New passwords must match and be 9 characters or more.")));
 	    }
             
     } else { 
@@ -133,14 +144,40 @@ $( document ).ready(function() {
     return true;
   }
   
+  // Build the feedback shown under the password from the /check response
+  function strength_feedback(data) {
+    var reason = (data.reason || data.message).replace(/^it /, "");
+    var msg = $("<div/>").text(message("msg-reason", "Your password %s.", reason));
+    if (data.warning.length > 0) {
+      msg.append($("<div/>").text(data.warning));
+    }
+    if (data.suggestions.length > 0) {
+      var list = $("<ul/>");
+      $.each(data.suggestions, function(i, suggestion) {
+        list.append($("<li/>").text(suggestion));
+      });
+      msg.append(list);
+    }
+    return msg.html();
+  }
+
+  // Show how long the password would take to crack
+  function strength_meter(data) {
+    if ($('#password_strength_meter').length == 0) {
+      $('#new_password_fields').append("<p class=\"help-block\" id=\"password_strength_meter\"></p>");
+    }
+    $('#password_strength_meter').text(message("msg-strength", "Strength %s/4, time to crack: %s", data.score, data.crack_time));
+  }
+
   // Async call for grey out button based on cracklib check
   function password_strength(){
     is_valid['cracklib'] = false;
 
-    $.post("/check", {password : $("#p1").val()}).done( function(data) {
-      if (data.search("GOOD") == -1){
+    $.post("/check", {password : $("#p1").val(), user : $("#user").val()}, null, "json").done( function(data) {
+      strength_meter(data);
+      if (data.message.search("GOOD") == -1){
         is_valid['cracklib'] = false;
-        warning_cracklib(true,data); 
+        warning_cracklib(true,strength_feedback(data)); 
       } else {
         is_valid['cracklib'] = true;
         warning_cracklib(false,"");
@@ -178,7 +215,19 @@ $( document ).ready(function() {
     }
   }
 
+  // Fetch a random passphrase for the user to consider
+  function generate_passphrase() {
+    $.get("/generate", null, null, "json").done( function(data) {
+      $('#generated_passphrase').text(data.passphrase);
+    });
+  }
+
   // Actions to be watched out for on the form
+  $('#generate_passphrase').on('click', function(e) {
+    e.preventDefault();
+    generate_passphrase();
+  });
+
   $('#p1').on('focusout', function() {
     p1_visited = true; 
     password_strength();
@@ -0,0 +1,23 @@
+// Send the user back to the start after a delay, counting down in #timer if
+// the page has one. The delay in seconds comes from data-redirect on the body
+// so the pages need no inline script
+
+$( document ).ready(function() {
+
+  var timeleft = parseInt($('body').data('redirect'), 10);
+  if (isNaN(timeleft)) {
+    return;
+  }
+
+  $("#timer").text(timeleft);
+
+  setTimeout(function () { window.location.href = "/"; }, timeleft * 1000);
+
+  setInterval(function () {
+    if (timeleft > 0) {
+      timeleft = timeleft - 1;
+      $("#timer").text(timeleft);
+    }
+  }, 1000);
+
+});